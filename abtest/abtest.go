@@ -0,0 +1,308 @@
+// Package abtest implements an SPOE handler assigning requests to the
+// variants of experiments. A feature flag is an experiment with on and off
+// variants.
+package abtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+	"gopkg.in/yaml.v3"
+)
+
+type Variant struct {
+	Name   string `json:"name" yaml:"name"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+// Experiment assigns the value of Arg to a variant, by hashing it with the
+// experiment ID. When StickyArg carries the name of one of the variants,
+// typically read from a cookie set after the first assignment, that variant
+// is kept even if the weights changed.
+type Experiment struct {
+	ID        string    `json:"id" yaml:"id"`
+	Message   string    `json:"message" yaml:"message"`
+	Arg       string    `json:"arg" yaml:"arg"`
+	StickyArg string    `json:"sticky_arg" yaml:"sticky_arg"`
+	Variants  []Variant `json:"variants" yaml:"variants"`
+}
+
+func (e Experiment) validate() error {
+	if e.ID == "" {
+		return fmt.Errorf("experiment without id")
+	}
+	if e.Message == "" || e.Arg == "" {
+		return fmt.Errorf("experiment %s: message and arg are required", e.ID)
+	}
+	if len(e.Variants) == 0 {
+		return fmt.Errorf("experiment %s: no variant", e.ID)
+	}
+
+	names := make(map[string]bool)
+	total := 0
+	for _, v := range e.Variants {
+		if v.Name == "" {
+			return fmt.Errorf("experiment %s: variant without name", e.ID)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("experiment %s: duplicate variant %s", e.ID, v.Name)
+		}
+		names[v.Name] = true
+		if v.Weight < 0 {
+			return fmt.Errorf("experiment %s: variant %s: negative weight", e.ID, v.Name)
+		}
+		total += v.Weight
+		if total > maxWeight {
+			return fmt.Errorf("experiment %s: weights sum above %d", e.ID, maxWeight)
+		}
+	}
+	if total == 0 {
+		return fmt.Errorf("experiment %s: all weights are zero", e.ID)
+	}
+	return nil
+}
+
+// maxWeight bounds the sum of the weights of an experiment, so that the
+// ranges of slots are computed without overflow.
+const maxWeight = 1000000
+
+// buckets is the number of slots keys are hashed to. Variants own
+// consecutive ranges of slots in their order, in proportion to their weight.
+const buckets = 10000
+
+// Assign returns the variant for key. Changing weights only moves the keys
+// whose slot changes owner: when a variant grows at the expense of the one
+// before or after it, it only gains keys from that variant.
+func (e Experiment) Assign(key string) string {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(e.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	bucket := int(h.Sum64() % buckets)
+
+	cumulative := 0
+	for _, v := range e.Variants {
+		cumulative += v.Weight
+		if bucket < cumulative*buckets/total {
+			return v.Name
+		}
+	}
+	// not reached, the last range ends at buckets
+	return e.Variants[len(e.Variants)-1].Name
+}
+
+// varPrefix returns the prefix of the variables of the experiment: its ID,
+// with the characters HAProxy does not allow in variable names replaced by
+// '_'.
+func (e Experiment) varPrefix() string {
+	return strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' {
+			return c
+		}
+		return '_'
+	}, e.ID)
+}
+
+func (e Experiment) hasVariant(name string) bool {
+	for _, v := range e.Variants {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type config struct {
+	Experiments []Experiment `json:"experiments" yaml:"experiments"`
+}
+
+// LoadExperiments reads experiments from a YAML or JSON file, depending on
+// its extension.
+func LoadExperiments(path string) ([]Experiment, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("abtest: %s", err)
+	}
+
+	var cfg config
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(b, &cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &cfg)
+	default:
+		return nil, fmt.Errorf("abtest: unsupported experiments file %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("abtest: %s: %s", path, err)
+	}
+
+	ids := make(map[string]bool)
+	prefixes := make(map[string]string)
+	messages := make(map[string]bool)
+	for _, e := range cfg.Experiments {
+		err := e.validate()
+		if err != nil {
+			return nil, fmt.Errorf("abtest: %s: %s", path, err)
+		}
+		if ids[e.ID] {
+			return nil, fmt.Errorf("abtest: %s: duplicate experiment %s", path, e.ID)
+		}
+		ids[e.ID] = true
+		if other, ok := prefixes[e.varPrefix()]; ok {
+			return nil, fmt.Errorf("abtest: %s: experiments %s and %s have the same variables", path, other, e.ID)
+		}
+		prefixes[e.varPrefix()] = e.ID
+		if messages[e.Message] {
+			return nil, fmt.Errorf("abtest: %s: experiment %s: message %s is already used", path, e.ID, e.Message)
+		}
+		messages[e.Message] = true
+	}
+
+	return cfg.Experiments, nil
+}
+
+type Config struct {
+	// File holds the experiments, as YAML or JSON. Each experiment
+	// handles one message:
+	//
+	//	experiments:
+	//	  - id: checkout-v2
+	//	    message: checkout
+	//	    arg: user_id
+	//	    sticky_arg: ab_cookie
+	//	    variants:
+	//	      - name: control
+	//	        weight: 90
+	//	      - name: new-checkout
+	//	        weight: 10
+	File string
+
+	// VariantVar names the transaction variable receiving the variant and
+	// ExperimentVar the session variable receiving the experiment ID. Both
+	// are prefixed by the experiment ID, with the characters not allowed in
+	// variable names replaced by '_', such as checkout_v2.variant.
+	VariantVar    string
+	ExperimentVar string
+
+	// ReloadInterval is how often the file is checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	VariantVar:     "variant",
+	ExperimentVar:  "experiment_id",
+	ReloadInterval: 10 * time.Second,
+}
+
+// Splitter assigns variants.
+type Splitter struct {
+	cfg         Config
+	experiments atomic.Value
+	watcher     *reload.Watcher
+}
+
+// New loads the experiments of cfg and starts watching the file.
+func New(cfg Config) (*Splitter, error) {
+	s := &Splitter{cfg: cfg}
+
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	s.watcher = reload.Watch([]string{cfg.File}, cfg.ReloadInterval, s.Reload)
+	return s, nil
+}
+
+func (s *Splitter) Close() error {
+	return s.watcher.Close()
+}
+
+// Reload loads the experiments again.
+func (s *Splitter) Reload() error {
+	experiments, err := LoadExperiments(s.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	byMessage := make(map[string]Experiment, len(experiments))
+	for _, e := range experiments {
+		byMessage[e.Message] = e
+	}
+	s.experiments.Store(byMessage)
+	return nil
+}
+
+func (s *Splitter) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	experiments := s.experiments.Load().(map[string]Experiment)
+
+	var actions []spoe.Action
+	for msgs.Next() {
+		e, ok := experiments[msgs.Message.Name]
+		if !ok {
+			continue
+		}
+
+		var key, sticky string
+		for msgs.Message.Args.Next() {
+			arg := msgs.Message.Args.Arg
+			switch arg.Name {
+			case e.Arg:
+				key = argString(arg.Value)
+			case e.StickyArg:
+				sticky = argString(arg.Value)
+			}
+		}
+
+		variant := sticky
+		if e.StickyArg == "" || !e.hasVariant(variant) {
+			if key == "" {
+				continue
+			}
+			variant = e.Assign(key)
+		}
+
+		prefix := e.varPrefix() + "."
+		actions = append(actions,
+			spoe.ActionSetVar{Name: prefix + s.cfg.VariantVar, Scope: spoe.VarScopeTransaction, Value: variant},
+			spoe.ActionSetVar{Name: prefix + s.cfg.ExperimentVar, Scope: spoe.VarScopeSession, Value: e.ID},
+		)
+	}
+
+	if msgs.Error() != nil {
+		return nil, msgs.Error()
+	}
+	return actions, nil
+}
+
+func argString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case net.IP:
+		return val.String()
+	case int:
+		return strconv.Itoa(val)
+	case uint:
+		return strconv.FormatUint(uint64(val), 10)
+	}
+	return ""
+}
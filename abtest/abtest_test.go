@@ -0,0 +1,182 @@
+package abtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssign(t *testing.T) {
+	e := Experiment{
+		ID: "exp",
+		Variants: []Variant{
+			{Name: "a", Weight: 70},
+			{Name: "b", Weight: 20},
+			{Name: "c", Weight: 10},
+			{Name: "off", Weight: 0},
+		},
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		v := e.Assign(key)
+		require.Equal(t, v, e.Assign(key))
+		counts[v]++
+	}
+
+	require.InDelta(t, 7000, counts["a"], 300)
+	require.InDelta(t, 2000, counts["b"], 300)
+	require.InDelta(t, 1000, counts["c"], 300)
+	require.Zero(t, counts["off"])
+
+	// the experiment ID salts the hash
+	other := e
+	other.ID = "other"
+	changed := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		if e.Assign(key) != other.Assign(key) {
+			changed++
+		}
+	}
+	require.NotZero(t, changed)
+}
+
+func TestAssignWeightChange(t *testing.T) {
+	before := Experiment{
+		ID: "exp",
+		Variants: []Variant{
+			{Name: "a", Weight: 50},
+			{Name: "b", Weight: 40},
+			{Name: "c", Weight: 10},
+		},
+	}
+	after := before
+	after.Variants = []Variant{
+		{Name: "a", Weight: 50},
+		{Name: "b", Weight: 30},
+		{Name: "c", Weight: 20},
+	}
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		v1, v2 := before.Assign(key), after.Assign(key)
+		if v1 == v2 {
+			continue
+		}
+		// raising c only moves users into c, taken from b
+		require.Equal(t, "b", v1, key)
+		require.Equal(t, "c", v2, key)
+		moved++
+	}
+	require.InDelta(t, 1000, moved, 200)
+}
+
+func TestLoadExperiments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "abtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "experiments.json")
+	invalid := map[string]string{
+		`{"experiments": [{"message": "m", "arg": "a", "variants": [{"name": "a", "weight": 1}]}]}`:                                                                                                   "experiment without id",
+		`{"experiments": [{"id": "e", "arg": "a", "variants": [{"name": "a", "weight": 1}]}]}`:                                                                                                        "experiment e: message and arg are required",
+		`{"experiments": [{"id": "e", "message": "m", "arg": "a"}]}`:                                                                                                                                  "experiment e: no variant",
+		`{"experiments": [{"id": "e", "message": "m", "arg": "a", "variants": [{"name": "a"}]}]}`:                                                                                                     "experiment e: all weights are zero",
+		`{"experiments": [{"id": "e", "message": "m", "arg": "a", "variants": [{"name": "a", "weight": 900000}, {"name": "b", "weight": 100001}]}]}`:                                                  "experiment e: weights sum above 1000000",
+		`{"experiments": [{"id": "e-1", "message": "m", "arg": "a", "variants": [{"name": "a", "weight": 1}]}, {"id": "e_1", "message": "n", "arg": "a", "variants": [{"name": "a", "weight": 1}]}]}`: "experiments e-1 and e_1 have the same variables",
+		`{"experiments": [{"id": "e", "message": "m", "arg": "a", "variants": [{"name": "a", "weight": -1}]}]}`:                                                                                       "experiment e: variant a: negative weight",
+		`{"experiments": [{"id": "e", "message": "m", "arg": "a", "variants": [{"name": "a", "weight": 1}, {"name": "a"}]}]}`:                                                                         "experiment e: duplicate variant a",
+		`{"experiments": [{"id": "e", "message": "m", "arg": "a", "variants": [{"name": "a", "weight": 1}]}, {"id": "e", "message": "n", "arg": "a", "variants": [{"name": "a", "weight": 1}]}]}`:     "duplicate experiment e",
+		`{"experiments": [{"id": "e", "message": "m", "arg": "a", "variants": [{"name": "a", "weight": 1}]}, {"id": "f", "message": "m", "arg": "a", "variants": [{"name": "a", "weight": 1}]}]}`:     "experiment f: message m is already used",
+	}
+	for content, msg := range invalid {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, err := LoadExperiments(path)
+		require.EqualError(t, err, "abtest: "+path+": "+msg)
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "abtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "experiments.yaml")
+	write := func(weight int) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+experiments:
+  - id: checkout-v2
+    message: checkout
+    arg: user_id
+    sticky_arg: cookie
+    variants:
+      - name: control
+        weight: 100
+      - name: new
+        weight: %d
+  - id: dark-mode
+    message: flags
+    arg: src
+    variants:
+      - name: "on"
+        weight: 1
+`, weight)), 0644))
+	}
+	write(0)
+
+	cfg := DefaultConfig
+	cfg.File = path
+	cfg.ReloadInterval = 5 * time.Millisecond
+	s, err := New(cfg)
+	require.NoError(t, err)
+	defer s.Close()
+
+	handle := func(message string, args map[string]interface{}) []spoe.Action {
+		actions, err := s.Handle(spoetest.Single(message, args))
+		require.NoError(t, err)
+		return actions
+	}
+
+	require.Equal(t, []spoe.Action{
+		spoe.ActionSetVar{Name: "checkout_v2.variant", Scope: spoe.VarScopeTransaction, Value: "control"},
+		spoe.ActionSetVar{Name: "checkout_v2.experiment_id", Scope: spoe.VarScopeSession, Value: "checkout-v2"},
+	}, handle("checkout", map[string]interface{}{"user_id": "alice"}))
+
+	require.Equal(t, map[string]interface{}{"dark_mode.variant": "on", "dark_mode.experiment_id": "dark-mode"},
+		spoetest.Vars(handle("flags", map[string]interface{}{"src": net.ParseIP("192.0.2.1")})))
+
+	// all the experiments of a frame are assigned
+	actions, err := s.Handle(spoetest.Messages(
+		spoetest.Message{Name: "checkout", Args: map[string]interface{}{"user_id": "alice"}},
+		spoetest.Message{Name: "flags", Args: map[string]interface{}{"src": net.ParseIP("192.0.2.1")}},
+	))
+	require.NoError(t, err)
+	vars := spoetest.Vars(actions)
+	require.Equal(t, "control", vars["checkout_v2.variant"])
+	require.Equal(t, "on", vars["dark_mode.variant"])
+
+	// sticky assignments outlive weight changes, unknown variants are ignored
+	require.Equal(t, "new", spoetest.Vars(handle("checkout", map[string]interface{}{"user_id": "alice", "cookie": "new"}))["checkout_v2.variant"])
+	require.Equal(t, "control", spoetest.Vars(handle("checkout", map[string]interface{}{"user_id": "alice", "cookie": "gone"}))["checkout_v2.variant"])
+
+	// no key, no assignment
+	require.Empty(t, handle("checkout", map[string]interface{}{}))
+	require.Empty(t, handle("other", map[string]interface{}{"user_id": "alice"}))
+
+	write(999900)
+	require.Eventually(t, func() bool {
+		return spoetest.Vars(handle("checkout", map[string]interface{}{"user_id": "alice"}))["checkout_v2.variant"] == "new"
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, "control", spoetest.Vars(handle("checkout", map[string]interface{}{"user_id": "alice", "cookie": "control"}))["checkout_v2.variant"])
+}
@@ -6,16 +6,42 @@ import (
 	"github.com/pkg/errors"
 )
 
-type varScope byte
+// VarScope is the scope of a variable, as in HAProxy's var() sample fetch.
+type VarScope byte
 
 const (
-	VarScopeProcess     varScope = 0
-	VarScopeSession     varScope = 1
-	VarScopeTransaction varScope = 2
-	VarScopeRequest     varScope = 3
-	VarScopeResponse    varScope = 4
+	VarScopeProcess     VarScope = 0
+	VarScopeSession     VarScope = 1
+	VarScopeTransaction VarScope = 2
+	VarScopeRequest     VarScope = 3
+	VarScopeResponse    VarScope = 4
 )
 
+// Short names of the scopes.
+const (
+	Proc = VarScopeProcess
+	Sess = VarScopeSession
+	Txn  = VarScopeTransaction
+	Req  = VarScopeRequest
+	Res  = VarScopeResponse
+)
+
+var scopeNames = map[VarScope]string{
+	VarScopeProcess:     "proc",
+	VarScopeSession:     "sess",
+	VarScopeTransaction: "txn",
+	VarScopeRequest:     "req",
+	VarScopeResponse:    "res",
+}
+
+// String returns the name HAProxy uses for the scope.
+func (s VarScope) String() string {
+	if name, ok := scopeNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("scope(%d)", byte(s))
+}
+
 const (
 	actionTypeSetVar   byte = 1
 	actionTypeUnsetVar byte = 2
@@ -27,7 +53,7 @@ type Action interface {
 
 type ActionSetVar struct {
 	Name  string
-	Scope varScope
+	Scope VarScope
 	Value interface{}
 }
 
@@ -53,7 +79,7 @@ func (a ActionSetVar) encode(b []byte) (int, error) {
 
 type ActionUnsetVar struct {
 	Name  string
-	Scope varScope
+	Scope VarScope
 }
 
 func (a ActionUnsetVar) encode(b []byte) (int, error) {
@@ -75,3 +101,41 @@ func (a ActionUnsetVar) encode(b []byte) (int, error) {
 
 	return off, nil
 }
+
+// DecodeActions decodes the actions of an ack frame payload. Values are
+// decoded as message args are, so integers are int or uint.
+func DecodeActions(b []byte) ([]Action, error) {
+	var actions []Action
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("decode action: unterminated sequence")
+		}
+
+		atype, scope := b[0], VarScope(b[2])
+		b = b[3:]
+
+		switch atype {
+		case actionTypeSetVar:
+			name, value, n, err := decodeKV(b)
+			if err != nil {
+				return nil, errors.Wrap(err, "decode action")
+			}
+			b = b[n:]
+			actions = append(actions, ActionSetVar{Name: name, Scope: scope, Value: value})
+
+		case actionTypeUnsetVar:
+			name, n, err := decodeString(b)
+			if err != nil {
+				return nil, errors.Wrap(err, "decode action")
+			}
+			b = b[n:]
+			actions = append(actions, ActionUnsetVar{Name: name, Scope: scope})
+
+		default:
+			return nil, fmt.Errorf("decode action: unknown action type %d", atype)
+		}
+	}
+
+	return actions, nil
+}
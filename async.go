@@ -0,0 +1,150 @@
+package spoe
+
+import (
+	"sync"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// AsyncHandler handles the messages of a notify frame and acknowledges it
+// through r, possibly after returning and from another goroutine. The
+// messages must be consumed before returning: their data is released once
+// the handler returns.
+//
+// When the handler returns an error, the frame is not acknowledged.
+type AsyncHandler func(msgs *MessageIterator, r *Responder) error
+
+var (
+	ErrAlreadyResponded = errors.New("spoe: frame already acknowledged")
+	ErrEngineClosed     = errors.New("spoe: engine closed")
+)
+
+// Responder sends the ack of a single notify frame. If Respond is not called
+// before Config.AsyncTimeout, an empty ack is sent.
+type Responder struct {
+	streamID int
+	frameID  int
+
+	acks       chan Frame
+	engineDone <-chan struct{}
+	// engine, when set, tracks the responder while its timer is pending
+	engine *Engine
+
+	lock  sync.Mutex
+	done  bool
+	timer *time.Timer
+}
+
+func NewAsync(h AsyncHandler) *Agent {
+	return NewAsyncWithConfig(h, defaultConfig)
+}
+
+func NewAsyncWithConfig(h AsyncHandler, cfg Config) *Agent {
+	a := NewWithConfig(nil, cfg)
+	a.AsyncHandler = h
+	return a
+}
+
+func (r *Responder) StreamID() int {
+	return r.streamID
+}
+
+func (r *Responder) FrameID() int {
+	return r.frameID
+}
+
+// Respond acknowledges the frame with the given actions. It can be called
+// from any goroutine, only the first successful call sends an ack.
+func (r *Responder) Respond(actions []Action) error {
+	r.lock.Lock()
+	if r.done {
+		r.lock.Unlock()
+		return ErrAlreadyResponded
+	}
+
+	f := Frame{
+		streamID:     r.streamID,
+		frameID:      r.frameID,
+		originalData: pool.Get(maxFrameSize),
+	}
+	err := encodeAck(&f, actions)
+	if err != nil {
+		r.lock.Unlock()
+		pool.Put(f.originalData)
+		return errors.Wrap(err, "respond")
+	}
+	r.finish()
+	r.lock.Unlock()
+
+	// send without holding the lock: the reply loop may be slow and the
+	// async timeout must not block on it
+	select {
+	case r.acks <- f:
+		return nil
+	case <-r.engineDone:
+		pool.Put(f.originalData)
+		return ErrEngineClosed
+	}
+}
+
+// cancel marks the frame as handled without sending an ack.
+func (r *Responder) cancel() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.finish()
+}
+
+func (r *Responder) finish() {
+	r.done = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.engine != nil {
+		r.engine.removeResponder(r)
+	}
+}
+
+func (c *conn) handleNotifyAsync(f Frame, acks chan Frame) error {
+	defer pool.Put(f.originalData)
+
+	messages := NewMessageIterator(f.data)
+	messages.engine = c.engine
+
+	r := &Responder{
+		streamID:   f.streamID,
+		frameID:    f.frameID,
+		acks:       acks,
+		engineDone: c.engine.done,
+	}
+
+	if c.cfg.AsyncTimeout > 0 && c.engine.addResponder(r) {
+		r.lock.Lock()
+		r.engine = c.engine
+		r.timer = time.AfterFunc(c.cfg.AsyncTimeout, func() {
+			err := r.Respond(nil)
+			// the engine is closed when HAProxy closes its connections,
+			// nobody is left to ack
+			if err != nil && err != ErrAlreadyResponded && err != ErrEngineClosed {
+				log.Errorf("spoe: error sending ack after async timeout: %s", err)
+			}
+		})
+		r.lock.Unlock()
+	}
+
+	err := c.asyncHandler(messages, r)
+	if err != nil {
+		r.cancel()
+
+		var disconnect *DisconnectError
+		if errors.As(err, &disconnect) {
+			c.requestDisconnect(disconnect)
+			return nil
+		}
+		return errors.Wrap(err, "handle notify")
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package spoe
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func serveAsync(t *testing.T, cfg Config, h AsyncHandler) *codec {
+	spoa := NewAsyncWithConfig(h, cfg)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	go spoa.Serve(lis)
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	cod := newCodec(client, defaultConfig)
+	require.NoError(t, cod.encodeFrame(helloFrame(t)))
+	res := Frame{}
+	ok, err := cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	return cod
+}
+
+func TestAsyncRespond(t *testing.T) {
+	responses := make(chan error, 2)
+
+	cod := serveAsync(t, defaultConfig, func(msgs *MessageIterator, r *Responder) error {
+		for msgs.Next() {
+		}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			responses <- r.Respond([]Action{
+				ActionSetVar{Name: "foo", Scope: VarScopeTransaction, Value: "bar"},
+			})
+			responses <- r.Respond(nil)
+		}()
+		return nil
+	})
+
+	req := notifyFrame(t)
+	require.NoError(t, cod.encodeFrame(req))
+
+	res := Frame{}
+	ok, err := cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	require.Equal(t, frameTypeAgentACK, res.ftype)
+	require.Equal(t, req.streamID, res.streamID)
+	require.Equal(t, req.frameID, res.frameID)
+	require.NotEmpty(t, res.data)
+
+	require.NoError(t, <-responses)
+	require.Equal(t, ErrAlreadyResponded, <-responses)
+}
+
+func TestAsyncTimeout(t *testing.T) {
+	cfg := defaultConfig
+	cfg.AsyncTimeout = 20 * time.Millisecond
+
+	responders := make(chan *Responder, 1)
+	cod := serveAsync(t, cfg, func(msgs *MessageIterator, r *Responder) error {
+		responders <- r
+		return nil
+	})
+
+	req := notifyFrame(t)
+	require.NoError(t, cod.encodeFrame(req))
+
+	res := Frame{}
+	ok, err := cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	require.Equal(t, frameTypeAgentACK, res.ftype)
+	require.Equal(t, req.frameID, res.frameID)
+	require.Empty(t, res.data)
+
+	r := <-responders
+	require.Equal(t, req.streamID, r.StreamID())
+	require.Equal(t, ErrAlreadyResponded, r.Respond(nil))
+}
+
+func TestAsyncRespondBlocked(t *testing.T) {
+	engineDone := make(chan struct{})
+	r := &Responder{
+		acks:       make(chan Frame),
+		engineDone: engineDone,
+	}
+
+	first := make(chan error, 1)
+	go func() {
+		first <- r.Respond(nil)
+	}()
+
+	require.Eventually(t, func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.done
+	}, time.Second, time.Millisecond)
+
+	// a pending send does not keep other calls waiting
+	require.Equal(t, ErrAlreadyResponded, r.Respond(nil))
+
+	close(engineDone)
+	require.Equal(t, ErrEngineClosed, <-first)
+}
+
+func TestAsyncEngineRelease(t *testing.T) {
+	e := &Engine{done: make(chan struct{})}
+
+	r := &Responder{engine: e}
+	require.True(t, e.addResponder(r))
+	r.timer = time.AfterFunc(time.Hour, func() {})
+
+	e.release()
+
+	// the pending timer is stopped and the responder is done
+	require.False(t, r.timer.Stop())
+	require.Equal(t, ErrAlreadyResponded, r.Respond(nil))
+	require.Empty(t, e.responders)
+
+	require.False(t, e.addResponder(&Responder{}))
+}
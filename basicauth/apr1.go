@@ -0,0 +1,86 @@
+package basicauth
+
+import (
+	"crypto/md5"
+)
+
+const apr1Magic = "$apr1$"
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes the Apache variant of the MD5-based crypt, as generated by
+// htpasswd -m.
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Magic))
+	h.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	out := make([]byte, 0, len(apr1Magic)+len(salt)+1+22)
+	out = append(out, apr1Magic...)
+	out = append(out, salt...)
+	out = append(out, '$')
+
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+
+	return string(out)
+}
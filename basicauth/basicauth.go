@@ -0,0 +1,187 @@
+// Package basicauth implements an SPOE handler checking HTTP basic
+// authentication credentials against an htpasswd file.
+package basicauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/lru"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+)
+
+type Config struct {
+	// File is the htpasswd file.
+	File string
+
+	// Message names the message to handle. The credentials are read from
+	// the Authorization header of its HeadersArg arg.
+	Message    string
+	HeadersArg string
+
+	// UserVar and OkVar name the transaction variables set by the handler.
+	// The user variable is only set on successful authentication.
+	UserVar string
+	OkVar   string
+
+	// CacheSize and CacheTTL bound the cache of successful verifications,
+	// which avoids running bcrypt on every request. A zero CacheSize
+	// disables the cache.
+	CacheSize int
+	CacheTTL  time.Duration
+
+	// ReloadInterval is how often the file is checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	Message:        "basic-auth",
+	HeadersArg:     "req.hdrs_bin",
+	UserVar:        "auth_user",
+	OkVar:          "auth_ok",
+	CacheSize:      10000,
+	CacheTTL:       5 * time.Minute,
+	ReloadInterval: 10 * time.Second,
+}
+
+// dummyHash is a bcrypt hash with the default cost, checked for unknown
+// users.
+const dummyHash = "$2a$10$BylUoCPpunRpfsXcNPz0heXsQt.bvx1JBLGTRSCUQxzesIIz0FNFa"
+
+// Authenticator checks credentials.
+type Authenticator struct {
+	cfg     Config
+	users   atomic.Value
+	cache   *lru.Cache
+	watcher *reload.Watcher
+}
+
+// New loads the htpasswd file of cfg and starts watching it.
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{cfg: cfg}
+	if cfg.CacheSize > 0 {
+		a.cache = lru.New(cfg.CacheSize)
+	}
+
+	err := a.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	a.watcher = reload.Watch([]string{cfg.File}, cfg.ReloadInterval, a.Reload)
+	return a, nil
+}
+
+func (a *Authenticator) Close() error {
+	return a.watcher.Close()
+}
+
+// Reload loads the htpasswd file again and empties the cache.
+func (a *Authenticator) Reload() error {
+	users, err := loadFile(a.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	a.users.Store(users)
+	if a.cache != nil {
+		a.cache.Purge()
+	}
+	return nil
+}
+
+// Authenticate reports whether password is valid for user.
+func (a *Authenticator) Authenticate(user, password string) bool {
+	hash, ok := a.users.Load().(map[string]string)[user]
+	if !ok {
+		// spend as long as for a known user so that the response time does
+		// not tell which users exist
+		verify(dummyHash, password)
+		return false
+	}
+
+	// only a digest of the password is kept in memory
+	var key string
+	if a.cache != nil {
+		sum := sha256.Sum256([]byte(password))
+		key = user + "\x00" + hash + "\x00" + string(sum[:])
+		if _, ok := a.cache.Get(key); ok {
+			return true
+		}
+	}
+
+	if !verify(hash, password) {
+		return false
+	}
+
+	if a.cache != nil {
+		a.cache.Add(key, struct{}{}, a.cfg.CacheTTL)
+	}
+	return true
+}
+
+func (a *Authenticator) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != a.cfg.Message {
+			continue
+		}
+
+		var headers []byte
+		for msgs.Message.Args.Next() {
+			arg := msgs.Message.Args.Arg
+			if arg.Name != a.cfg.HeadersArg {
+				continue
+			}
+
+			var ok bool
+			headers, ok = arg.Value.([]byte)
+			if !ok {
+				return nil, fmt.Errorf("basicauth: expected binary in arg %s, got %T", arg.Name, arg.Value)
+			}
+		}
+
+		authorization, _, err := spoe.LookupHeader(headers, "authorization")
+		if err != nil {
+			return nil, fmt.Errorf("basicauth: %s", err)
+		}
+
+		user, password, ok := parseBasicAuth(authorization)
+		if !ok || !a.Authenticate(user, password) {
+			return []spoe.Action{
+				spoe.ActionSetVar{Name: a.cfg.OkVar, Scope: spoe.VarScopeTransaction, Value: false},
+			}, nil
+		}
+
+		return []spoe.Action{
+			spoe.ActionSetVar{Name: a.cfg.OkVar, Scope: spoe.VarScopeTransaction, Value: true},
+			spoe.ActionSetVar{Name: a.cfg.UserVar, Scope: spoe.VarScopeTransaction, Value: user},
+		}, nil
+	}
+
+	return nil, msgs.Error()
+}
+
+// parseBasicAuth works like http.Request.BasicAuth.
+func parseBasicAuth(auth string) (string, string, bool) {
+	const prefix = "basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+
+	s := string(b)
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
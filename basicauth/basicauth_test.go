@@ -0,0 +1,112 @@
+package basicauth
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAPR1(t *testing.T) {
+	// generated with openssl passwd -apr1
+	require.Equal(t, "$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0", apr1("password", "xxxxxxxx"))
+	require.Equal(t, "$apr1$ab12$iH1uY.MRJOdNQaOQUSpUS0", apr1("a much longer password than sixteen", "ab12"))
+}
+
+func TestVerify(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	hashes := []string{
+		string(bc),
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"$apr1$xxxxxxxx$/mULyOsdWlXlIt5U99q7h1",
+	}
+	for _, hash := range hashes {
+		require.True(t, supported(hash), hash)
+		require.True(t, verify(hash, "secret"), hash)
+		require.False(t, verify(hash, "Secret"), hash)
+	}
+
+	require.False(t, supported("plain"))
+
+	// the hash checked for unknown users must cost as much as real ones
+	cost, err := bcrypt.Cost([]byte(dummyHash))
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.DefaultCost, cost)
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	user, password, ok := parseBasicAuth("Basic " + base64.StdEncoding.EncodeToString([]byte("alice:a:b")))
+	require.True(t, ok)
+	require.Equal(t, "alice", user)
+	require.Equal(t, "a:b", password)
+
+	for _, auth := range []string{"", "Bearer abc", "Basic !!!", "basic " + base64.StdEncoding.EncodeToString([]byte("alice"))} {
+		_, _, ok := parseBasicAuth(auth)
+		require.False(t, ok, auth)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basicauth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bc, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "htpasswd")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# users\nalice:"+string(bc)+"\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644))
+
+	cfg := DefaultConfig
+	cfg.File = path
+	cfg.ReloadInterval = 5 * time.Millisecond
+	a, err := New(cfg)
+	require.NoError(t, err)
+	defer a.Close()
+
+	handle := func(user, password string) map[string]interface{} {
+		headers, err := spoe.EncodeHeaders(http.Header{
+			"Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))},
+		})
+		require.NoError(t, err)
+
+		actions, err := a.Handle(spoetest.Single("basic-auth", map[string]interface{}{"req.hdrs_bin": headers}))
+		require.NoError(t, err)
+		return spoetest.Vars(actions)
+	}
+
+	require.Equal(t, map[string]interface{}{"auth_ok": true, "auth_user": "alice"}, handle("alice", "secret"))
+	require.Equal(t, 1, a.cache.Len())
+	require.Equal(t, map[string]interface{}{"auth_ok": true, "auth_user": "alice"}, handle("alice", "secret"))
+	require.Equal(t, map[string]interface{}{"auth_ok": false}, handle("alice", "wrong"))
+	require.Equal(t, map[string]interface{}{"auth_ok": true, "auth_user": "bob"}, handle("bob", "secret"))
+	require.Equal(t, map[string]interface{}{"auth_ok": false}, handle("carol", "secret"))
+
+	actions, err := a.Handle(spoetest.Single("basic-auth", map[string]interface{}{}))
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"auth_ok": false}, spoetest.Vars(actions))
+
+	// invalid files are not loaded
+	require.NoError(t, ioutil.WriteFile(path, []byte("alice\n"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, true, handle("alice", "secret")["auth_ok"])
+
+	// removed users are rejected even when cached
+	require.NoError(t, ioutil.WriteFile(path, []byte("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644))
+	require.Eventually(t, func() bool {
+		return handle("alice", "secret")["auth_ok"] == false
+	}, time.Second, 5*time.Millisecond)
+
+	_, err = a.Handle(spoetest.Single("basic-auth", map[string]interface{}{"req.hdrs_bin": "x"}))
+	require.Error(t, err)
+}
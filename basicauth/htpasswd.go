@@ -0,0 +1,78 @@
+package basicauth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func loadFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("basicauth: %s", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(l, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("basicauth: %s:%d: expected user:hash", path, line)
+		}
+		user, hash := l[:i], l[i+1:]
+		if !supported(hash) {
+			return nil, fmt.Errorf("basicauth: %s:%d: unsupported hash for user %s", path, line, user)
+		}
+		users[user] = hash
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("basicauth: %s: %s", path, err)
+	}
+
+	return users, nil
+}
+
+func supported(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return true
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	case strings.HasPrefix(hash, apr1Magic):
+		return true
+	}
+	return false
+}
+
+// verify reports whether password matches an htpasswd hash.
+func verify(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(expected)) == 1
+
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := hash[len(apr1Magic):]
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
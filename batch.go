@@ -0,0 +1,209 @@
+package spoe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrBatcherClosed = errors.New("spoe: batcher closed")
+
+// BatchMessage is a copy of a message which remains valid after the frame
+// has been acknowledged.
+type BatchMessage struct {
+	Name string
+	Args map[string]interface{}
+}
+
+// BatchRequest holds the messages of a single notify frame.
+type BatchRequest struct {
+	Messages []BatchMessage
+}
+
+// BatchHandler handles the requests of many frames at once. It returns the
+// actions of each request, in the order of reqs. An error fails all the
+// requests of the batch.
+type BatchHandler func(reqs []BatchRequest) ([][]Action, error)
+
+type BatchConfig struct {
+	// MaxItems is the number of messages which triggers a batch.
+	MaxItems int
+	// MaxDelay is the longest a message waits for its batch.
+	MaxDelay time.Duration
+}
+
+var defaultBatchConfig = BatchConfig{
+	MaxItems: 100,
+	MaxDelay: time.Millisecond,
+}
+
+type batchResult struct {
+	actions []Action
+	err     error
+}
+
+type batchItem struct {
+	req    BatchRequest
+	result chan batchResult
+}
+
+// Batcher collects the messages of concurrent notify frames and hands them
+// to a BatchHandler in batches.
+type Batcher struct {
+	handler BatchHandler
+	cfg     BatchConfig
+
+	items     chan batchItem
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func NewBatcher(h BatchHandler) *Batcher {
+	return NewBatcherWithConfig(h, defaultBatchConfig)
+}
+
+func NewBatcherWithConfig(h BatchHandler, cfg BatchConfig) *Batcher {
+	if cfg.MaxItems <= 0 {
+		cfg.MaxItems = defaultBatchConfig.MaxItems
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaultBatchConfig.MaxDelay
+	}
+
+	b := &Batcher{
+		handler: h,
+		cfg:     cfg,
+		items:   make(chan batchItem),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Handle queues the messages in the next batch and waits for its result.
+func (b *Batcher) Handle(msgs *MessageIterator) ([]Action, error) {
+	item := batchItem{
+		result: make(chan batchResult, 1),
+	}
+
+	for msgs.Next() {
+		msg := BatchMessage{
+			Name: msgs.Message.Name,
+			Args: make(map[string]interface{}, msgs.Message.Args.Count()),
+		}
+		for msgs.Message.Args.Next() {
+			arg := msgs.Message.Args.Arg
+			msg.Args[arg.Name] = cloneValue(arg.Value)
+		}
+		item.req.Messages = append(item.req.Messages, msg)
+	}
+	if msgs.Error() != nil {
+		return nil, msgs.Error()
+	}
+
+	select {
+	case b.items <- item:
+	case <-b.closed:
+		return nil, ErrBatcherClosed
+	}
+
+	res := <-item.result
+	return res.actions, res.err
+}
+
+// Close flushes the pending messages and stops the batcher. It can be
+// called several times.
+func (b *Batcher) Close() {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	<-b.done
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+
+	var (
+		batch   []batchItem
+		count   int
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(batch) > 0 {
+			go b.process(batch)
+		}
+		batch, count = nil, 0
+	}
+
+	for {
+		select {
+		case item := <-b.items:
+			batch = append(batch, item)
+			count += len(item.req.Messages)
+			if timer == nil {
+				timer = time.NewTimer(b.cfg.MaxDelay)
+				timeout = timer.C
+			}
+			if count >= b.cfg.MaxItems {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		case <-b.closed:
+			flush()
+			return
+		}
+	}
+}
+
+func (b *Batcher) process(batch []batchItem) {
+	reqs := make([]BatchRequest, len(batch))
+	for i, item := range batch {
+		reqs[i] = item.req
+	}
+
+	actions, err := b.call(reqs)
+	if err == nil && len(actions) != len(reqs) {
+		err = fmt.Errorf("spoe: batch handler returned %d results for %d requests", len(actions), len(reqs))
+	}
+
+	for i, item := range batch {
+		if err != nil {
+			item.result <- batchResult{err: err}
+			continue
+		}
+		item.result <- batchResult{actions: actions[i]}
+	}
+}
+
+// call runs the handler, turning a panic into an error so that the waiters
+// of the batch are released.
+func (b *Batcher) call(reqs []BatchRequest) (actions [][]Action, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			actions, err = nil, fmt.Errorf("spoe: batch handler panicked: %v", r)
+		}
+	}()
+	return b.handler(reqs)
+}
+
+// cloneValue copies the arg values referencing the frame buffer.
+func cloneValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []byte:
+		return append([]byte(nil), val...)
+	case net.IP:
+		return append(net.IP(nil), val...)
+	}
+	return v
+}
@@ -0,0 +1,121 @@
+package spoe
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func batchTestIterator(t *testing.T, value string) *MessageIterator {
+	b := make([]byte, 256)
+	m := 0
+
+	n, err := encodeString(b[m:], "ip-rep")
+	require.NoError(t, err)
+	m += n
+	b[m] = 1
+	m++
+	n, err = encodeKV(b[m:], "ip", []byte(value))
+	require.NoError(t, err)
+	m += n
+
+	return NewMessageIterator(b[:m])
+}
+
+func TestBatcher(t *testing.T) {
+	var lock sync.Mutex
+	var sizes []int
+
+	b := NewBatcherWithConfig(func(reqs []BatchRequest) ([][]Action, error) {
+		lock.Lock()
+		sizes = append(sizes, len(reqs))
+		lock.Unlock()
+
+		res := make([][]Action, len(reqs))
+		for i, req := range reqs {
+			res[i] = []Action{ActionSetVar{
+				Name:  "ip",
+				Scope: VarScopeTransaction,
+				Value: string(req.Messages[0].Args["ip"].([]byte)),
+			}}
+		}
+		return res, nil
+	}, BatchConfig{MaxItems: 4, MaxDelay: time.Second})
+	defer b.Close()
+
+	type result struct {
+		value   string
+		actions []Action
+		err     error
+	}
+	results := make(chan result, 8)
+	for i := 0; i < 8; i++ {
+		value := string(rune('a' + i))
+		msgs := batchTestIterator(t, value)
+		go func() {
+			actions, err := b.Handle(msgs)
+			results <- result{value, actions, err}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		res := <-results
+		require.NoError(t, res.err)
+		require.Equal(t, res.value, res.actions[0].(ActionSetVar).Value)
+	}
+
+	require.Equal(t, []int{4, 4}, sizes)
+}
+
+func TestBatcherDelay(t *testing.T) {
+	b := NewBatcherWithConfig(func(reqs []BatchRequest) ([][]Action, error) {
+		return make([][]Action, len(reqs)), nil
+	}, BatchConfig{MaxItems: 100, MaxDelay: 10 * time.Millisecond})
+
+	start := time.Now()
+	_, err := b.Handle(batchTestIterator(t, "a"))
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 10*time.Millisecond)
+
+	b.Close()
+	_, err = b.Handle(batchTestIterator(t, "a"))
+	require.Equal(t, ErrBatcherClosed, err)
+	b.Close()
+}
+
+func TestBatcherErrors(t *testing.T) {
+	failure := errors.New("backend down")
+	b := NewBatcherWithConfig(func(reqs []BatchRequest) ([][]Action, error) {
+		return nil, failure
+	}, BatchConfig{MaxItems: 1})
+	defer b.Close()
+
+	_, err := b.Handle(batchTestIterator(t, "a"))
+	require.Equal(t, failure, err)
+
+	b = NewBatcherWithConfig(func(reqs []BatchRequest) ([][]Action, error) {
+		return nil, nil
+	}, BatchConfig{MaxItems: 1})
+	defer b.Close()
+
+	_, err = b.Handle(batchTestIterator(t, "a"))
+	require.Error(t, err)
+
+	b = NewBatcherWithConfig(func(reqs []BatchRequest) ([][]Action, error) {
+		panic("boom")
+	}, BatchConfig{MaxItems: 1})
+	defer b.Close()
+
+	_, err = b.Handle(batchTestIterator(t, "a"))
+	require.EqualError(t, err, "spoe: batch handler panicked: boom")
+}
+
+func TestCloneValue(t *testing.T) {
+	b := []byte("abc")
+	c := cloneValue(b).([]byte)
+	b[0] = 'x'
+	require.Equal(t, "abc", string(c))
+	require.Equal(t, 42, cloneValue(42))
+}
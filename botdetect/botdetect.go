@@ -0,0 +1,264 @@
+// Package botdetect implements an SPOE handler scoring clients on their
+// recent behaviour.
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/lru"
+)
+
+const maxScore = 100
+
+// Signal adds Points to the score when its value exceeds Threshold. Signals
+// without points are ignored.
+type Signal struct {
+	Threshold float64
+	Points    int
+}
+
+func (s Signal) score(v float64) int {
+	if s.Points != 0 && v > s.Threshold {
+		return s.Points
+	}
+	return 0
+}
+
+type Scoring struct {
+	// RequestRate is the number of requests in the window.
+	RequestRate Signal
+	// PathRate is the number of requests to the most requested path.
+	PathRate Signal
+	// DistinctPaths is the number of paths requested.
+	DistinctPaths Signal
+	// ErrorRatio is the fraction of the requests answered with an error
+	// status.
+	ErrorRatio Signal
+	// AnomalyRatio is the fraction of the requests missing one of the
+	// required headers.
+	AnomalyRatio Signal
+	// MissingHeader is checked for the current request only, its
+	// threshold is ignored.
+	MissingHeader Signal
+
+	// MinRequests is the number of requests in the window below which
+	// the ratios are ignored.
+	MinRequests float64
+}
+
+type Config struct {
+	// RequestMessage names the message sent for requests, which gets the
+	// score back, and ResponseMessage the one sent for responses.
+	RequestMessage  string
+	ResponseMessage string
+
+	// KeyArgs are the args identifying the client, in both messages.
+	KeyArgs []string
+	// PathArg and HeadersArg are read from requests, StatusArg from
+	// responses. Statuses from 400 are errors.
+	PathArg    string
+	HeadersArg string
+	StatusArg  string
+
+	// RequiredHeaders are the headers whose absence is an anomaly. When
+	// set, requests must carry HeadersArg.
+	RequiredHeaders []string
+
+	Window time.Duration
+	// MaxClients bounds the number of clients tracked, and MaxPaths the
+	// number of paths tracked per client.
+	MaxClients int
+	MaxPaths   int
+
+	Scoring  Scoring
+	ScoreVar string
+}
+
+var DefaultConfig = Config{
+	RequestMessage:  "bot-req",
+	ResponseMessage: "bot-res",
+	KeyArgs:         []string{"src"},
+	PathArg:         "path",
+	HeadersArg:      "req.hdrs_bin",
+	StatusArg:       "status",
+	RequiredHeaders: []string{"User-Agent", "Accept", "Accept-Language"},
+	Window:          time.Minute,
+	MaxClients:      100000,
+	MaxPaths:        100,
+	Scoring: Scoring{
+		RequestRate:   Signal{Threshold: 300, Points: 30},
+		PathRate:      Signal{Threshold: 60, Points: 20},
+		DistinctPaths: Signal{Threshold: 50, Points: 20},
+		ErrorRatio:    Signal{Threshold: 0.5, Points: 20},
+		AnomalyRatio:  Signal{Threshold: 0.5, Points: 20},
+		MissingHeader: Signal{Points: 10},
+		MinRequests:   10,
+	},
+	ScoreVar: "bot_score",
+}
+
+// Detector scores clients.
+type Detector struct {
+	cfg Config
+
+	lock    sync.Mutex
+	clients *lru.Cache
+
+	now func() time.Time
+}
+
+func New(cfg Config) (*Detector, error) {
+	if cfg.Window <= 0 {
+		return nil, fmt.Errorf("botdetect: window must be positive")
+	}
+	if len(cfg.KeyArgs) == 0 {
+		return nil, fmt.Errorf("botdetect: no key arg")
+	}
+	if cfg.MaxClients <= 0 || cfg.MaxPaths <= 0 {
+		return nil, fmt.Errorf("botdetect: max clients and max paths must be positive")
+	}
+	if cfg.Scoring.MinRequests <= 0 {
+		return nil, fmt.Errorf("botdetect: min requests must be positive")
+	}
+
+	return &Detector{
+		cfg:     cfg,
+		clients: lru.New(cfg.MaxClients),
+		now:     time.Now,
+	}, nil
+}
+
+func (d *Detector) client(key string, now time.Time) *client {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if c, ok := d.clients.Get(key); ok {
+		return c.(*client)
+	}
+	c := newClient(d.cfg.Window, now)
+	d.clients.Add(key, c, 0)
+	return c
+}
+
+func (d *Detector) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	now := d.now()
+
+	for msgs.Next() {
+		switch msgs.Message.Name {
+		case d.cfg.RequestMessage:
+			args := msgs.Message.Args.Map()
+			key, ok := d.key(args)
+			if !ok {
+				continue
+			}
+
+			score, err := d.request(key, args, now)
+			if err != nil {
+				return nil, err
+			}
+			return []spoe.Action{
+				spoe.ActionSetVar{Name: d.cfg.ScoreVar, Scope: spoe.VarScopeSession, Value: score},
+			}, nil
+
+		case d.cfg.ResponseMessage:
+			args := msgs.Message.Args.Map()
+			key, ok := d.key(args)
+			if !ok {
+				continue
+			}
+
+			status, err := argInt(args, d.cfg.StatusArg)
+			if err != nil {
+				return nil, err
+			}
+			d.client(key, now).response(now, status >= 400)
+		}
+	}
+
+	return nil, msgs.Error()
+}
+
+func (d *Detector) request(key string, args map[string]interface{}, now time.Time) (int, error) {
+	path, _ := args[d.cfg.PathArg].(string)
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+
+	missing := 0
+	if len(d.cfg.RequiredHeaders) > 0 {
+		// without headers, every client would look anomalous
+		b, ok := args[d.cfg.HeadersArg].([]byte)
+		if !ok {
+			return 0, fmt.Errorf("botdetect: expected binary in arg %s, got %T", d.cfg.HeadersArg, args[d.cfg.HeadersArg])
+		}
+		headers, err := spoe.DecodeHeaders(b)
+		if err != nil {
+			return 0, fmt.Errorf("botdetect: %s", err)
+		}
+		for _, h := range d.cfg.RequiredHeaders {
+			if headers.Get(h) == "" {
+				missing++
+			}
+		}
+	}
+
+	f := d.client(key, now).request(now, path, missing > 0, d.cfg.MaxPaths)
+
+	s := d.cfg.Scoring
+	score := s.RequestRate.score(f.requests) +
+		s.PathRate.score(f.maxPath) +
+		s.DistinctPaths.score(float64(f.distinctPaths)) +
+		missing*s.MissingHeader.Points
+	if f.requests >= s.MinRequests {
+		score += s.ErrorRatio.score(f.errorRatio) + s.AnomalyRatio.score(f.anomalyRatio)
+	}
+
+	if score > maxScore {
+		score = maxScore
+	}
+	return score, nil
+}
+
+func (d *Detector) key(args map[string]interface{}) (string, bool) {
+	var b strings.Builder
+	found := false
+	for i, name := range d.cfg.KeyArgs {
+		if i > 0 {
+			b.WriteByte(0)
+		}
+		switch v := args[name].(type) {
+		case string:
+			b.WriteString(v)
+		case []byte:
+			b.Write(v)
+		case net.IP:
+			b.WriteString(v.String())
+		case int:
+			b.WriteString(strconv.Itoa(v))
+		case uint:
+			b.WriteString(strconv.FormatUint(uint64(v), 10))
+		default:
+			continue
+		}
+		found = true
+	}
+	return b.String(), found
+}
+
+func argInt(args map[string]interface{}, name string) (int, error) {
+	switch v := args[name].(type) {
+	case int:
+		return v, nil
+	case uint:
+		return int(v), nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("botdetect: expected integer in arg %s, got %T", name, args[name])
+}
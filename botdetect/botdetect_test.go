@@ -0,0 +1,138 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := newClient(time.Minute, start)
+
+	for i := 0; i < 10; i++ {
+		c.request(start, fmt.Sprintf("/%d", i%2), false, 1)
+	}
+	c.response(start, true)
+
+	// a quarter into the next window, 3/4 of the previous one is counted
+	f := c.request(start.Add(75*time.Second), "/0", true, 1)
+	require.Equal(t, 8.5, f.requests)
+	require.Equal(t, 4.75, f.maxPath)
+	require.Equal(t, 1, f.distinctPaths)
+	require.InDelta(t, 0.75/8.5, f.errorRatio, 1e-9)
+	require.InDelta(t, 1/8.5, f.anomalyRatio, 1e-9)
+
+	// the counters are reset after two windows
+	f = c.request(start.Add(200*time.Second), "/0", false, 1)
+	require.Equal(t, features{requests: 1, maxPath: 1, distinctPaths: 1}, f)
+}
+
+func TestDetector(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.KeyArgs = []string{"src", "ja3"}
+	cfg.Scoring = Scoring{
+		RequestRate:   Signal{Threshold: 20, Points: 30},
+		PathRate:      Signal{Threshold: 10, Points: 20},
+		DistinctPaths: Signal{Threshold: 5, Points: 40},
+		ErrorRatio:    Signal{Threshold: 0.5, Points: 25},
+		AnomalyRatio:  Signal{Threshold: 0.5},
+		MissingHeader: Signal{Points: 10},
+		MinRequests:   6,
+	}
+	d, err := New(cfg)
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+
+	browser, err := spoe.EncodeHeaders(http.Header{
+		"User-Agent":      []string{"Mozilla/5.0"},
+		"Accept":          []string{"text/html"},
+		"Accept-Language": []string{"en"},
+	})
+	require.NoError(t, err)
+	script, err := spoe.EncodeHeaders(http.Header{"User-Agent": []string{"curl/7.68.0"}})
+	require.NoError(t, err)
+
+	request := func(ip, path string, headers []byte) int {
+		actions, err := d.Handle(spoetest.Single("bot-req", map[string]interface{}{
+			"src":          net.ParseIP(ip),
+			"ja3":          "771,4865",
+			"path":         path,
+			"req.hdrs_bin": headers,
+		}))
+		require.NoError(t, err)
+		require.Len(t, actions, 1)
+		require.Equal(t, spoe.VarScopeSession, actions[0].(spoe.ActionSetVar).Scope)
+		return spoetest.Vars(actions)["bot_score"].(int)
+	}
+	response := func(ip string, status int) {
+		actions, err := d.Handle(spoetest.Single("bot-res", map[string]interface{}{
+			"src":    net.ParseIP(ip),
+			"ja3":    "771,4865",
+			"status": status,
+		}))
+		require.NoError(t, err)
+		require.Empty(t, actions)
+	}
+
+	require.Equal(t, 0, request("192.0.2.1", "/", browser))
+	require.Equal(t, 20, request("192.0.2.2", "/", script))
+
+	// a client hammering a single path
+	for i := 0; i < 10; i++ {
+		require.Equal(t, 0, request("192.0.2.3", "/login?u=x", browser))
+	}
+	require.Equal(t, 20, request("192.0.2.3", "/login", browser))
+
+	// a scanner crawling paths and getting errors
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 0, request("192.0.2.4", fmt.Sprintf("/%d", i), browser))
+		response("192.0.2.4", 404)
+	}
+	require.Equal(t, 65, request("192.0.2.4", "/5", browser))
+
+	// scores are capped
+	for i := 0; i < 30; i++ {
+		request("192.0.2.5", fmt.Sprintf("/%d", i/20*i), script)
+	}
+	require.Equal(t, 100, request("192.0.2.5", "/", script))
+
+	// behaviour is forgotten
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, 0, request("192.0.2.4", "/", browser))
+
+	// clients without key are not scored
+	actions, err := d.Handle(spoetest.Single("bot-req", map[string]interface{}{"path": "/"}))
+	require.NoError(t, err)
+	require.Empty(t, actions)
+
+	_, err = d.Handle(spoetest.Single("bot-res", map[string]interface{}{"src": "x", "status": "404"}))
+	require.Error(t, err)
+
+	// requests without headers are not scored as anomalous
+	_, err = d.Handle(spoetest.Single("bot-req", map[string]interface{}{"src": "x", "path": "/"}))
+	require.EqualError(t, err, "botdetect: expected binary in arg req.hdrs_bin, got <nil>")
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, edit := range []func(*Config){
+		func(cfg *Config) { cfg.Window = 0 },
+		func(cfg *Config) { cfg.KeyArgs = nil },
+		func(cfg *Config) { cfg.MaxClients = 0 },
+		func(cfg *Config) { cfg.MaxPaths = -1 },
+		func(cfg *Config) { cfg.Scoring.MinRequests = 0 },
+	} {
+		cfg := DefaultConfig
+		edit(&cfg)
+		_, err := New(cfg)
+		require.Error(t, err)
+	}
+}
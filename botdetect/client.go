@@ -0,0 +1,122 @@
+package botdetect
+
+import (
+	"sync"
+	"time"
+)
+
+type counts struct {
+	requests  int
+	errors    int
+	anomalies int
+	paths     map[string]int
+}
+
+func newCounts() counts {
+	return counts{paths: make(map[string]int)}
+}
+
+// client keeps the counters of a client over two consecutive windows. Rates
+// are estimated over a window sliding across them, weighting the previous
+// window by the part of it still covered.
+type client struct {
+	lock   sync.Mutex
+	window time.Duration
+	start  time.Time
+	prev   counts
+	cur    counts
+}
+
+func newClient(window time.Duration, now time.Time) *client {
+	return &client{
+		window: window,
+		start:  now,
+		prev:   newCounts(),
+		cur:    newCounts(),
+	}
+}
+
+// rotate must be called with the lock held.
+func (c *client) rotate(now time.Time) {
+	elapsed := now.Sub(c.start)
+	if elapsed < c.window {
+		return
+	}
+
+	if elapsed < 2*c.window {
+		c.prev = c.cur
+	} else {
+		c.prev = newCounts()
+	}
+	c.cur = newCounts()
+	c.start = c.start.Add(elapsed / c.window * c.window)
+}
+
+// weight must be called with the lock held, after rotate.
+func (c *client) weight(now time.Time) float64 {
+	return 1 - float64(now.Sub(c.start))/float64(c.window)
+}
+
+type features struct {
+	requests      float64
+	maxPath       float64
+	distinctPaths int
+	errorRatio    float64
+	anomalyRatio  float64
+}
+
+// request records a request and returns the features of the client,
+// including this request.
+func (c *client) request(now time.Time, path string, anomaly bool, maxPaths int) features {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rotate(now)
+	c.cur.requests++
+	if anomaly {
+		c.cur.anomalies++
+	}
+	if _, ok := c.cur.paths[path]; ok || len(c.cur.paths) < maxPaths {
+		c.cur.paths[path]++
+	}
+
+	w := c.weight(now)
+	f := features{
+		requests: float64(c.prev.requests)*w + float64(c.cur.requests),
+	}
+
+	for p, n := range c.cur.paths {
+		rate := float64(c.prev.paths[p])*w + float64(n)
+		if rate > f.maxPath {
+			f.maxPath = rate
+		}
+	}
+	for p, n := range c.prev.paths {
+		if _, ok := c.cur.paths[p]; ok {
+			continue
+		}
+		if rate := float64(n) * w; rate > f.maxPath {
+			f.maxPath = rate
+		}
+	}
+	f.distinctPaths = len(c.cur.paths)
+	for p := range c.prev.paths {
+		if _, ok := c.cur.paths[p]; !ok {
+			f.distinctPaths++
+		}
+	}
+
+	f.errorRatio = (float64(c.prev.errors)*w + float64(c.cur.errors)) / f.requests
+	f.anomalyRatio = (float64(c.prev.anomalies)*w + float64(c.cur.anomalies)) / f.requests
+	return f
+}
+
+func (c *client) response(now time.Time, failed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rotate(now)
+	if failed {
+		c.cur.errors++
+	}
+}
@@ -0,0 +1,199 @@
+package spoe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/criteo/haproxy-spoe-go/internal/lru"
+	"github.com/pkg/errors"
+)
+
+type CacheConfig struct {
+	// Keys lists, per message name, the args whose values make the cache
+	// key. Frames holding a message not listed here bypass the cache, as
+	// its args could change the actions.
+	Keys map[string][]string
+
+	// MaxEntries bounds the number of cached results and TTL how long
+	// they are kept. The defaults apply to zero values.
+	MaxEntries int
+	TTL        time.Duration
+	// ErrorTTL is how long handler errors are cached. Zero disables it.
+	// DisconnectErrors are never cached.
+	ErrorTTL time.Duration
+}
+
+var defaultCacheConfig = CacheConfig{
+	MaxEntries: 10000,
+	TTL:        time.Minute,
+}
+
+// errCallPanicked is returned to the frames waiting for a handler call
+// which panicked.
+var errCallPanicked = errors.New("spoe: cached handler panicked")
+
+type cacheResult struct {
+	actions []Action
+	err     error
+}
+
+type cacheCall struct {
+	wg  sync.WaitGroup
+	res cacheResult
+}
+
+// Cache wraps a Handler, caching its actions by message args. Concurrent
+// frames with the same key wait for a single call to the handler. Its
+// Handle method is a Handler.
+//
+// The cached actions are shared by all the frames with the same key, their
+// values must not reference the messages.
+type Cache struct {
+	handler Handler
+	cfg     CacheConfig
+	entries *lru.Cache
+
+	callsLock sync.Mutex
+	calls     map[string]*cacheCall
+}
+
+func NewCache(h Handler, keys map[string][]string) *Cache {
+	cfg := defaultCacheConfig
+	cfg.Keys = keys
+	return NewCacheWithConfig(h, cfg)
+}
+
+func NewCacheWithConfig(h Handler, cfg CacheConfig) *Cache {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultCacheConfig.MaxEntries
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultCacheConfig.TTL
+	}
+
+	return &Cache{
+		handler: h,
+		cfg:     cfg,
+		entries: lru.New(cfg.MaxEntries),
+		calls:   make(map[string]*cacheCall),
+	}
+}
+
+func (c *Cache) Handle(msgs *MessageIterator) ([]Action, error) {
+	orig := msgs.clone()
+
+	key, err := c.key(msgs)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return c.handler(orig)
+	}
+
+	if v, ok := c.entries.Get(key); ok {
+		res := v.(cacheResult)
+		return res.actions, res.err
+	}
+
+	c.callsLock.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.callsLock.Unlock()
+		call.wg.Wait()
+		return call.res.actions, call.res.err
+	}
+	call := &cacheCall{res: cacheResult{err: errCallPanicked}}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.callsLock.Unlock()
+
+	defer func() {
+		c.callsLock.Lock()
+		delete(c.calls, key)
+		c.callsLock.Unlock()
+		call.wg.Done()
+	}()
+
+	actions, err := c.handler(orig)
+	call.res = cacheResult{actions: actions, err: err}
+
+	var disconnect *DisconnectError
+	switch {
+	case err == nil:
+		c.entries.Add(key, call.res, c.cfg.TTL)
+	case errors.As(err, &disconnect):
+	case c.cfg.ErrorTTL > 0:
+		c.entries.Add(key, call.res, c.cfg.ErrorTTL)
+	}
+
+	return actions, err
+}
+
+// Purge removes all the cached results.
+func (c *Cache) Purge() {
+	c.entries.Purge()
+}
+
+func (c *Cache) key(msgs *MessageIterator) (string, error) {
+	var key []byte
+
+	for msgs.Next() {
+		names, ok := c.cfg.Keys[msgs.Message.Name]
+		if !ok {
+			return "", nil
+		}
+
+		args := msgs.Message.Args.Map()
+		key = appendKeyBytes(key, []byte(msgs.Message.Name))
+		for _, name := range names {
+			var err error
+			key, err = appendKeyValue(key, args[name])
+			if err != nil {
+				return "", fmt.Errorf("cache key: arg %s of message %s: %s", name, msgs.Message.Name, err)
+			}
+		}
+	}
+	if msgs.Error() != nil {
+		return "", msgs.Error()
+	}
+
+	return string(key), nil
+}
+
+func appendKeyBytes(key []byte, b []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(b)))
+	key = append(key, l[:n]...)
+	return append(key, b...)
+}
+
+// appendKeyValue appends an unambiguous encoding of an arg value.
+func appendKeyValue(key []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(key, 'n'), nil
+	case bool:
+		if val {
+			return append(key, 't'), nil
+		}
+		return append(key, 'f'), nil
+	case int:
+		key = append(key, 'i')
+		return appendKeyBytes(key, []byte(fmt.Sprint(val))), nil
+	case uint:
+		key = append(key, 'u')
+		return appendKeyBytes(key, []byte(fmt.Sprint(val))), nil
+	case string:
+		key = append(key, 's')
+		return appendKeyBytes(key, []byte(val)), nil
+	case []byte:
+		key = append(key, 'b')
+		return appendKeyBytes(key, val), nil
+	case net.IP:
+		key = append(key, 'a')
+		return appendKeyBytes(key, val.To16()), nil
+	}
+	return nil, fmt.Errorf("type %T is not handled", v)
+}
@@ -0,0 +1,250 @@
+package spoe
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	calls := int32(0)
+	c := NewCache(func(msgs *MessageIterator) ([]Action, error) {
+		atomic.AddInt32(&calls, 1)
+
+		require.True(t, msgs.Next())
+		args := msgs.Message.Args.Map()
+		return []Action{ActionSetVar{
+			Name:  "ip",
+			Scope: VarScopeTransaction,
+			Value: string(args["ip"].([]byte)),
+		}}, nil
+	}, map[string][]string{
+		"ip-rep": {"ip"},
+	})
+
+	for i := 0; i < 3; i++ {
+		actions, err := c.Handle(batchTestIterator(t, "a"))
+		require.NoError(t, err)
+		require.Equal(t, "a", actions[0].(ActionSetVar).Value)
+	}
+	require.Equal(t, int32(1), calls)
+
+	actions, err := c.Handle(batchTestIterator(t, "b"))
+	require.NoError(t, err)
+	require.Equal(t, "b", actions[0].(ActionSetVar).Value)
+	require.Equal(t, int32(2), calls)
+
+	c.Purge()
+	_, err = c.Handle(batchTestIterator(t, "a"))
+	require.NoError(t, err)
+	require.Equal(t, int32(3), calls)
+}
+
+func TestCacheBypass(t *testing.T) {
+	calls := 0
+	c := NewCache(func(msgs *MessageIterator) ([]Action, error) {
+		calls++
+		require.True(t, msgs.Next())
+		return nil, nil
+	}, map[string][]string{
+		"other": {"ip"},
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Handle(batchTestIterator(t, "a"))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, calls)
+}
+
+func TestCacheErrors(t *testing.T) {
+	failure := errors.New("backend down")
+	calls := 0
+	h := func(msgs *MessageIterator) ([]Action, error) {
+		calls++
+		return nil, failure
+	}
+
+	c := NewCache(h, map[string][]string{"ip-rep": {"ip"}})
+	for i := 0; i < 2; i++ {
+		_, err := c.Handle(batchTestIterator(t, "a"))
+		require.Equal(t, failure, err)
+	}
+	require.Equal(t, 2, calls)
+
+	calls = 0
+	c = NewCacheWithConfig(h, CacheConfig{
+		Keys:     map[string][]string{"ip-rep": {"ip"}},
+		TTL:      time.Minute,
+		ErrorTTL: time.Minute,
+	})
+	for i := 0; i < 2; i++ {
+		_, err := c.Handle(batchTestIterator(t, "a"))
+		require.Equal(t, failure, err)
+	}
+	require.Equal(t, 1, calls)
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	calls := int32(0)
+	release := make(chan struct{})
+	c := NewCache(func(msgs *MessageIterator) ([]Action, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []Action{ActionUnsetVar{Name: "x", Scope: VarScopeTransaction}}, nil
+	}, map[string][]string{"ip-rep": {"ip"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			actions, err := c.Handle(batchTestIterator(t, "a"))
+			require.NoError(t, err)
+			require.Len(t, actions, 1)
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCacheKey(t *testing.T) {
+	c := NewCache(nil, map[string][]string{"m": {"a", "b"}})
+
+	// values must not be confused when concatenated
+	k1, err := c.key(cacheTestIterator(t, "ab", "c"))
+	require.NoError(t, err)
+	k2, err := c.key(cacheTestIterator(t, "a", "bc"))
+	require.NoError(t, err)
+	require.NotEqual(t, k1, k2)
+}
+
+func cacheTestIterator(t *testing.T, a, b string) *MessageIterator {
+	buf := make([]byte, 256)
+	m := 0
+
+	n, err := encodeString(buf[m:], "m")
+	require.NoError(t, err)
+	m += n
+	buf[m] = 2
+	m++
+	n, err = encodeKV(buf[m:], "a", a)
+	require.NoError(t, err)
+	m += n
+	n, err = encodeKV(buf[m:], "b", b)
+	require.NoError(t, err)
+	m += n
+
+	return NewMessageIterator(buf[:m])
+}
+
+func TestCacheUnkeyedMessage(t *testing.T) {
+	calls := 0
+	c := NewCache(func(msgs *MessageIterator) ([]Action, error) {
+		calls++
+		return nil, nil
+	}, map[string][]string{"ip-rep": {"ip"}})
+
+	frame := func(path string) *MessageIterator {
+		buf := make([]byte, 256)
+		m := 0
+		for _, msg := range []struct{ name, arg, value string }{
+			{"ip-rep", "ip", "a"},
+			{"route", "path", path},
+		} {
+			n, err := encodeString(buf[m:], msg.name)
+			require.NoError(t, err)
+			m += n
+			buf[m] = 1
+			m++
+			n, err = encodeKV(buf[m:], msg.arg, msg.value)
+			require.NoError(t, err)
+			m += n
+		}
+		return NewMessageIterator(buf[:m])
+	}
+
+	// the route message is not part of the key, its args must not be
+	// answered with the actions computed for other values
+	for _, path := range []string{"/a", "/b", "/a"} {
+		_, err := c.Handle(frame(path))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, calls)
+}
+
+func TestCacheDisconnectNotCached(t *testing.T) {
+	calls := 0
+	c := NewCacheWithConfig(func(msgs *MessageIterator) ([]Action, error) {
+		calls++
+		return nil, &DisconnectError{Code: ErrorUnknown}
+	}, CacheConfig{
+		Keys:     map[string][]string{"ip-rep": {"ip"}},
+		TTL:      time.Minute,
+		ErrorTTL: time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Handle(batchTestIterator(t, "a"))
+		require.Error(t, err)
+	}
+	require.Equal(t, 2, calls)
+}
+
+func TestCachePanic(t *testing.T) {
+	calls := int32(0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c := NewCache(func(msgs *MessageIterator) ([]Action, error) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			return nil, errors.New("called again")
+		}
+		close(started)
+		<-release
+		panic("handler bug")
+	}, map[string][]string{"ip-rep": {"ip"}})
+
+	go func() {
+		defer func() { recover() }()
+		c.Handle(batchTestIterator(t, "a"))
+	}()
+	<-started
+
+	errs := make(chan error)
+	go func() {
+		_, err := c.Handle(batchTestIterator(t, "a"))
+		errs <- err
+	}()
+	require.Eventually(t, func() bool {
+		c.callsLock.Lock()
+		defer c.callsLock.Unlock()
+		return len(c.calls) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-errs:
+		require.Equal(t, errCallPanicked, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked after the handler panicked")
+	}
+}
+
+func TestCacheConfigDefaults(t *testing.T) {
+	c := NewCacheWithConfig(nil, CacheConfig{Keys: map[string][]string{"ip-rep": {"ip"}}})
+	require.Equal(t, defaultCacheConfig.MaxEntries, c.cfg.MaxEntries)
+	require.Equal(t, defaultCacheConfig.TTL, c.cfg.TTL)
+	require.Equal(t, time.Duration(0), c.cfg.ErrorTTL)
+}
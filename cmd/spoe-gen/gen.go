@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/criteo/haproxy-spoe-go/spoeconf"
+)
+
+type field struct {
+	Name   string
+	Type   goType
+	Arg    string
+	Index  int
+	Sample string
+}
+
+type message struct {
+	Name     string
+	Type     string
+	Fields   []field
+	HasBytes bool
+}
+
+type file struct {
+	Source   string
+	Package  string
+	Agent    string
+	Messages []message
+	NeedFmt  bool
+	NeedNet  bool
+}
+
+var initialisms = map[string]bool{
+	"api": true, "asn": true, "cpu": true, "dns": true, "http": true, "https": true,
+	"id": true, "ip": true, "jwt": true, "json": true, "sni": true, "ssl": true,
+	"tcp": true, "tls": true, "ttl": true, "uri": true, "url": true, "uuid": true,
+}
+
+// goName turns an SPOE message or arg name into an exported Go identifier.
+func goName(s string) string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var b strings.Builder
+	for _, w := range words {
+		if initialisms[strings.ToLower(w)] {
+			b.WriteString(strings.ToUpper(w))
+			continue
+		}
+		b.WriteString(strings.ToUpper(w[:1]))
+		b.WriteString(w[1:])
+	}
+
+	name := b.String()
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "M" + name
+	}
+	return name
+}
+
+func buildMessages(file *file, msgs []*spoeconf.Message) error {
+	types := make(map[string]string)
+
+	for _, m := range msgs {
+		gm := message{Name: m.Name, Type: goName(m.Name)}
+		if other, ok := types[gm.Type]; ok {
+			return fmt.Errorf("messages %s and %s both map to type %s", other, m.Name, gm.Type)
+		}
+		types[gm.Type] = m.Name
+
+		fields := make(map[string]string)
+		for i, a := range m.Args {
+			f := field{
+				Name:   goName(a.Name),
+				Type:   sampleType(a.Sample),
+				Arg:    a.Name,
+				Index:  i,
+				Sample: a.Sample,
+			}
+			if a.Name == "" {
+				// unnamed args are named after their fetch, for instance
+				// ReqHdrsBin for req.hdrs_bin
+				f.Name = goName(name(splitConverters(a.Sample)[0]))
+				if _, ok := fields[f.Name]; ok {
+					f.Name = fmt.Sprintf("Arg%d", i)
+				}
+			} else if _, ok := fields[a.Name]; ok {
+				return fmt.Errorf("message %s: duplicate arg %s", m.Name, a.Name)
+			}
+			if other, ok := fields[f.Name]; ok {
+				return fmt.Errorf("message %s: args %s and %s both map to field %s", m.Name, other, a.Name, f.Name)
+			}
+			fields[f.Name] = a.Name
+			if a.Name != "" {
+				fields[a.Name] = a.Name
+			}
+			if f.Type == typeBytes {
+				gm.HasBytes = true
+			}
+			if f.Type != typeAny {
+				file.NeedFmt = true
+			}
+			if f.Type == typeIP {
+				file.NeedNet = true
+			}
+			gm.Fields = append(gm.Fields, f)
+		}
+
+		file.Messages = append(file.Messages, gm)
+	}
+
+	return nil
+}
+
+// decodeCases gives, for each type, the cases of a type switch on v storing
+// the value in dst.
+var decodeCases = map[goType]string{
+	typeString: `case string:
+		{{.Dst}} = v
+	case []byte:
+		{{.Dst}} = string(v)`,
+	typeBytes: `case []byte:
+		{{.Dst}} = v`,
+	typeInt: `case int:
+		{{.Dst}} = v
+	case uint:
+		{{.Dst}} = int(v)`,
+	typeBool: `case bool:
+		{{.Dst}} = v`,
+	typeIP: `case net.IP:
+		{{.Dst}} = v`,
+}
+
+func decode(f field, msg string) (string, error) {
+	if f.Type == typeAny {
+		return fmt.Sprintf("m.%s = args.Arg.Value", f.Name), nil
+	}
+
+	var cases bytes.Buffer
+	err := template.Must(template.New("").Parse(decodeCases[f.Type])).Execute(&cases, map[string]string{"Dst": "m." + f.Name})
+	if err != nil {
+		return "", err
+	}
+
+	arg := f.Arg
+	if arg == "" {
+		arg = fmt.Sprintf("#%d", f.Index)
+	}
+	// names come from the configuration and may hold quotes or verbs
+	escape := strings.NewReplacer("%", "%%").Replace
+	errFormat := fmt.Sprintf("message %s: arg %s: expected %s, got %%T", escape(msg), escape(arg), f.Type)
+	return fmt.Sprintf(`switch v := args.Arg.Value.(type) {
+	%s
+	case nil:
+	default:
+		return m, fmt.Errorf(%s, v)
+	}`, cases.String(), strconv.Quote(errFormat)), nil
+}
+
+var fileTemplate = template.Must(template.New("file").Funcs(template.FuncMap{
+	"decode": decode,
+}).Parse(`// Code generated by spoe-gen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- if .NeedFmt}}
+	"fmt"
+{{- end}}
+{{- if .NeedNet}}
+	"net"
+{{- end}}
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+)
+{{range $m := .Messages}}
+// {{.Type}} holds the args of the {{.Name}} message.
+{{- if .HasBytes}}
+// Byte slices point into the frame and are only valid during the handler
+// call.
+{{- end}}
+type {{.Type}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}} // {{if .Arg}}{{.Arg}}={{end}}{{.Sample}}
+{{- end}}
+}
+
+// Decode{{.Type}} reads the args of a {{.Name}} message.
+// Unknown args are ignored, missing args are left to their zero value.
+func Decode{{.Type}}(args *spoe.ArgIterator) ({{.Type}}, error) {
+	var m {{.Type}}
+	for i := 0; args.Next(); i++ {
+		switch {
+{{- range .Fields}}
+		case {{if .Arg}}args.Arg.Name == {{printf "%q" .Arg}}{{else}}args.Arg.Name == "" && i == {{.Index}}{{end}}:
+			{{decode . $m.Name}}
+{{- end}}
+		}
+	}
+	return m, nil
+}
+{{end}}
+// Handlers handles the messages of {{if .Agent}}the {{.Agent}} agent{{else}}{{.Source}}{{end}}.
+type Handlers interface {
+{{- range .Messages}}
+	Handle{{.Type}}(msg {{.Type}}) ([]spoe.Action, error)
+{{- end}}
+}
+
+// Route returns an spoe.Handler decoding the messages and dispatching them to
+// h. The actions of all the messages of a frame are returned together.
+// Unknown messages are ignored.
+func Route(h Handlers) spoe.Handler {
+	return func(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+		var actions []spoe.Action
+		for msgs.Next() {
+			var res []spoe.Action
+			var err error
+
+			switch msgs.Message.Name {
+{{- range .Messages}}
+			case {{printf "%q" .Name}}:
+				var m {{.Type}}
+				m, err = Decode{{.Type}}(msgs.Message.Args)
+				if err == nil {
+					res, err = h.Handle{{.Type}}(m)
+				}
+{{- end}}
+			default:
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, res...)
+		}
+		return actions, msgs.Error()
+	}
+}
+`))
+
+var stubsTemplate = template.Must(template.New("stubs").Parse(`package {{.Package}}
+
+import (
+	spoe "github.com/criteo/haproxy-spoe-go"
+)
+
+// Handler implements Handlers.
+type Handler struct{}
+
+var _ Handlers = (*Handler)(nil)
+{{range .Messages}}
+func (h *Handler) Handle{{.Type}}(msg {{.Type}}) ([]spoe.Action, error) {
+	return nil, nil
+}
+{{end}}`))
+
+func render(t *template.Template, f file) ([]byte, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, f)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %s", err)
+	}
+	return src, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/criteo/haproxy-spoe-go/spoeconf"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestGoName(t *testing.T) {
+	tests := map[string]string{
+		"check-client-ip": "CheckClientIP",
+		"req.hdrs_bin":    "ReqHdrsBin",
+		"user_id":         "UserID",
+		"3rd-party":       "M3rdParty",
+		"":                "M",
+	}
+	for in, out := range tests {
+		require.Equal(t, out, goName(in), in)
+	}
+}
+
+func TestSampleType(t *testing.T) {
+	tests := map[string]goType{
+		"src":                      typeIP,
+		"src,ipmask(24)":           typeIP,
+		"req.hdr(host)":            typeString,
+		"req.hdr(host),lower":      typeString,
+		"req.hdr(x-a,1),length":    typeInt,
+		"req.body":                 typeBytes,
+		"req.body,sha1":            typeBytes,
+		"ssl_fc":                   typeBool,
+		"src_port":                 typeInt,
+		"var(txn.x)":               typeAny,
+		"req.hdr(host),custom_cnv": typeAny,
+		"unknown_fetch":            typeAny,
+	}
+	for sample, typ := range tests {
+		require.Equal(t, typ, sampleType(sample), sample)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	cfg, err := spoeconf.ParseFile("testdata/spoe.conf")
+	require.NoError(t, err)
+
+	for _, golden := range []struct {
+		file     string
+		template string
+	}{
+		{"handlers.golden", "file"},
+		{"stubs.golden", "stubs"},
+	} {
+		f, err := generate(cfg, "spoe.conf", "iprep-agent", "handlers")
+		require.NoError(t, err)
+
+		tpl := fileTemplate
+		if golden.template == "stubs" {
+			tpl = stubsTemplate
+		}
+		src, err := render(tpl, f)
+		require.NoError(t, err)
+
+		path := filepath.Join("testdata", golden.file)
+		if *update {
+			require.NoError(t, ioutil.WriteFile(path, src, 0644))
+		}
+		expected, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, string(expected), string(src))
+	}
+
+	_, err = generate(cfg, "spoe.conf", "other", "handlers")
+	require.EqualError(t, err, "no agent other in spoe.conf")
+}
+
+func TestDecodeQuotesNames(t *testing.T) {
+	code, err := decode(field{Name: "A", Type: typeInt, Arg: `a"%s`}, `m\%d`)
+	require.NoError(t, err)
+
+	_, err = parser.ParseFile(token.NewFileSet(), "", "package p\nfunc f() {"+code+"}", 0)
+	require.NoError(t, err, code)
+	require.Contains(t, code, `fmt.Errorf("message m\\%%d: arg a\"%%s: expected int, got %T", v)`)
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := map[string]string{
+		"spoe-message a-b\nspoe-message a_b":           "messages a-b and a_b both map to type AB",
+		"spoe-message m\nargs a=src a=dst":             "message m: duplicate arg a",
+		"spoe-message m\nargs user-id=src user_id=dst": "message m: args user-id and user_id both map to field UserID",
+		"spoe-agent a\nmessages m":                     "spoeconf: agent a: unknown message m",
+		"spoe-agent a":                                 "no message in spoe.conf",
+	}
+	for config, msg := range tests {
+		cfg, err := spoeconf.Parse(strings.NewReader(config))
+		require.NoError(t, err)
+
+		agent := ""
+		if len(cfg.Agents) > 0 {
+			agent = "a"
+		}
+		_, err = generate(cfg, "spoe.conf", agent, "handlers")
+		require.EqualError(t, err, msg, config)
+	}
+}
+
+func TestRunKeepsStubs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spoe-gen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "handlers.go")
+	stubs := filepath.Join(dir, "stubs.go")
+	require.NoError(t, run("testdata/spoe.conf", "iprep-agent", "handlers", out, stubs))
+	generated, err := ioutil.ReadFile(stubs)
+	require.NoError(t, err)
+
+	edited := []byte("package handlers\n")
+	require.NoError(t, ioutil.WriteFile(stubs, edited, 0644))
+	require.NoError(t, run("testdata/spoe.conf", "iprep-agent", "handlers", out, stubs))
+	kept, err := ioutil.ReadFile(stubs)
+	require.NoError(t, err)
+	require.Equal(t, edited, kept)
+	require.NotEqual(t, generated, kept)
+}
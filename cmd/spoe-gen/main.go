@@ -0,0 +1,116 @@
+// Command spoe-gen generates Go code from the spoe-message sections of an
+// HAProxy SPOE configuration file: a struct and a decode function per
+// message, a Handlers interface with one method per message and a Route
+// function turning it into an spoe.Handler. Regenerating the code when the
+// configuration changes makes the handlers fail to compile instead of
+// silently missing args.
+//
+// Arg types are guessed from the sample fetches and converters, unknown
+// ones give interface{} fields.
+//
+//	spoe-gen -config spoe.conf -agent my-agent -package handlers -o messages_gen.go
+//
+// With -stubs, it also writes a Handler type implementing Handlers, meant to
+// be edited. Existing stub files are never overwritten.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/criteo/haproxy-spoe-go/spoeconf"
+)
+
+func main() {
+	config := flag.String("config", "", "SPOE configuration file")
+	agent := flag.String("agent", "", "only generate the messages of this agent")
+	pkg := flag.String("package", "handlers", "package of the generated code")
+	out := flag.String("o", "", "output file, standard output when empty")
+	stubs := flag.String("stubs", "", "also write handler stubs to this file, if it does not exist")
+	flag.Parse()
+
+	err := run(*config, *agent, *pkg, *out, *stubs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spoe-gen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(config, agent, pkg, out, stubs string) error {
+	if config == "" {
+		return fmt.Errorf("-config is required")
+	}
+
+	cfg, err := spoeconf.ParseFile(config)
+	if err != nil {
+		return err
+	}
+
+	f, err := generate(cfg, filepath.Base(config), agent, pkg)
+	if err != nil {
+		return err
+	}
+
+	src, err := render(fileTemplate, f)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+	} else {
+		err = ioutil.WriteFile(out, src, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	if stubs == "" {
+		return nil
+	}
+	if _, err := os.Stat(stubs); err == nil {
+		// the stubs have been edited, keep them
+		return nil
+	}
+	src, err = render(stubsTemplate, f)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stubs, src, 0644)
+}
+
+func generate(cfg *spoeconf.Config, source, agent, pkg string) (file, error) {
+	f := file{
+		Source:  source,
+		Package: pkg,
+		Agent:   agent,
+	}
+
+	msgs := cfg.Messages
+	if agent != "" {
+		var a *spoeconf.Agent
+		for _, candidate := range cfg.Agents {
+			if candidate.Name == agent {
+				a = candidate
+				break
+			}
+		}
+		if a == nil {
+			return f, fmt.Errorf("no agent %s in %s", agent, source)
+		}
+
+		var err error
+		msgs, err = cfg.AgentMessages(a)
+		if err != nil {
+			return f, err
+		}
+	}
+	if len(msgs) == 0 {
+		return f, fmt.Errorf("no message in %s", source)
+	}
+
+	err := buildMessages(&f, msgs)
+	return f, err
+}
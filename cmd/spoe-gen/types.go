@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strings"
+)
+
+// goType is the Go type of the values the SPOE library decodes for a sample.
+type goType int
+
+const (
+	typeAny goType = iota
+	typeString
+	typeBytes
+	typeInt
+	typeBool
+	typeIP
+)
+
+func (t goType) String() string {
+	switch t {
+	case typeString:
+		return "string"
+	case typeBytes:
+		return "[]byte"
+	case typeInt:
+		return "int"
+	case typeBool:
+		return "bool"
+	case typeIP:
+		return "net.IP"
+	}
+	return "interface{}"
+}
+
+var fetchTypes = map[string]goType{
+	"src":           typeIP,
+	"dst":           typeIP,
+	"req.hdr_ip":    typeIP,
+	"hdr_ip":        typeIP,
+	"src_port":      typeInt,
+	"dst_port":      typeInt,
+	"status":        typeInt,
+	"txn.status":    typeInt,
+	"req.len":       typeInt,
+	"res.len":       typeInt,
+	"req.body_len":  typeInt,
+	"res.body_len":  typeInt,
+	"req.body_size": typeInt,
+	"res.body_size": typeInt,
+	"req.hdr_cnt":   typeInt,
+	"res.hdr_cnt":   typeInt,
+	"hdr_cnt":       typeInt,
+	"unique-id":     typeString,
+	"method":        typeString,
+	"path":          typeString,
+	"pathq":         typeString,
+	"query":         typeString,
+	"url":           typeString,
+	"base":          typeString,
+	"req.ver":       typeString,
+	"res.ver":       typeString,
+	"req.hdr":       typeString,
+	"res.hdr":       typeString,
+	"hdr":           typeString,
+	"req.fhdr":      typeString,
+	"res.fhdr":      typeString,
+	"req.cook":      typeString,
+	"cook":          typeString,
+	"url_param":     typeString,
+	"urlp":          typeString,
+	"ssl_fc_sni":    typeString,
+	"ssl_c_s_dn":    typeString,
+	"var":           typeAny,
+	"req.hdrs":      typeString,
+	"res.hdrs":      typeString,
+	"req.hdrs_bin":  typeBytes,
+	"res.hdrs_bin":  typeBytes,
+	"req.body":      typeBytes,
+	"res.body":      typeBytes,
+	"req.payload":   typeBytes,
+	"res.payload":   typeBytes,
+	"ssl_fc":        typeBool,
+	"ssl_c_used":    typeBool,
+	"always_true":   typeBool,
+	"always_false":  typeBool,
+}
+
+var converterTypes = map[string]goType{
+	"lower":       typeString,
+	"upper":       typeString,
+	"hex":         typeString,
+	"base64":      typeString,
+	"ub64enc":     typeString,
+	"url_dec":     typeString,
+	"json":        typeString,
+	"field":       typeString,
+	"word":        typeString,
+	"regsub":      typeString,
+	"concat":      typeString,
+	"length":      typeInt,
+	"strlen":      typeInt,
+	"crc32":       typeInt,
+	"djb2":        typeInt,
+	"wt6":         typeInt,
+	"xxh32":       typeInt,
+	"add":         typeInt,
+	"sub":         typeInt,
+	"mul":         typeInt,
+	"div":         typeInt,
+	"mod":         typeInt,
+	"neg":         typeInt,
+	"bool":        typeBool,
+	"not":         typeBool,
+	"odd":         typeBool,
+	"even":        typeBool,
+	"sha1":        typeBytes,
+	"sha2":        typeBytes,
+	"digest":      typeBytes,
+	"hex2i":       typeInt,
+	"ipmask":      typeIP,
+	"be2dec":      typeString,
+	"bytes":       typeBytes,
+	"ub64dec":     typeBytes,
+	"b64dec":      typeBytes,
+	"in_table":    typeBool,
+	"map":         typeString,
+	"map_str":     typeString,
+	"map_beg":     typeString,
+	"map_reg":     typeString,
+	"map_ip":      typeString,
+	"map_str_int": typeInt,
+	"map_ip_int":  typeInt,
+}
+
+// sampleType guesses the type of a sample expression from its fetch and
+// its last converter. Unknown fetches and converters give typeAny.
+func sampleType(sample string) goType {
+	parts := splitConverters(sample)
+
+	t, ok := fetchTypes[name(parts[0])]
+	if !ok {
+		t = typeAny
+	}
+	if len(parts) > 1 {
+		last := name(parts[len(parts)-1])
+		t, ok = converterTypes[last]
+		if !ok {
+			t = typeAny
+		}
+	}
+	return t
+}
+
+// name strips the parameters of a fetch or converter.
+func name(s string) string {
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// splitConverters cuts a sample expression on the commas outside of
+// parentheses.
+func splitConverters(sample string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(sample); i++ {
+		switch sample[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, sample[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, sample[start:])
+}
@@ -0,0 +1,151 @@
+// Command spoe-replay sends the notify frames of a recording, as written by
+// spoe.Recorder, to a running agent and compares the actions of its acks
+// with the recorded ones.
+//
+//	spoe-replay -addr 127.0.0.1:12345 spoe.rec.2 spoe.rec.1 spoe.rec
+//
+// Rotated files are given oldest first. Frames whose actions differ are
+// printed with the recorded actions prefixed by "-" and the replayed ones by
+// "+". The exit status is 1 when at least one frame differs, 2 on errors.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+)
+
+type options struct {
+	network  string
+	addr     string
+	engineID string
+	timeout  time.Duration
+	pace     bool
+	verbose  bool
+}
+
+type summary struct {
+	frames int
+	differ int
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.network, "network", "tcp", "network of the agent address, tcp or unix")
+	flag.StringVar(&opts.addr, "addr", "", "address of the agent")
+	flag.StringVar(&opts.engineID, "engine-id", "spoe-replay", "engine id announced to the agent")
+	flag.DurationVar(&opts.timeout, "timeout", time.Second, "timeout of each frame")
+	flag.BoolVar(&opts.pace, "pace", false, "send frames at the recorded pace instead of as fast as possible")
+	flag.BoolVar(&opts.verbose, "v", false, "also print the frames which do not differ")
+	flag.Parse()
+
+	s, err := run(opts, flag.Args(), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spoe-replay: %s\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("%d frames replayed, %d differ\n", s.frames, s.differ)
+	if s.differ > 0 {
+		os.Exit(1)
+	}
+}
+
+func run(opts options, paths []string, out io.Writer) (summary, error) {
+	var s summary
+
+	if opts.addr == "" {
+		return s, fmt.Errorf("-addr is required")
+	}
+	if len(paths) == 0 {
+		return s, fmt.Errorf("no recording given")
+	}
+
+	var readers []io.Reader
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return s, err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	records, err := spoe.NewRecordReader(io.MultiReader(readers...))
+	if err != nil {
+		return s, err
+	}
+
+	client, err := spoe.DialReplay(opts.network, opts.addr, opts.engineID, opts.timeout)
+	if err != nil {
+		return s, err
+	}
+	defer client.Close()
+
+	target := client.Notify
+	if opts.pace {
+		target = paced(target)
+	}
+
+	err = spoe.Replay(records, target, func(res spoe.ReplayResult) error {
+		s.frames++
+		if len(res.Diff) > 0 {
+			s.differ++
+		} else if !opts.verbose {
+			return nil
+		}
+
+		_, err := fmt.Fprintln(out, format(res))
+		return err
+	})
+	if err == io.ErrUnexpectedEOF {
+		fmt.Fprintln(os.Stderr, "spoe-replay: recording truncated, ignoring its last record")
+		err = nil
+	}
+	return s, err
+}
+
+// paced delays the frames so they are sent with the recorded intervals.
+func paced(target spoe.ReplayTarget) spoe.ReplayTarget {
+	var first time.Time
+	var start time.Time
+
+	return func(notify spoe.Record) ([]spoe.Action, error) {
+		if first.IsZero() {
+			first, start = notify.Time, time.Now()
+		}
+		if d := notify.Time.Sub(first) - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+		return target(notify)
+	}
+}
+
+func format(res spoe.ReplayResult) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %s stream %d frame %d", res.Notify.Time.Format(time.RFC3339Nano), res.Notify.EngineID, res.Notify.StreamID, res.Notify.FrameID)
+	if res.Ack != nil {
+		fmt.Fprintf(&b, " latency %s (recorded %s)", res.Latency, res.Ack.Time.Sub(res.Notify.Time))
+	}
+	if res.Err != nil {
+		fmt.Fprintf(&b, " error: %s", res.Err)
+	}
+
+	msgs := res.Notify.Messages()
+	for msgs.Next() {
+		fmt.Fprintf(&b, "\n  message %s", msgs.Message.Name)
+		for msgs.Message.Args.Next() {
+			fmt.Fprintf(&b, " %s=%v", msgs.Message.Args.Arg.Name, msgs.Message.Args.Arg.Value)
+		}
+	}
+
+	for _, line := range res.Diff {
+		fmt.Fprintf(&b, "\n  %s", line)
+	}
+	return b.String()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spoe-replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := spoe.DefaultRecorderConfig
+	cfg.Path = filepath.Join(dir, "spoe.rec")
+	recorder, err := spoe.NewRecorder(cfg)
+	require.NoError(t, err)
+
+	// message check with an ip arg
+	data := []byte{5, 'c', 'h', 'e', 'c', 'k', 1, 2, 'i', 'p', 6, 192, 0, 2, 1}
+	// set-var txn.score to an int
+	ack := func(score byte) []byte {
+		return []byte{1, 3, 2, 5, 's', 'c', 'o', 'r', 'e', 4, score}
+	}
+
+	now := time.Now()
+	for i, rec := range []spoe.Record{
+		{Type: spoe.RecordNotify, StreamID: 1, FrameID: 1, Data: data},
+		{Type: spoe.RecordAck, StreamID: 1, FrameID: 1, Data: ack(10)},
+		{Type: spoe.RecordNotify, StreamID: 2, FrameID: 1, Data: data},
+		{Type: spoe.RecordAck, StreamID: 2, FrameID: 1, Data: ack(20)},
+	} {
+		rec.Time = now.Add(time.Duration(i) * time.Millisecond)
+		rec.EngineID = "engine"
+		require.NoError(t, recorder.Write(rec))
+	}
+	require.NoError(t, recorder.Close())
+
+	agent := spoe.New(func(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+		return []spoe.Action{spoe.ActionSetVar{Name: "score", Scope: spoe.VarScopeTransaction, Value: 10}}, nil
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	go agent.Serve(lis)
+
+	opts := options{
+		network:  "tcp",
+		addr:     lis.Addr().String(),
+		engineID: "test",
+		timeout:  time.Second,
+		pace:     true,
+	}
+
+	var out bytes.Buffer
+	s, err := run(opts, []string{cfg.Path}, &out)
+	require.NoError(t, err)
+	require.Equal(t, summary{frames: 2, differ: 1}, s)
+	require.Contains(t, out.String(), "engine stream 2 frame 1")
+	require.Contains(t, out.String(), "message check ip=192.0.2.1\n  - set-var txn.score=int:20\n  + set-var txn.score=int:10\n")
+	require.NotContains(t, out.String(), "stream 1 ")
+
+	_, err = run(options{}, []string{cfg.Path}, &out)
+	require.EqualError(t, err, "-addr is required")
+}
@@ -1,11 +1,14 @@
 package spoe
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,21 +18,23 @@ type conn struct {
 	net.Conn
 	cfg Config
 
-	handler   Handler
-	frameSize int
+	handler      Handler
+	asyncHandler AsyncHandler
+	frameSize    int
 
 	engineID string
+	engine   *Engine
 
 	notifyTasks chan Frame
+
+	closeLock    sync.Mutex
+	closeRequest *DisconnectError
 }
 
 func (c *conn) run(a *Agent) error {
 	defer c.Close()
 
-	done := make(chan struct{})
-	defer close(done)
-
-	cod := newCodec(c.Conn, c.cfg)
+	cod := newCodec(c, c.cfg)
 
 	myframe := Frame{}
 	ok, err := cod.decodeFrame(&myframe)
@@ -49,9 +54,17 @@ func (c *conn) run(a *Agent) error {
 		return err
 	}
 
-	disconnError := spoeErrorNone
+	done := make(chan struct{})
+	var replies sync.WaitGroup
+
+	disconnError := ErrorNone
+	disconnMessage := ""
 	defer func() {
-		df, err := c.disconnectFrame(disconnError)
+		// stop the reply loop so it does not write concurrently
+		close(done)
+		replies.Wait()
+
+		df, err := c.disconnectFrame(disconnError, disconnMessage)
 		if err != nil {
 			log.Errorf("spoe disconnectFrame error : %s", err)
 			return
@@ -64,6 +77,35 @@ func (c *conn) run(a *Agent) error {
 		}
 	}()
 
+	if c.cfg.HealthCheck != nil && (healcheck || c.cfg.RefuseWhenUnhealthy) {
+		err := c.checkHealth()
+		if err != nil {
+			disconnError = ErrorUnknown
+			disconnMessage = err.Error()
+			if healcheck {
+				log.Infof("spoe: reporting unhealthy agent to %s: %s", c.Conn.RemoteAddr(), err)
+				return nil
+			}
+			return errors.Wrap(err, "refusing connection")
+		}
+	}
+
+	observer := c.cfg.observer()
+	observer.OnHello(c.Conn, Hello{
+		EngineID:     c.engineID,
+		FrameSize:    c.frameSize,
+		Capabilities: capabilities,
+		Healthcheck:  healcheck,
+	})
+
+	err = cod.encodeFrame(myframe)
+	if err != nil {
+		return err
+	}
+	if healcheck {
+		return nil
+	}
+
 	engKey := EngKey{
 		FrameSize: c.frameSize,
 		Engine:    c.engineID,
@@ -80,47 +122,68 @@ func (c *conn) run(a *Agent) error {
 		atomic.AddInt32(&eng.count, 1)
 	} else {
 		frames = make(chan Frame)
-		a.engines[engKey] = &Engine{
+		eng = &Engine{
 			frames: frames,
 			count:  1,
+			done:   make(chan struct{}),
+			id:     c.engineID,
 		}
+		a.engines[engKey] = eng
 	}
 	a.engLock.Unlock()
+	// observers are called without the lock so that they cannot stall
+	// new connections
+	if !ok {
+		observer.OnEngineStart(engKey)
+	}
+	c.engine = eng
 	defer func() {
 		a.engLock.Lock()
-		new := atomic.AddInt32(&a.engines[engKey].count, -1)
+		new := atomic.AddInt32(&eng.count, -1)
 		if new == 0 {
 			delete(a.engines, engKey)
 		}
 		a.engLock.Unlock()
+		if new == 0 {
+			observer.OnEngineStop(engKey)
+			eng.release()
+		}
 	}()
 
-	err = cod.encodeFrame(myframe)
-	if err != nil {
-		return err
-	}
-	if healcheck {
-		return nil
-	}
-
 	// run reply loop
+	replies.Add(1)
 	go func() {
+		defer replies.Done()
 		for {
 			select {
 			case <-done:
 				return
 			case frame := <-frames:
-				err = cod.encodeFrame(frame)
+				info := FrameInfo{
+					EngineID: c.engineID,
+					StreamID: frame.streamID,
+					FrameID:  frame.frameID,
+					Size:     len(frame.data),
+				}
+				c.cfg.Recorder.record(RecordAck, c.engineID, frame)
+				err := cod.encodeFrame(frame)
 				if err != nil {
 					log.Errorf("spoe reply problem: %s", err)
 					continue
 				}
+				observer.OnAck(info)
 			}
 		}
 	}()
 
 	for {
 		ok, err := cod.decodeFrame(&myframe)
+		if req := c.disconnectRequest(); req != nil {
+			log.Infof("spoe: closing connection from %s on handler request: %s", c.Conn.RemoteAddr(), req)
+			disconnError = req.Code
+			disconnMessage = req.Message
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -130,6 +193,13 @@ func (c *conn) run(a *Agent) error {
 
 		switch myframe.ftype {
 		case frameTypeHaproxyNotify:
+			observer.OnNotify(FrameInfo{
+				EngineID: c.engineID,
+				StreamID: myframe.streamID,
+				FrameID:  myframe.frameID,
+				Size:     len(myframe.data),
+			})
+			c.cfg.Recorder.record(RecordNotify, c.engineID, myframe)
 			select {
 			case c.notifyTasks <- myframe:
 			default:
@@ -149,6 +219,67 @@ func (c *conn) run(a *Agent) error {
 	}
 }
 
+// requestDisconnect makes the read loop stop and close the connection with
+// the given status. Only the first request is kept.
+func (c *conn) requestDisconnect(req *DisconnectError) {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+
+	if c.closeRequest != nil {
+		return
+	}
+	c.closeRequest = req
+
+	// wake up the read loop
+	err := c.Conn.SetReadDeadline(time.Now())
+	if err != nil {
+		log.Errorf("spoe: error interrupting connection read: %s", err)
+	}
+}
+
+func (c *conn) disconnectRequest() *DisconnectError {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	return c.closeRequest
+}
+
+// SetReadDeadline and SetDeadline keep the read loop from blocking again
+// once a disconnection has been requested.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+
+	if c.closeRequest != nil {
+		t = time.Now()
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+
+	if c.closeRequest != nil {
+		return c.Conn.SetReadDeadline(time.Now())
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *conn) checkHealth() error {
+	timeout := c.cfg.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultConfig.HealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := c.cfg.HealthCheck(ctx)
+	if err != nil {
+		return errors.Wrap(err, "healthcheck")
+	}
+	return nil
+}
+
 func (c *conn) runWorker(f Frame, frames chan Frame) {
 	err := c.handleNotify(f, frames)
 	if err != nil {
@@ -1,12 +1,15 @@
 package spoe
 
 import (
-	"fmt"
+	"unicode/utf8"
+
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func (c *conn) disconnectFrame(e spoeError) (Frame, error) {
+const maxDisconnectMessageLen = 255
+
+func (c *conn) disconnectFrame(e ErrorCode, message string) (Frame, error) {
 	f := Frame{
 		frameID:  0,
 		streamID: 0,
@@ -23,7 +26,19 @@ func (c *conn) disconnectFrame(e spoeError) (Frame, error) {
 	}
 	off += n
 
-	n, err = encodeKV(f.data[off:], "message", spoeErrorMessages[e])
+	if message == "" {
+		message = errorMessages[e]
+	}
+	if len(message) > maxDisconnectMessageLen {
+		// cut on a rune boundary, HAProxy logs the message
+		n := maxDisconnectMessageLen
+		for n > 0 && !utf8.RuneStart(message[n]) {
+			n--
+		}
+		message = message[:n]
+	}
+
+	n, err = encodeKV(f.data[off:], "message", message)
 	if err != nil {
 		return f, errors.Wrap(err, "disconnect")
 	}
@@ -41,32 +56,28 @@ func (c *conn) handleDisconnect(f Frame) error {
 		return errors.Wrap(err, "disconnect")
 	}
 
+	message, _ := data["message"].(string)
+
 	code, ok := data["status-code"].(uint)
 	if !ok {
-		message, _ := data["message"].(string)
-		if message == "" {
-			message = "unknown error "
+		return &DisconnectError{
+			Code:    ErrorUnknown,
+			Message: message,
 		}
-		return fmt.Errorf("disconnect error without status-code and message: %s", message)
 	}
 
-	if spoeError(code) == spoeErrorTimeout || spoeError(code) == spoeErrorNone {
+	if ErrorCode(code) == ErrorTimeout || ErrorCode(code) == ErrorNone {
 		return nil
 	}
 
-	if spoeError(code) == spoeErrorFragNotSupported {
+	if ErrorCode(code) == ErrorFragNotSupported {
 		// TODO: understand why we have this message
 		log.Info("spoe: Disconnect with \"fragmentation not supported\"")
 		return nil
 	}
-	message, okMessage := spoeErrorMessages[spoeError(code)]
-	if okMessage {
-		return fmt.Errorf("disconnect error: %s", message)
-	}
 
-	message, _ = data["message"].(string)
-	if message == "" {
-		message = "unknown error "
+	return &DisconnectError{
+		Code:    ErrorCode(code),
+		Message: message,
 	}
-	return fmt.Errorf("disconnect error (without status-code) : %s", message)
 }
@@ -0,0 +1,49 @@
+package spoe
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func disconnectFrameData(t *testing.T, kvs map[string]interface{}) Frame {
+	b := make([]byte, 256)
+	off := 0
+	for k, v := range kvs {
+		n, err := encodeKV(b[off:], k, v)
+		require.NoError(t, err)
+		off += n
+	}
+	return Frame{ftype: frameTypeHaproxyDiscon, data: b[:off]}
+}
+
+func TestHandleDisconnect(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	c := &conn{Conn: server}
+
+	err := c.handleDisconnect(disconnectFrameData(t, map[string]interface{}{
+		"status-code": uint(ErrorNone),
+		"message":     "normal",
+	}))
+	require.NoError(t, err)
+
+	err = c.handleDisconnect(disconnectFrameData(t, map[string]interface{}{
+		"status-code": uint(ErrorTooBig),
+		"message":     "frame is too big",
+	}))
+	var disconnect *DisconnectError
+	require.True(t, errors.As(err, &disconnect))
+	require.Equal(t, ErrorTooBig, disconnect.Code)
+	require.Equal(t, "frame is too big", disconnect.Message)
+
+	err = c.handleDisconnect(disconnectFrameData(t, map[string]interface{}{
+		"message": "oops",
+	}))
+	require.True(t, errors.As(err, &disconnect))
+	require.Equal(t, ErrorUnknown, disconnect.Code)
+	require.Equal(t, "disconnect error (99): oops", err.Error())
+}
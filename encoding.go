@@ -30,6 +30,8 @@ const (
 	dataFlagTrue byte = 0x10
 )
 
+const maxVarintLen = 10
+
 func decodeUint32(b []byte) (uint32, int, error) {
 	// read the frame length
 	if len(b) < 4 {
@@ -111,7 +113,7 @@ func decodeBytes(b []byte) ([]byte, int, error) {
 		return nil, 0, errors.Wrap(err, "decode bytes")
 	}
 
-	if len(b) < l+off {
+	if l < 0 || len(b) < l+off {
 		return nil, 0, fmt.Errorf("decode bytes: unterminated sequence")
 	}
 
@@ -184,6 +186,9 @@ func decodeKV(b []byte) (string, interface{}, int, error) {
 	}
 	off += n
 
+	if off >= len(b) {
+		return "", nil, 0, fmt.Errorf("decode k/v: unterminated sequence")
+	}
 	dbyte := b[off]
 	dtype := dataType(dbyte & dataTypeMask)
 	off++
@@ -0,0 +1,43 @@
+package spoe
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeKVTruncated(t *testing.T) {
+	b := make([]byte, 64)
+	n, err := encodeKV(b, "ip", net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+
+	name, value, m, err := decodeKV(b[:n])
+	require.NoError(t, err)
+	require.Equal(t, "ip", name)
+	require.Equal(t, net.ParseIP("192.0.2.1").To4(), value)
+	require.Equal(t, n, m)
+
+	for i := 0; i < n; i++ {
+		_, _, _, err := decodeKV(b[:i])
+		require.Error(t, err, "truncated at %d", i)
+	}
+}
+
+func TestMessageIteratorTruncated(t *testing.T) {
+	f := notifyFrame(t)
+
+	// only the cut between the two messages gives a valid frame
+	valid := 0
+	for i := 1; i < len(f.data); i++ {
+		msgs := NewMessageIterator(f.data[:i])
+		require.NotPanics(t, func() {
+			for msgs.Next() {
+			}
+		}, "truncated at %d", i)
+		if msgs.Error() == nil {
+			valid++
+		}
+	}
+	require.Equal(t, 1, valid)
+}
@@ -0,0 +1,134 @@
+package spoe
+
+import (
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Engine groups the connections sharing their frames: those opened by the
+// same HAProxy process when async is negotiated, a single connection
+// otherwise. Handlers can attach state to it, which lives as long as the
+// engine has connections.
+//
+// Once the engine is released, values are no longer stored: SetValue and
+// LoadOrCreate close the io.Closer values they are given right away.
+type Engine struct {
+	frames chan Frame
+	count  int32
+	done   chan struct{}
+
+	id string
+
+	stateLock sync.Mutex
+	state     map[interface{}]interface{}
+	released  bool
+	// responders are the async frames waiting for their ack, whose
+	// timeouts are stopped on release
+	responders map[*Responder]struct{}
+}
+
+func (e *Engine) ID() string {
+	return e.id
+}
+
+// Value returns the state stored under key, or nil.
+func (e *Engine) Value(key interface{}) interface{} {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	return e.state[key]
+}
+
+func (e *Engine) SetValue(key, value interface{}) {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	if e.released {
+		e.closeValue(value)
+		return
+	}
+	if e.state == nil {
+		e.state = make(map[interface{}]interface{})
+	}
+	e.state[key] = value
+}
+
+// LoadOrCreate returns the state stored under key, calling create to
+// initialize it on first use.
+func (e *Engine) LoadOrCreate(key interface{}, create func() interface{}) interface{} {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	if v, ok := e.state[key]; ok {
+		return v
+	}
+	v := create()
+	if e.released {
+		e.closeValue(v)
+		return v
+	}
+	if e.state == nil {
+		e.state = make(map[interface{}]interface{})
+	}
+	e.state[key] = v
+	return v
+}
+
+func (e *Engine) DeleteValue(key interface{}) {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	delete(e.state, key)
+}
+
+// addResponder tracks r until it is done. It returns false once the engine
+// is released.
+func (e *Engine) addResponder(r *Responder) bool {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	if e.released {
+		return false
+	}
+	if e.responders == nil {
+		e.responders = make(map[*Responder]struct{})
+	}
+	e.responders[r] = struct{}{}
+	return true
+}
+
+func (e *Engine) removeResponder(r *Responder) {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	delete(e.responders, r)
+}
+
+// release drops the engine state once its last connection is closed,
+// closing the values implementing io.Closer, and stops pending async
+// responses.
+func (e *Engine) release() {
+	if e.done != nil {
+		close(e.done)
+	}
+
+	e.stateLock.Lock()
+	state := e.state
+	responders := e.responders
+	e.state = nil
+	e.responders = nil
+	e.released = true
+	e.stateLock.Unlock()
+
+	for r := range responders {
+		r.cancel()
+	}
+	for _, v := range state {
+		e.closeValue(v)
+	}
+}
+
+func (e *Engine) closeValue(v interface{}) {
+	if closer, ok := v.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			log.Errorf("spoe: error releasing state of engine %s: %s", e.id, err)
+		}
+	}
+}
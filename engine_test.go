@@ -0,0 +1,103 @@
+package spoe
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type engineCounter struct {
+	hits   int32
+	closed int32
+}
+
+func (c *engineCounter) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func TestEngineState(t *testing.T) {
+	e := &Engine{id: "engine"}
+
+	require.Nil(t, e.Value("missing"))
+
+	created := 0
+	create := func() interface{} {
+		created++
+		return &engineCounter{}
+	}
+	c1 := e.LoadOrCreate("counter", create)
+	c2 := e.LoadOrCreate("counter", create)
+	require.Equal(t, 1, created)
+	require.True(t, c1 == c2)
+
+	e.SetValue("name", "value")
+	require.Equal(t, "value", e.Value("name"))
+	e.DeleteValue("name")
+	require.Nil(t, e.Value("name"))
+
+	e.release()
+	require.Equal(t, int32(1), c1.(*engineCounter).closed)
+	require.Nil(t, e.Value("counter"))
+
+	// handlers still running after the release cannot bring state back
+	c3 := e.LoadOrCreate("counter", create)
+	require.Equal(t, int32(1), c3.(*engineCounter).closed)
+	c4 := &engineCounter{}
+	e.SetValue("other", c4)
+	require.Equal(t, int32(1), c4.closed)
+	require.Nil(t, e.Value("counter"))
+	require.Nil(t, e.Value("other"))
+}
+
+func TestEngineStateReleasedWithConnection(t *testing.T) {
+	type counterKey struct{}
+	counters := make(chan *engineCounter, 2)
+	engineIDs := make(chan string, 2)
+
+	spoa := New(func(msgs *MessageIterator) ([]Action, error) {
+		engineIDs <- msgs.Engine().ID()
+		c := msgs.Engine().LoadOrCreate(counterKey{}, func() interface{} {
+			return &engineCounter{}
+		}).(*engineCounter)
+		atomic.AddInt32(&c.hits, 1)
+		counters <- c
+		return nil, nil
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	go spoa.Serve(lis)
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+
+	cod := newCodec(client, defaultConfig)
+	require.NoError(t, cod.encodeFrame(helloFrame(t)))
+	res := Frame{}
+	_, err = cod.decodeFrame(&res)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, cod.encodeFrame(notifyFrame(t)))
+		_, err = cod.decodeFrame(&res)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "0082BA75-E79D-4766-86D3-1AE84AB4A366", <-engineIDs)
+
+	c := <-counters
+	require.True(t, c == <-counters)
+	require.Equal(t, int32(2), atomic.LoadInt32(&c.hits))
+	require.Equal(t, int32(0), atomic.LoadInt32(&c.closed))
+
+	require.NoError(t, client.Close())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&c.closed) == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,39 +1,65 @@
 package spoe
 
-type spoeError int
+import "fmt"
+
+// ErrorCode is the status code sent in disconnect frames.
+type ErrorCode int
 
 const (
-	spoeErrorNone spoeError = iota
-	spoeErrorIO
-	spoeErrorTimeout
-	spoeErrorTooBig
-	spoeErrorInvalid
-	spoeErrorNoVSN
-	spoeErrorNoFrameSize
-	spoeErrorNoCap
-	spoeErrorBadVsn
-	spoeErrorBadFrameSize
-	spoeErrorFragNotSupported
-	spoeErrorInterlacedFrames
-	spoeErrorFrameIDNotfound
-	spoeErrorRes
-	spoeErrorUnknown spoeError = 99
+	ErrorNone ErrorCode = iota
+	ErrorIO
+	ErrorTimeout
+	ErrorTooBig
+	ErrorInvalid
+	ErrorNoVSN
+	ErrorNoFrameSize
+	ErrorNoCap
+	ErrorBadVsn
+	ErrorBadFrameSize
+	ErrorFragNotSupported
+	ErrorInterlacedFrames
+	ErrorFrameIDNotfound
+	ErrorRes
+	ErrorUnknown ErrorCode = 99
 )
 
-var spoeErrorMessages = map[spoeError]string{
-	spoeErrorNone:             "normal",
-	spoeErrorIO:               "I/O error",
-	spoeErrorTimeout:          "a timeout occurred",
-	spoeErrorTooBig:           "frame is too big",
-	spoeErrorInvalid:          "invalid frame received",
-	spoeErrorNoVSN:            "version value not found",
-	spoeErrorNoFrameSize:      "max-frame-size value not found",
-	spoeErrorNoCap:            "capabilities value not found",
-	spoeErrorBadVsn:           "unsupported version",
-	spoeErrorBadFrameSize:     "max-frame-size too big or too small",
-	spoeErrorFragNotSupported: "fragmentation not supported",
-	spoeErrorInterlacedFrames: "invalid interlaced frames",
-	spoeErrorFrameIDNotfound:  "frame-id not found",
-	spoeErrorRes:              "resource allocation error",
-	spoeErrorUnknown:          "an unknown error occurred",
+var errorMessages = map[ErrorCode]string{
+	ErrorNone:             "normal",
+	ErrorIO:               "I/O error",
+	ErrorTimeout:          "a timeout occurred",
+	ErrorTooBig:           "frame is too big",
+	ErrorInvalid:          "invalid frame received",
+	ErrorNoVSN:            "version value not found",
+	ErrorNoFrameSize:      "max-frame-size value not found",
+	ErrorNoCap:            "capabilities value not found",
+	ErrorBadVsn:           "unsupported version",
+	ErrorBadFrameSize:     "max-frame-size too big or too small",
+	ErrorFragNotSupported: "fragmentation not supported",
+	ErrorInterlacedFrames: "invalid interlaced frames",
+	ErrorFrameIDNotfound:  "frame-id not found",
+	ErrorRes:              "resource allocation error",
+	ErrorUnknown:          "an unknown error occurred",
+}
+
+func (e ErrorCode) String() string {
+	if msg, ok := errorMessages[e]; ok {
+		return msg
+	}
+	return fmt.Sprintf("status code %d", int(e))
+}
+
+// DisconnectError carries the status of a disconnect frame. It is returned
+// when HAProxy closes a connection with an error, and handlers can return it
+// to have the agent close their connection with the given status.
+type DisconnectError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *DisconnectError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = e.Code.String()
+	}
+	return fmt.Sprintf("disconnect error (%d): %s", int(e.Code), message)
 }
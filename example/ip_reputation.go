@@ -1,60 +1,47 @@
 package main
 
 import (
-	"fmt"
-	"net"
-
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/iprep"
 )
 
-func getReputation(ip net.IP) (float64, error) {
-	// implement IP reputation code here
-	return 1.0, nil
-}
-
 func main() {
-	agent := spoe.New(func(messages *spoe.MessageIterator) ([]spoe.Action, error) {
-		reputation := 0.0
+	addr := flag.String("addr", ":9000", "listen address")
+	lists := flag.String("lists", "reputation.txt", "comma separated CIDR lists")
+	flag.Parse()
 
-		for messages.Next() {
-			msg := messages.Message
-
-			if msg.Name != "ip-rep" {
-				continue
-			}
+	cfg := iprep.DefaultConfig
+	cfg.Files = strings.Split(*lists, ",")
+	// the variable set by earlier versions of this example
+	cfg.ScoreVar = "reputation"
 
-			var ip net.IP
-			for msg.Args.Next() {
-				arg := msg.Args.Arg
-
-				if arg.Name == "ip" {
-					var ok bool
-					ip, ok = arg.Value.(net.IP)
-					if !ok {
-						return nil, fmt.Errorf("spoe handler: expected ip in message, got %+v", ip)
-					}
-				}
-			}
-
-			var err error
-			reputation, err = getReputation(ip)
-			if err != nil {
-				return nil, fmt.Errorf("spoe handler: error processing request: %s", err)
+	reputation, err := iprep.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reputation.Close()
+
+	// reload the lists on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reputation.Reload(); err != nil {
+				log.Printf("reloading lists: %s", err)
 			}
 		}
+	}()
 
-		return []spoe.Action{
-			spoe.ActionSetVar{
-				Name:  "reputation",
-				Scope: spoe.VarScopeSession,
-				Value: reputation,
-			},
-		}, nil
-	})
+	agent := spoe.New(reputation.Handle)
 
-	if err := agent.ListenAndServe(":9000"); err != nil {
+	if err := agent.ListenAndServe(*addr); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -73,3 +73,35 @@ func helloFrame(t require.TestingT) Frame {
 
 	return f
 }
+
+func healthcheckHelloFrame(t require.TestingT) Frame {
+	f := Frame{
+		ftype:    frameTypeHaproxyHello,
+		flags:    frameFlagFin,
+		streamID: 0,
+		frameID:  0,
+		data:     make([]byte, maxFrameSize),
+	}
+
+	m := 0
+
+	n, err := encodeKV(f.data[m:], "capabilities", "")
+	require.NoError(t, err)
+	m += n
+
+	n, err = encodeKV(f.data[m:], "healthcheck", true)
+	require.NoError(t, err)
+	m += n
+
+	n, err = encodeKV(f.data[m:], "max-frame-size", uint(16380))
+	require.NoError(t, err)
+	m += n
+
+	n, err = encodeKV(f.data[m:], "supported-versions", "2.0")
+	require.NoError(t, err)
+	m += n
+
+	f.data = f.data[:m]
+
+	return f
+}
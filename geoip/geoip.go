@@ -0,0 +1,237 @@
+// Package geoip implements an SPOE handler geolocating client IPs with
+// local MaxMind databases (GeoIP2/GeoLite2 Country, City and ASN).
+package geoip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/lru"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Fields which can be exported as variables.
+const (
+	FieldCountry     = "country"
+	FieldCountryName = "country_name"
+	FieldContinent   = "continent"
+	FieldSubdivision = "subdivision"
+	FieldCity        = "city"
+	FieldASN         = "asn"
+	FieldASOrg       = "as_org"
+)
+
+// Record holds the data read from all the databases for an IP.
+type Record struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// Field returns the value of a field, and false when the record does not
+// have it.
+func (r *Record) Field(name string) (interface{}, bool) {
+	switch name {
+	case FieldCountry:
+		return r.Country.ISOCode, r.Country.ISOCode != ""
+	case FieldCountryName:
+		v := r.Country.Names["en"]
+		return v, v != ""
+	case FieldContinent:
+		return r.Continent.Code, r.Continent.Code != ""
+	case FieldSubdivision:
+		if len(r.Subdivisions) == 0 {
+			return "", false
+		}
+		return r.Subdivisions[0].ISOCode, r.Subdivisions[0].ISOCode != ""
+	case FieldCity:
+		v := r.City.Names["en"]
+		return v, v != ""
+	case FieldASN:
+		return int(r.ASN), r.ASN != 0
+	case FieldASOrg:
+		return r.ASOrg, r.ASOrg != ""
+	}
+	return nil, false
+}
+
+type Config struct {
+	// Databases are the MMDB files, all of them are looked up for each IP.
+	Databases []string
+
+	// Message and Arg name the message and its net.IP arg to locate.
+	Message string
+	Arg     string
+
+	// Vars maps record fields to the names of the session variables set
+	// by the handler.
+	Vars map[string]string
+
+	// CacheSize is the number of records kept in memory. Zero disables the
+	// cache.
+	CacheSize int
+
+	// ReloadInterval is how often the databases are checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	Message: "geoip",
+	Arg:     "ip",
+	Vars: map[string]string{
+		FieldCountry: "geo_country",
+		FieldCity:    "geo_city",
+		FieldASN:     "geo_asn",
+	},
+	CacheSize:      10000,
+	ReloadInterval: time.Minute,
+}
+
+// GeoIP locates IPs.
+type GeoIP struct {
+	cfg     Config
+	readers atomic.Value
+	cache   *lru.Cache
+	watcher *reload.Watcher
+}
+
+// New loads the databases of cfg and starts watching them.
+func New(cfg Config) (*GeoIP, error) {
+	for field := range cfg.Vars {
+		if !knownField(field) {
+			return nil, fmt.Errorf("geoip: unknown field %s", field)
+		}
+	}
+
+	g := &GeoIP{cfg: cfg}
+	if cfg.CacheSize > 0 {
+		g.cache = lru.New(cfg.CacheSize)
+	}
+
+	err := g.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	g.watcher = reload.Watch(cfg.Databases, cfg.ReloadInterval, g.Reload)
+	return g, nil
+}
+
+func knownField(name string) bool {
+	switch name {
+	case FieldCountry, FieldCountryName, FieldContinent, FieldSubdivision, FieldCity, FieldASN, FieldASOrg:
+		return true
+	}
+	return false
+}
+
+func (g *GeoIP) Close() error {
+	return g.watcher.Close()
+}
+
+// Reload loads the databases again.
+func (g *GeoIP) Reload() error {
+	readers := make([]*maxminddb.Reader, 0, len(g.cfg.Databases))
+	for _, path := range g.cfg.Databases {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("geoip: %s", err)
+		}
+		r, err := maxminddb.FromBytes(b)
+		if err != nil {
+			return fmt.Errorf("geoip: %s: %s", path, err)
+		}
+		readers = append(readers, r)
+	}
+
+	g.readers.Store(readers)
+	if g.cache != nil {
+		g.cache.Purge()
+	}
+	return nil
+}
+
+func (g *GeoIP) Lookup(ip net.IP) (*Record, error) {
+	key := string(ip.To16())
+	if g.cache != nil {
+		if v, ok := g.cache.Get(key); ok {
+			return v.(*Record), nil
+		}
+	}
+
+	rec := &Record{}
+	for _, r := range g.readers.Load().([]*maxminddb.Reader) {
+		err := r.Lookup(ip, rec)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: lookup %s: %s", ip, err)
+		}
+	}
+
+	if g.cache != nil {
+		g.cache.Add(key, rec, 0)
+	}
+	return rec, nil
+}
+
+func (g *GeoIP) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != g.cfg.Message {
+			continue
+		}
+
+		var ip net.IP
+		for msgs.Message.Args.Next() {
+			arg := msgs.Message.Args.Arg
+			if arg.Name != g.cfg.Arg {
+				continue
+			}
+
+			var ok bool
+			ip, ok = arg.Value.(net.IP)
+			if !ok {
+				return nil, fmt.Errorf("geoip: expected ip in arg %s, got %T", g.cfg.Arg, arg.Value)
+			}
+		}
+		if ip == nil {
+			continue
+		}
+
+		rec, err := g.Lookup(ip)
+		if err != nil {
+			return nil, err
+		}
+
+		var actions []spoe.Action
+		for field, name := range g.cfg.Vars {
+			v, ok := rec.Field(field)
+			if !ok {
+				continue
+			}
+			actions = append(actions, spoe.ActionSetVar{
+				Name:  name,
+				Scope: spoe.VarScopeSession,
+				Value: v,
+			})
+		}
+		return actions, nil
+	}
+
+	return nil, msgs.Error()
+}
@@ -0,0 +1,212 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+// mmdb encodes values in the MaxMind DB data format.
+func mmdb(b []byte, v interface{}) []byte {
+	switch val := v.(type) {
+	case string:
+		if len(val) < 29 {
+			b = append(b, 2<<5|byte(len(val)))
+		} else {
+			// sizes from 29 to 284 take an extra byte
+			b = append(b, 2<<5|29, byte(len(val)-29))
+		}
+		return append(b, val...)
+	case uint32:
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], val)
+		b = append(b, 6<<5|4)
+		return append(b, n[:]...)
+	case []string:
+		// arrays are an extended type
+		b = append(b, byte(len(val)), 11-7)
+		for _, s := range val {
+			b = mmdb(b, s)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = append(b, 7<<5|byte(len(val)))
+		for _, k := range keys {
+			b = mmdb(b, k)
+			b = mmdb(b, val[k])
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+type treeNode struct {
+	children [2]*treeNode
+	data     []byte
+	id       uint32
+}
+
+// writeDB writes an IPv4 database with 24 bit records.
+func writeDB(t *testing.T, path string, networks map[string]map[string]interface{}) {
+	root := &treeNode{}
+	for cidr, rec := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, _ := n.Mask.Size()
+		ip := n.IP.To4()
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &treeNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = mmdb(nil, rec)
+	}
+
+	// number the inner nodes and lay out the data
+	var nodes []*treeNode
+	var walk func(n *treeNode)
+	walk = func(n *treeNode) {
+		if n.data != nil {
+			return
+		}
+		n.id = uint32(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+
+	nodeCount := uint32(len(nodes))
+	var data []byte
+	record := func(n *treeNode) uint32 {
+		switch {
+		case n == nil:
+			return nodeCount
+		case n.data != nil:
+			off := uint32(len(data))
+			data = append(data, n.data...)
+			return nodeCount + 16 + off
+		}
+		return n.id
+	}
+
+	var out []byte
+	for _, n := range nodes {
+		for _, c := range n.children {
+			r := record(c)
+			out = append(out, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, "\xAB\xCD\xEFMaxMind.com"...)
+	out = mmdb(out, map[string]interface{}{
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(time.Now().Unix()),
+		"database_type":               "Test",
+		"ip_version":                  uint32(4),
+		"languages":                   []string{"en"},
+		"node_count":                  nodeCount,
+		"record_size":                 uint32(24),
+	})
+
+	tmp := path + ".tmp"
+	require.NoError(t, ioutil.WriteFile(tmp, out, 0644))
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func TestGeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cityPath := filepath.Join(dir, "city.mmdb")
+	writeDB(t, cityPath, map[string]map[string]interface{}{
+		"81.2.69.0/24": {
+			"country": map[string]interface{}{
+				"iso_code": "GB",
+				"names":    map[string]interface{}{"en": "United Kingdom"},
+			},
+			"city": map[string]interface{}{
+				"names": map[string]interface{}{"en": "London"},
+			},
+		},
+	})
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	writeDB(t, asnPath, map[string]map[string]interface{}{
+		"81.2.0.0/16": {
+			"autonomous_system_number":       uint32(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd",
+		},
+	})
+
+	cfg := DefaultConfig
+	cfg.Databases = []string{cityPath, asnPath}
+	cfg.Vars = map[string]string{
+		FieldCountry:     "geo_country",
+		FieldCountryName: "geo_country_name",
+		FieldCity:        "geo_city",
+		FieldASN:         "geo_asn",
+		FieldASOrg:       "geo_as_org",
+	}
+	cfg.ReloadInterval = 5 * time.Millisecond
+	g, err := New(cfg)
+	require.NoError(t, err)
+	defer g.Close()
+
+	handle := func(ip string) map[string]interface{} {
+		actions, err := g.Handle(spoetest.Single("geoip", map[string]interface{}{"ip": net.ParseIP(ip)}))
+		require.NoError(t, err)
+		return spoetest.Vars(actions)
+	}
+
+	require.Equal(t, map[string]interface{}{
+		"geo_country":      "GB",
+		"geo_country_name": "United Kingdom",
+		"geo_city":         "London",
+		"geo_asn":          20712,
+		"geo_as_org":       "Andrews & Arnold Ltd",
+	}, handle("81.2.69.160"))
+
+	require.Equal(t, map[string]interface{}{
+		"geo_asn":    20712,
+		"geo_as_org": "Andrews & Arnold Ltd",
+	}, handle("81.2.1.1"))
+
+	require.Empty(t, handle("10.0.0.1"))
+
+	// the database is swapped and the cache purged when the file changes
+	writeDB(t, cityPath, map[string]map[string]interface{}{
+		"81.2.69.0/24": {
+			"country": map[string]interface{}{"iso_code": "FR"},
+		},
+	})
+	require.Eventually(t, func() bool {
+		return handle("81.2.69.160")["geo_country"] == "FR"
+	}, time.Second, 5*time.Millisecond)
+
+	_, err = New(Config{Vars: map[string]string{"latitude": "lat"}})
+	require.Error(t, err)
+}
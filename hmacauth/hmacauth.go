@@ -0,0 +1,260 @@
+// Package hmacauth implements an SPOE handler verifying HMAC request
+// signatures, as computed by Sign.
+package hmacauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrMissingDate      = errors.New("missing or invalid date")
+	ErrMissingNonce     = errors.New("missing nonce")
+	ErrClockSkew        = errors.New("date outside of the accepted clock skew")
+	ErrUnknownKey       = errors.New("unknown key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrReplay           = errors.New("nonce already used")
+	ErrTooManyNonces    = errors.New("too many recent nonces")
+)
+
+// CanonicalString returns the string signed for a request. uri is the path,
+// followed by the query if any.
+func CanonicalString(method, uri, date, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{method, uri, date, nonce, hex.EncodeToString(sum[:])}, "\n")
+}
+
+// Sign returns the base64 signature of a request.
+func Sign(secret []byte, method, uri, date, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(CanonicalString(method, uri, date, nonce, body)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type Config struct {
+	// Keystore is the file holding the keys.
+	Keystore string
+
+	// Message names the message to handle and Args the args carrying the
+	// request. Only Method, Path, Query, Headers and Body are used.
+	Message string
+	Args    spoe.RequestArgNames
+
+	// Headers carrying the signature data.
+	KeyIDHeader     string
+	SignatureHeader string
+	NonceHeader     string
+	DateHeader      string
+
+	// MaxClockSkew is the largest accepted difference between the Date
+	// header and the agent clock. Nonces are remembered twice as long.
+	MaxClockSkew time.Duration
+	// RequireNonce rejects requests without nonce. Without nonce,
+	// requests can be replayed within the clock skew.
+	RequireNonce bool
+	// NonceCacheSize bounds the number of nonces remembered. Nonces are
+	// never forgotten before they expire: when the cache is full, requests
+	// with new nonces are rejected with ErrTooManyNonces.
+	NonceCacheSize int
+
+	// ValidVar names the boolean variable set for every request. KeyIDVar
+	// receives the key ID of valid requests and ErrorVar, when set, the
+	// reason invalid requests were rejected.
+	ValidVar string
+	KeyIDVar string
+	ErrorVar string
+
+	// ReloadInterval is how often the keystore is checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	Message:         "hmac",
+	Args:            spoe.DefaultRequestArgNames,
+	KeyIDHeader:     "X-Key-Id",
+	SignatureHeader: "X-Signature",
+	NonceHeader:     "X-Nonce",
+	DateHeader:      "Date",
+	MaxClockSkew:    5 * time.Minute,
+	RequireNonce:    true,
+	NonceCacheSize:  100000,
+	ValidVar:        "hmac_valid",
+	KeyIDVar:        "hmac_key_id",
+	ReloadInterval:  10 * time.Second,
+}
+
+// Verifier checks signatures.
+type Verifier struct {
+	cfg     Config
+	keys    atomic.Value
+	watcher *reload.Watcher
+
+	nonceLock sync.Mutex
+	nonces    *nonceStore
+
+	now func() time.Time
+}
+
+// New loads the keystore of cfg and starts watching it.
+func New(cfg Config) (*Verifier, error) {
+	v := &Verifier{
+		cfg:    cfg,
+		nonces: newNonceStore(cfg.NonceCacheSize),
+		now:    time.Now,
+	}
+
+	err := v.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	v.watcher = reload.Watch([]string{cfg.Keystore}, cfg.ReloadInterval, v.Reload)
+	return v, nil
+}
+
+func (v *Verifier) Close() error {
+	return v.watcher.Close()
+}
+
+// Reload loads the keystore again.
+func (v *Verifier) Reload() error {
+	keys, err := LoadKeys(v.cfg.Keystore)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string][]Key)
+	for _, k := range keys {
+		byID[k.ID] = append(byID[k.ID], k)
+	}
+	v.keys.Store(byID)
+	return nil
+}
+
+// Verify checks the signature of the request carried by args, as returned by
+// ArgIterator.Map, and returns the ID of the key which signed it.
+func (v *Verifier) Verify(args map[string]interface{}) (string, error) {
+	req, err := spoe.RequestFromArgs(args, v.cfg.Args)
+	if err != nil {
+		return "", fmt.Errorf("hmacauth: %s", err)
+	}
+
+	keyID := req.Header.Get(v.cfg.KeyIDHeader)
+	signature := req.Header.Get(v.cfg.SignatureHeader)
+	if keyID == "" || signature == "" {
+		return "", ErrMissingSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	date := req.Header.Get(v.cfg.DateHeader)
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return "", ErrMissingDate
+	}
+	now := v.now()
+	if skew := now.Sub(t); skew > v.cfg.MaxClockSkew || skew < -v.cfg.MaxClockSkew {
+		return "", ErrClockSkew
+	}
+
+	nonce := req.Header.Get(v.cfg.NonceHeader)
+	if nonce == "" && v.cfg.RequireNonce {
+		return "", ErrMissingNonce
+	}
+
+	keys, ok := v.keys.Load().(map[string][]Key)[keyID]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	body, _ := args[v.cfg.Args.Body].([]byte)
+	canonical := []byte(CanonicalString(req.Method, req.URL.RequestURI(), date, nonce, body))
+
+	err = ErrUnknownKey
+	for _, k := range keys {
+		if !k.active(now) {
+			continue
+		}
+
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(canonical)
+		if hmac.Equal(mac.Sum(nil), sig) {
+			err = nil
+			break
+		}
+		err = ErrInvalidSignature
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if nonce != "" {
+		// nonces are only recorded for valid signatures, so they cannot
+		// be burnt by third parties
+		key := keyID + "\x00" + nonce
+
+		v.nonceLock.Lock()
+		defer v.nonceLock.Unlock()
+		err := v.nonces.add(key, now, 2*v.cfg.MaxClockSkew)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return keyID, nil
+}
+
+func (v *Verifier) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != v.cfg.Message {
+			continue
+		}
+
+		keyID, err := v.Verify(msgs.Message.Args.Map())
+		if err != nil {
+			if !isVerificationError(err) {
+				return nil, err
+			}
+
+			log.Debugf("hmacauth: rejecting request: %s", err)
+			actions := []spoe.Action{
+				spoe.ActionSetVar{Name: v.cfg.ValidVar, Scope: spoe.VarScopeTransaction, Value: false},
+			}
+			if v.cfg.ErrorVar != "" {
+				actions = append(actions, spoe.ActionSetVar{Name: v.cfg.ErrorVar, Scope: spoe.VarScopeTransaction, Value: err.Error()})
+			}
+			return actions, nil
+		}
+
+		return []spoe.Action{
+			spoe.ActionSetVar{Name: v.cfg.ValidVar, Scope: spoe.VarScopeTransaction, Value: true},
+			spoe.ActionSetVar{Name: v.cfg.KeyIDVar, Scope: spoe.VarScopeTransaction, Value: keyID},
+		}, nil
+	}
+
+	return nil, msgs.Error()
+}
+
+func isVerificationError(err error) bool {
+	switch err {
+	case ErrMissingSignature, ErrMissingDate, ErrMissingNonce, ErrClockSkew, ErrUnknownKey, ErrInvalidSignature, ErrReplay, ErrTooManyNonces:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package hmacauth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	oldSecret = []byte("old secret")
+	newSecret = []byte("new secret")
+)
+
+const testKeys = `
+keys:
+  - id: partner
+    secret: b2xkIHNlY3JldA==
+    not_after: 2021-01-01T00:00:00Z
+  - id: partner
+    secret: bmV3IHNlY3JldA==
+    not_before: 2020-12-01T00:00:00Z
+`
+
+func TestCanonicalString(t *testing.T) {
+	require.Equal(t,
+		"POST\n/a?b=c\nTue, 15 Dec 2020 00:00:00 GMT\nn1\n"+
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		CanonicalString("POST", "/a?b=c", "Tue, 15 Dec 2020 00:00:00 GMT", "n1", nil))
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hmacauth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	invalid := map[string]string{
+		`{"keys": [{"secret": "YQ=="}]}`:         "key without id",
+		`{"keys": [{"id": "a", "secret": "!"}]}`: "key a: illegal base64 data at input byte 0",
+		`{"keys": [{"id": "a"}]}`:                "key a: empty secret",
+		`{"keys": [{"id": "a", "secret": "YQ==", "not_before": "2021-01-01T00:00:00Z", "not_after": "2020-01-01T00:00:00Z"}]}`: "key a: not_after must be after not_before",
+	}
+	for content, msg := range invalid {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, err := LoadKeys(path)
+		require.EqualError(t, err, "hmacauth: "+path+": "+msg)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hmacauth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testKeys), 0644))
+
+	cfg := DefaultConfig
+	cfg.Keystore = path
+	cfg.ErrorVar = "hmac_error"
+	v, err := New(cfg)
+	require.NoError(t, err)
+	defer v.Close()
+
+	now := time.Date(2020, 12, 15, 0, 0, 0, 0, time.UTC)
+	v.now = func() time.Time { return now }
+
+	type request struct {
+		keyID, signature, nonce string
+		date                    time.Time
+	}
+	handle := func(r request) map[string]interface{} {
+		h := http.Header{}
+		for k, val := range map[string]string{"X-Key-Id": r.keyID, "X-Signature": r.signature, "X-Nonce": r.nonce} {
+			if val != "" {
+				h.Set(k, val)
+			}
+		}
+		if !r.date.IsZero() {
+			h.Set("Date", r.date.Format(http.TimeFormat))
+		}
+		headers, err := spoe.EncodeHeaders(h)
+		require.NoError(t, err)
+
+		actions, err := v.Handle(spoetest.Single("hmac", map[string]interface{}{
+			"method":       "POST",
+			"path":         "/orders",
+			"query":        "dry=1",
+			"req.hdrs_bin": headers,
+			"req.body":     []byte(`{"qty": 1}`),
+		}))
+		require.NoError(t, err)
+		return spoetest.Vars(actions)
+	}
+	signed := func(secret []byte, nonce string, date time.Time) request {
+		sig := Sign(secret, "POST", "/orders?dry=1", date.Format(http.TimeFormat), nonce, []byte(`{"qty": 1}`))
+		return request{"partner", sig, nonce, date}
+	}
+	rejected := func(err error) map[string]interface{} {
+		return map[string]interface{}{"hmac_valid": false, "hmac_error": err.Error()}
+	}
+
+	valid := map[string]interface{}{"hmac_valid": true, "hmac_key_id": "partner"}
+
+	// both keys are accepted during the rotation
+	require.Equal(t, valid, handle(signed(oldSecret, "n1", now)))
+	require.Equal(t, valid, handle(signed(newSecret, "n2", now.Add(-time.Minute))))
+	require.Equal(t, rejected(ErrReplay), handle(signed(newSecret, "n2", now.Add(-time.Minute))))
+
+	require.Equal(t, rejected(ErrInvalidSignature), handle(signed([]byte("other"), "n3", now)))
+	require.Equal(t, rejected(ErrClockSkew), handle(signed(newSecret, "n4", now.Add(6*time.Minute))))
+	require.Equal(t, rejected(ErrMissingNonce), handle(signed(newSecret, "", now)))
+	require.Equal(t, rejected(ErrMissingDate), handle(request{keyID: "partner", signature: "c2ln"}))
+	require.Equal(t, rejected(ErrMissingSignature), handle(request{date: now}))
+
+	unknown := signed(newSecret, "n5", now)
+	unknown.keyID = "other"
+	require.Equal(t, rejected(ErrUnknownKey), handle(unknown))
+
+	// a failed attempt does not burn the nonce
+	require.Equal(t, valid, handle(signed(newSecret, "n3", now)))
+
+	// the old key expired
+	now = time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, rejected(ErrInvalidSignature), handle(signed(oldSecret, "n6", now)))
+	require.Equal(t, valid, handle(signed(newSecret, "n6", now)))
+
+	_, err = v.Verify(map[string]interface{}{"path": "not a path"})
+	require.Error(t, err)
+}
+
+func TestNonceStore(t *testing.T) {
+	s := newNonceStore(2)
+	now := time.Date(2020, 12, 15, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, s.add("a", now, time.Minute))
+	require.NoError(t, s.add("b", now.Add(time.Second), time.Minute))
+	require.Equal(t, ErrReplay, s.add("a", now.Add(time.Second), time.Minute))
+
+	// young nonces are not evicted to make room
+	require.Equal(t, ErrTooManyNonces, s.add("c", now.Add(time.Second), time.Minute))
+	require.Equal(t, ErrReplay, s.add("a", now.Add(2*time.Second), time.Minute))
+
+	// expired ones are
+	now = now.Add(time.Minute)
+	require.NoError(t, s.add("c", now, time.Minute))
+	require.Equal(t, ErrReplay, s.add("b", now, time.Minute))
+	now = now.Add(time.Second)
+	require.NoError(t, s.add("a", now, time.Minute))
+}
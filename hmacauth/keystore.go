@@ -0,0 +1,78 @@
+package hmacauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key is a signing secret. Several keys may share an ID to rotate its
+// secret: each is accepted between NotBefore and NotAfter, when set.
+type Key struct {
+	ID        string    `json:"id" yaml:"id"`
+	Secret    string    `json:"secret" yaml:"secret"`
+	NotBefore time.Time `json:"not_before" yaml:"not_before"`
+	NotAfter  time.Time `json:"not_after" yaml:"not_after"`
+
+	secret []byte
+}
+
+func (k Key) active(now time.Time) bool {
+	if !k.NotBefore.IsZero() && now.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !now.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+type keystore struct {
+	Keys []Key `json:"keys" yaml:"keys"`
+}
+
+// LoadKeys reads keys from a YAML or JSON file, depending on its extension.
+// Secrets are base64 encoded.
+func LoadKeys(path string) ([]Key, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("hmacauth: %s", err)
+	}
+
+	var ks keystore
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(b, &ks)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &ks)
+	default:
+		return nil, fmt.Errorf("hmacauth: unsupported keystore %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("hmacauth: %s: %s", path, err)
+	}
+
+	for i := range ks.Keys {
+		k := &ks.Keys[i]
+		if k.ID == "" {
+			return nil, fmt.Errorf("hmacauth: %s: key without id", path)
+		}
+		k.secret, err = base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("hmacauth: %s: key %s: %s", path, k.ID, err)
+		}
+		if len(k.secret) == 0 {
+			return nil, fmt.Errorf("hmacauth: %s: key %s: empty secret", path, k.ID)
+		}
+		if !k.NotAfter.IsZero() && !k.NotBefore.Before(k.NotAfter) {
+			return nil, fmt.Errorf("hmacauth: %s: key %s: not_after must be after not_before", path, k.ID)
+		}
+	}
+
+	return ks.Keys, nil
+}
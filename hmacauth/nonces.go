@@ -0,0 +1,54 @@
+package hmacauth
+
+import "time"
+
+type nonceEntry struct {
+	key     string
+	expires time.Time
+}
+
+// nonceStore remembers nonces until they expire. Unlike an LRU cache, it
+// never forgets a nonce early, which would allow its replay: once full, new
+// nonces are refused.
+type nonceStore struct {
+	max     int
+	expires map[string]time.Time
+	// queue holds the nonces by expiry, as they all live as long
+	queue []nonceEntry
+}
+
+func newNonceStore(max int) *nonceStore {
+	return &nonceStore{
+		max:     max,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// add records key until now+ttl. It returns ErrReplay when key is already
+// recorded and ErrTooManyNonces when the store is full.
+func (s *nonceStore) add(key string, now time.Time, ttl time.Duration) error {
+	s.expire(now)
+
+	if expires, ok := s.expires[key]; ok && now.Before(expires) {
+		return ErrReplay
+	}
+	if s.max > 0 && len(s.expires) >= s.max {
+		return ErrTooManyNonces
+	}
+
+	expires := now.Add(ttl)
+	s.expires[key] = expires
+	s.queue = append(s.queue, nonceEntry{key: key, expires: expires})
+	return nil
+}
+
+func (s *nonceStore) expire(now time.Time) {
+	i := 0
+	for ; i < len(s.queue) && !now.Before(s.queue[i].expires); i++ {
+		e := s.queue[i]
+		if s.expires[e.key].Equal(e.expires) {
+			delete(s.expires, e.key)
+		}
+	}
+	s.queue = s.queue[i:]
+}
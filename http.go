@@ -0,0 +1,219 @@
+package spoe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RequestArgNames maps the parts of an HTTP request to the names of the
+// message args carrying them. Empty names are ignored.
+type RequestArgNames struct {
+	Method     string
+	Path       string
+	Query      string
+	Version    string
+	Headers    string
+	Body       string
+	ClientIP   string
+	ClientPort string
+}
+
+// ResponseArgNames maps the parts of an HTTP response to the names of the
+// message args carrying them. Empty names are ignored.
+type ResponseArgNames struct {
+	Status  string
+	Version string
+	Headers string
+	Body    string
+}
+
+var DefaultRequestArgNames = RequestArgNames{
+	Method:     "method",
+	Path:       "path",
+	Query:      "query",
+	Version:    "req.ver",
+	Headers:    "req.hdrs_bin",
+	Body:       "req.body",
+	ClientIP:   "src",
+	ClientPort: "src_port",
+}
+
+var DefaultResponseArgNames = ResponseArgNames{
+	Status:  "status",
+	Version: "res.ver",
+	Headers: "res.hdrs_bin",
+	Body:    "res.body",
+}
+
+// RequestFromArgs builds an http.Request from the args of a message, as
+// returned by ArgIterator.Map. All the data is copied so the request can
+// outlive the handler call.
+func RequestFromArgs(args map[string]interface{}, names RequestArgNames) (*http.Request, error) {
+	req := &http.Request{
+		Method:     http.MethodGet,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+	}
+
+	if method, ok := argString(args, names.Method); ok && method != "" {
+		req.Method = method
+	}
+
+	path, _ := argString(args, names.Path)
+	if path == "" {
+		path = "/"
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "request from args")
+	}
+	if query, ok := argString(args, names.Query); ok && query != "" {
+		u.RawQuery = query
+	}
+	req.URL = u
+	req.RequestURI = u.RequestURI()
+
+	if v, ok := argString(args, names.Version); ok && v != "" {
+		err := setProto(v, &req.Proto, &req.ProtoMajor, &req.ProtoMinor)
+		if err != nil {
+			return nil, errors.Wrap(err, "request from args")
+		}
+	}
+
+	if hdrs, ok := argBytes(args, names.Headers); ok {
+		req.Header, err = DecodeHeaders(hdrs)
+		if err != nil {
+			return nil, errors.Wrap(err, "request from args")
+		}
+	}
+	req.Host = req.Header.Get("Host")
+	req.Header.Del("Host")
+
+	if body, ok := argBytes(args, names.Body); ok && len(body) > 0 {
+		body = append([]byte(nil), body...)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	if ip, ok := args[names.ClientIP].(net.IP); ok && names.ClientIP != "" {
+		port, _ := argInt(args, names.ClientPort)
+		req.RemoteAddr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+
+	return req, nil
+}
+
+// ResponseFromArgs builds an http.Response from the args of a message, as
+// returned by ArgIterator.Map. All the data is copied so the response can
+// outlive the handler call.
+func ResponseFromArgs(args map[string]interface{}, names ResponseArgNames) (*http.Response, error) {
+	res := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+	}
+
+	status, ok := argInt(args, names.Status)
+	if !ok {
+		return nil, fmt.Errorf("response from args: expected %s", names.Status)
+	}
+	res.StatusCode = status
+	res.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+
+	if v, ok := argString(args, names.Version); ok && v != "" {
+		err := setProto(v, &res.Proto, &res.ProtoMajor, &res.ProtoMinor)
+		if err != nil {
+			return nil, errors.Wrap(err, "response from args")
+		}
+	}
+
+	if hdrs, ok := argBytes(args, names.Headers); ok {
+		var err error
+		res.Header, err = DecodeHeaders(hdrs)
+		if err != nil {
+			return nil, errors.Wrap(err, "response from args")
+		}
+	}
+
+	if body, ok := argBytes(args, names.Body); ok && len(body) > 0 {
+		body = append([]byte(nil), body...)
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		res.ContentLength = int64(len(body))
+	}
+
+	return res, nil
+}
+
+func setProto(v string, proto *string, major, minor *int) error {
+	v = strings.TrimPrefix(v, "HTTP/")
+	parts, err := parseVersion(v)
+	if err != nil {
+		return err
+	}
+
+	*major = parts[0]
+	*minor = 0
+	if len(parts) > 1 {
+		*minor = parts[1]
+	}
+	*proto = fmt.Sprintf("HTTP/%d.%d", *major, *minor)
+	return nil
+}
+
+func argString(args map[string]interface{}, name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+
+	switch v := args[name].(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+func argBytes(args map[string]interface{}, name string) ([]byte, bool) {
+	if name == "" {
+		return nil, false
+	}
+
+	switch v := args[name].(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+func argInt(args map[string]interface{}, name string) (int, bool) {
+	if name == "" {
+		return 0, false
+	}
+
+	switch v := args[name].(type) {
+	case int:
+		return v, true
+	case uint:
+		return int(v), true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,88 @@
+package spoe
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testHeaders(t *testing.T, kvs ...string) []byte {
+	b := make([]byte, 1024)
+	pos := 0
+	for _, s := range append(kvs, "", "") {
+		n, err := encodeString(b[pos:], s)
+		require.NoError(t, err)
+		pos += n
+	}
+	return b[:pos]
+}
+
+func TestRequestFromArgs(t *testing.T) {
+	body := []byte("a=1")
+	args := map[string]interface{}{
+		"method":       "POST",
+		"path":         "/foo/bar",
+		"query":        "x=y",
+		"req.ver":      "1.0",
+		"req.hdrs_bin": testHeaders(t, "host", "example.com", "content-type", "application/x-www-form-urlencoded"),
+		"req.body":     body,
+		"src":          net.ParseIP("10.0.0.1").To4(),
+		"src_port":     4242,
+	}
+
+	req, err := RequestFromArgs(args, DefaultRequestArgNames)
+	require.NoError(t, err)
+
+	require.Equal(t, "POST", req.Method)
+	require.Equal(t, "/foo/bar", req.URL.Path)
+	require.Equal(t, "y", req.URL.Query().Get("x"))
+	require.Equal(t, "/foo/bar?x=y", req.RequestURI)
+	require.Equal(t, "HTTP/1.0", req.Proto)
+	require.Equal(t, 0, req.ProtoMinor)
+	require.Equal(t, "example.com", req.Host)
+	require.Equal(t, "application/x-www-form-urlencoded", req.Header.Get("Content-Type"))
+	require.Equal(t, "10.0.0.1:4242", req.RemoteAddr)
+
+	// the body must not alias the frame buffer
+	body[0] = 'b'
+	got, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, "a=1", string(got))
+	require.Equal(t, int64(3), req.ContentLength)
+}
+
+func TestRequestFromArgsDefaults(t *testing.T) {
+	req, err := RequestFromArgs(map[string]interface{}{}, DefaultRequestArgNames)
+	require.NoError(t, err)
+
+	require.Equal(t, "GET", req.Method)
+	require.Equal(t, "/", req.URL.Path)
+	require.Equal(t, "HTTP/1.1", req.Proto)
+	require.Equal(t, "", req.RemoteAddr)
+}
+
+func TestResponseFromArgs(t *testing.T) {
+	args := map[string]interface{}{
+		"status":       uint(404),
+		"res.ver":      "2.0",
+		"res.hdrs_bin": testHeaders(t, "content-type", "text/plain"),
+		"res.body":     []byte("not found"),
+	}
+
+	res, err := ResponseFromArgs(args, DefaultResponseArgNames)
+	require.NoError(t, err)
+
+	require.Equal(t, 404, res.StatusCode)
+	require.Equal(t, "404 Not Found", res.Status)
+	require.Equal(t, "HTTP/2.0", res.Proto)
+	require.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+
+	got, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "not found", string(got))
+
+	_, err = ResponseFromArgs(map[string]interface{}{}, DefaultResponseArgNames)
+	require.Error(t, err)
+}
@@ -0,0 +1,113 @@
+// Package lru implements a size-bounded, least recently used cache whose
+// entries expire after a per-entry TTL.
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// Cache is safe for concurrent use.
+type Cache struct {
+	lock       sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+
+	now func() time.Time
+}
+
+// New returns a cache holding at most maxEntries entries. A zero or negative
+// maxEntries means no limit.
+func New(maxEntries int) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Add stores value under key. A zero ttl means the entry never expires.
+func (c *Cache) Add(key string, value interface{}, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&entry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+
+	if c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *Cache) Remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Purge removes all the entries.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
@@ -0,0 +1,55 @@
+package lru
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEviction(t *testing.T) {
+	c := New(2)
+
+	c.Add("a", 1, 0)
+	c.Add("b", 2, 0)
+
+	// a becomes the most recently used
+	v, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	c.Add("c", 3, 0)
+	require.Equal(t, 2, c.Len())
+
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	_, ok = c.Get("a")
+	require.True(t, ok)
+	_, ok = c.Get("c")
+	require.True(t, ok)
+
+	c.Remove("a")
+	_, ok = c.Get("a")
+	require.False(t, ok)
+
+	c.Purge()
+	require.Equal(t, 0, c.Len())
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	c := New(0)
+	c.now = func() time.Time { return now }
+
+	c.Add("a", 1, time.Minute)
+	c.Add("b", 2, 0)
+
+	now = now.Add(time.Minute)
+
+	_, ok := c.Get("a")
+	require.False(t, ok)
+	require.Equal(t, 1, c.Len())
+
+	_, ok = c.Get("b")
+	require.True(t, ok)
+}
@@ -0,0 +1,102 @@
+// Package reload calls a function when files change on disk.
+//
+// The handlers loading files watch them every ReloadInterval of their
+// configuration, zero disabling it. When loading fails, they keep serving
+// their previous data. Signals are left to the application: handlers export
+// their Reload method so that it can be called on SIGHUP.
+package reload
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+// Watcher polls the modification time and size of its files. Errors
+// returned by the reload function are logged, the caller keeps serving its
+// previous data.
+type Watcher struct {
+	paths  []string
+	reload func() error
+	states []fileState
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Watch starts watching paths every interval. It does not call reload
+// initially, and never calls it when interval is zero.
+func Watch(paths []string, interval time.Duration, reload func() error) *Watcher {
+	w := &Watcher{
+		paths:  paths,
+		reload: reload,
+		states: make([]fileState, len(paths)),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	w.changed()
+	go w.run(interval)
+	return w
+}
+
+func (w *Watcher) Close() error {
+	close(w.stop)
+	<-w.done
+	return nil
+}
+
+func (w *Watcher) run(interval time.Duration) {
+	defer close(w.done)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-tick:
+			if w.changed() {
+				w.call()
+			}
+		}
+	}
+}
+
+func (w *Watcher) call() {
+	err := w.reload()
+	if err != nil {
+		log.Errorf("reload %v: %s", w.paths, err)
+		return
+	}
+	log.Infof("reloaded %v", w.paths)
+}
+
+// changed updates the recorded file states and reports whether any of them
+// differs from the previous ones.
+func (w *Watcher) changed() bool {
+	res := false
+	for i, p := range w.paths {
+		var st fileState
+		fi, err := os.Stat(p)
+		if err == nil {
+			st = fileState{modTime: fi.ModTime(), size: fi.Size(), exists: true}
+		}
+		if st != w.states[i] {
+			res = true
+		}
+		w.states[i] = st
+	}
+	return res
+}
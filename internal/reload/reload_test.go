@@ -0,0 +1,42 @@
+package reload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "list")
+	require.NoError(t, ioutil.WriteFile(path, []byte("a"), 0644))
+
+	calls := int32(0)
+	w := Watch([]string{path}, 5*time.Millisecond, func() error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	defer w.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("ab"), 0644))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// removed files are changes too
+	require.NoError(t, os.Remove(path))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 2
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+// Package spoetest builds messages in the SPOE wire format for handler
+// tests.
+package spoetest
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+)
+
+type Message struct {
+	Name string
+	Args map[string]interface{}
+}
+
+// Messages encodes msgs as in a notify frame. Args are encoded in name
+// order. It panics on unsupported value types.
+func Messages(msgs ...Message) *spoe.MessageIterator {
+	var b []byte
+	for _, m := range msgs {
+		b = appendString(b, m.Name)
+		b = append(b, byte(len(m.Args)))
+
+		names := make([]string, 0, len(m.Args))
+		for name := range m.Args {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			b = appendString(b, name)
+			b = appendValue(b, m.Args[name])
+		}
+	}
+	return spoe.NewMessageIterator(b)
+}
+
+// Single encodes a single message.
+func Single(name string, args map[string]interface{}) *spoe.MessageIterator {
+	return Messages(Message{Name: name, Args: args})
+}
+
+// Vars returns the values of the set-var actions, by variable name.
+func Vars(actions []spoe.Action) map[string]interface{} {
+	res := make(map[string]interface{})
+	for _, a := range actions {
+		if v, ok := a.(spoe.ActionSetVar); ok {
+			res[v.Name] = v.Value
+		}
+	}
+	return res
+}
+
+func appendValue(b []byte, v interface{}) []byte {
+	switch val := v.(type) {
+	case nil:
+		return append(b, 0)
+	case bool:
+		if val {
+			return append(b, 0x11)
+		}
+		return append(b, 0x01)
+	case int:
+		return appendVarint(append(b, 4), val)
+	case uint:
+		return appendVarint(append(b, 5), int(val))
+	case net.IP:
+		if v4 := val.To4(); v4 != nil {
+			return append(append(b, 6), v4...)
+		}
+		return append(append(b, 7), val.To16()...)
+	case string:
+		return appendString(append(b, 8), val)
+	case []byte:
+		return appendString(append(b, 9), string(val))
+	}
+	panic(fmt.Sprintf("spoetest: type %T is not handled", v))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendVarint(b, len(s)), s...)
+}
+
+func appendVarint(b []byte, i int) []byte {
+	if i < 240 {
+		return append(b, byte(i))
+	}
+
+	b = append(b, byte(i)|240)
+	i = (i - 240) >> 4
+	for i >= 128 {
+		b = append(b, byte(i)|128)
+		i = (i - 128) >> 7
+	}
+	return append(b, byte(i))
+}
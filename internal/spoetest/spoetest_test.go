@@ -0,0 +1,43 @@
+package spoetest
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessages(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	msgs := Messages(
+		Message{Name: "first", Args: map[string]interface{}{
+			"ip":   net.ParseIP("10.0.0.1"),
+			"ip6":  net.ParseIP("2001:db8::1"),
+			"n":    -1 + 100000,
+			"u":    uint(7),
+			"ok":   true,
+			"long": long,
+			"bin":  []byte{1, 2},
+			"null": nil,
+		}},
+		Message{Name: "second", Args: map[string]interface{}{}},
+	)
+
+	require.True(t, msgs.Next())
+	require.Equal(t, "first", msgs.Message.Name)
+	args := msgs.Message.Args.Map()
+	require.True(t, net.ParseIP("10.0.0.1").Equal(args["ip"].(net.IP)))
+	require.True(t, net.ParseIP("2001:db8::1").Equal(args["ip6"].(net.IP)))
+	require.Equal(t, 99999, args["n"])
+	require.Equal(t, uint(7), args["u"])
+	require.Equal(t, true, args["ok"])
+	require.Equal(t, long, args["long"])
+	require.Equal(t, []byte{1, 2}, args["bin"])
+	require.Nil(t, args["null"])
+
+	require.True(t, msgs.Next())
+	require.Equal(t, "second", msgs.Message.Name)
+	require.False(t, msgs.Next())
+	require.NoError(t, msgs.Error())
+}
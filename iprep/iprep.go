@@ -0,0 +1,218 @@
+// Package iprep implements an SPOE handler scoring client IPs against CIDR
+// lists.
+//
+// Lists are text files with one prefix per line, followed by its score and
+// optionally a comma separated list of tags:
+//
+//	# tor exit nodes
+//	192.0.2.0/24    80  tor,proxy
+//	2001:db8::/32   50
+//	198.51.100.7    100 scanner
+//
+// The most specific prefix matching the IP wins. When several lines have the
+// same prefix, the last one wins.
+package iprep
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+)
+
+type Entry struct {
+	Prefix *net.IPNet
+	Score  int
+	Tags   []string
+}
+
+type Config struct {
+	// Files are the CIDR lists, loaded in order.
+	Files []string
+
+	// Message and Arg name the message and its net.IP arg to score.
+	Message string
+	Arg     string
+
+	// ScoreVar and TagsVar name the session variables set by the handler.
+	// The tags variable is only set for listed IPs with tags.
+	ScoreVar string
+	TagsVar  string
+	// DefaultScore is the score of IPs not in any list.
+	DefaultScore int
+
+	// ReloadInterval is how often the files are checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	Message:        "ip-rep",
+	Arg:            "ip",
+	ScoreVar:       "ip_score",
+	TagsVar:        "ip_tags",
+	ReloadInterval: 10 * time.Second,
+}
+
+// Reputation scores IPs.
+type Reputation struct {
+	cfg     Config
+	trie    atomic.Value
+	watcher *reload.Watcher
+}
+
+// New loads the lists of cfg and starts watching them.
+func New(cfg Config) (*Reputation, error) {
+	r := &Reputation{cfg: cfg}
+
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	r.watcher = reload.Watch(cfg.Files, cfg.ReloadInterval, r.Reload)
+	return r, nil
+}
+
+func (r *Reputation) Close() error {
+	return r.watcher.Close()
+}
+
+// Reload loads the lists again.
+func (r *Reputation) Reload() error {
+	t := &trie{}
+	for _, path := range r.cfg.Files {
+		err := loadFile(t, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.trie.Store(t)
+	return nil
+}
+
+func (r *Reputation) Lookup(ip net.IP) (Entry, bool) {
+	return r.trie.Load().(*trie).lookup(ip)
+}
+
+func (r *Reputation) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != r.cfg.Message {
+			continue
+		}
+
+		var ip net.IP
+		for msgs.Message.Args.Next() {
+			arg := msgs.Message.Args.Arg
+			if arg.Name != r.cfg.Arg {
+				continue
+			}
+
+			var ok bool
+			ip, ok = arg.Value.(net.IP)
+			if !ok {
+				return nil, fmt.Errorf("iprep: expected ip in arg %s, got %T", r.cfg.Arg, arg.Value)
+			}
+		}
+		if ip == nil {
+			continue
+		}
+
+		entry, ok := r.Lookup(ip)
+		if !ok {
+			return []spoe.Action{
+				spoe.ActionSetVar{Name: r.cfg.ScoreVar, Scope: spoe.VarScopeSession, Value: r.cfg.DefaultScore},
+			}, nil
+		}
+
+		actions := []spoe.Action{
+			spoe.ActionSetVar{Name: r.cfg.ScoreVar, Scope: spoe.VarScopeSession, Value: entry.Score},
+		}
+		if len(entry.Tags) > 0 && r.cfg.TagsVar != "" {
+			actions = append(actions, spoe.ActionSetVar{
+				Name:  r.cfg.TagsVar,
+				Scope: spoe.VarScopeSession,
+				Value: strings.Join(entry.Tags, ","),
+			})
+		}
+		return actions, nil
+	}
+
+	return nil, msgs.Error()
+}
+
+func loadFile(t *trie, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("iprep: %s", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		e, err := parseEntry(fields)
+		if err != nil {
+			return fmt.Errorf("iprep: %s:%d: %s", path, line, err)
+		}
+		t.insert(e.Prefix, e)
+	}
+	if s.Err() != nil {
+		return fmt.Errorf("iprep: %s: %s", path, s.Err())
+	}
+
+	return nil
+}
+
+func parseEntry(fields []string) (Entry, error) {
+	if len(fields) < 2 || len(fields) > 3 {
+		return Entry{}, fmt.Errorf("expected prefix, score and optional tags")
+	}
+
+	prefix := fields[0]
+	if !strings.Contains(prefix, "/") {
+		ip := net.ParseIP(prefix)
+		if ip == nil {
+			return Entry{}, fmt.Errorf("invalid ip %s", prefix)
+		}
+		if ip.To4() != nil {
+			prefix += "/32"
+		} else {
+			prefix += "/128"
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	score, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid score %s", fields[1])
+	}
+
+	e := Entry{
+		Prefix: ipnet,
+		Score:  score,
+	}
+	if len(fields) == 3 {
+		e.Tags = strings.Split(fields[2], ",")
+	}
+	return e, nil
+}
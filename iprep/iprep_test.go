@@ -0,0 +1,95 @@
+package iprep
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrie(t *testing.T) {
+	tr := &trie{}
+	for _, e := range []struct {
+		prefix string
+		score  int
+	}{
+		{"10.0.0.0/8", 1},
+		{"10.1.0.0/16", 2},
+		{"10.1.2.3/32", 3},
+		{"0.0.0.0/0", 4},
+		{"2001:db8::/32", 5},
+	} {
+		_, n, err := net.ParseCIDR(e.prefix)
+		require.NoError(t, err)
+		tr.insert(n, Entry{Prefix: n, Score: e.score})
+	}
+
+	for ip, score := range map[string]int{
+		"10.2.0.1":        1,
+		"10.1.9.9":        2,
+		"10.1.2.3":        3,
+		"192.168.0.1":     4,
+		"2001:db8::1":     5,
+		"::ffff:10.1.2.3": 3,
+	} {
+		e, ok := tr.lookup(net.ParseIP(ip))
+		require.True(t, ok, ip)
+		require.Equal(t, score, e.Score, ip)
+	}
+
+	_, ok := tr.lookup(net.ParseIP("2001:db9::1"))
+	require.False(t, ok)
+}
+
+func writeList(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func TestReputation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iprep")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "list.txt")
+	writeList(t, path, `
+# comment
+192.0.2.0/24   80  tor,proxy
+198.51.100.7   100 # no tags
+`)
+
+	cfg := DefaultConfig
+	cfg.Files = []string{path}
+	cfg.ReloadInterval = 5 * time.Millisecond
+	r, err := New(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	handle := func(ip string) map[string]interface{} {
+		actions, err := r.Handle(spoetest.Single("ip-rep", map[string]interface{}{"ip": net.ParseIP(ip)}))
+		require.NoError(t, err)
+		return spoetest.Vars(actions)
+	}
+
+	require.Equal(t, map[string]interface{}{"ip_score": 80, "ip_tags": "tor,proxy"}, handle("192.0.2.1"))
+	require.Equal(t, map[string]interface{}{"ip_score": 100}, handle("198.51.100.7"))
+	require.Equal(t, map[string]interface{}{"ip_score": 0}, handle("203.0.113.1"))
+
+	// invalid lists are not loaded
+	writeList(t, path, "203.0.113.0/24 high\n")
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 80, handle("192.0.2.1")["ip_score"])
+
+	writeList(t, path, "203.0.113.0/24 60 bad\n")
+	require.Eventually(t, func() bool {
+		return handle("203.0.113.1")["ip_score"] == 60
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, 0, handle("192.0.2.1")["ip_score"])
+
+	_, err = r.Handle(spoetest.Single("ip-rep", map[string]interface{}{"ip": "192.0.2.1"}))
+	require.Error(t, err)
+}
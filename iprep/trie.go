@@ -0,0 +1,70 @@
+package iprep
+
+import "net"
+
+type node struct {
+	children [2]*node
+	entry    *Entry
+}
+
+// trie is a binary prefix trie for longest prefix matching. IPv4 and IPv6
+// prefixes are kept in separate trees.
+type trie struct {
+	v4 node
+	v6 node
+}
+
+func (t *trie) insert(prefix *net.IPNet, e Entry) {
+	ip, root := prefix.IP.To16(), &t.v6
+	if len(prefix.Mask) == net.IPv4len {
+		ip, root = prefix.IP.To4(), &t.v4
+	}
+	ones, _ := prefix.Mask.Size()
+
+	n := root
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+	n.entry = &e
+}
+
+func (t *trie) lookup(ip net.IP) (Entry, bool) {
+	ip, n := t.root(ip)
+	if ip == nil {
+		return Entry{}, false
+	}
+
+	var match *Entry
+	for i := 0; n != nil; i++ {
+		if n.entry != nil {
+			match = n.entry
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		n = n.children[bit(ip, i)]
+	}
+
+	if match == nil {
+		return Entry{}, false
+	}
+	return *match, true
+}
+
+func (t *trie) root(ip net.IP) (net.IP, *node) {
+	if v4 := ip.To4(); v4 != nil {
+		return v4, &t.v4
+	}
+	if v6 := ip.To16(); v6 != nil {
+		return v6, &t.v6
+	}
+	return nil, nil
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
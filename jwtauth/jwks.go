@@ -0,0 +1,155 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errUnsupportedKey is returned for keys of types or curves which are not
+// supported. They are skipped, so that a provider adding such keys to its
+// set does not break the validation of tokens signed with the other keys.
+var errUnsupportedKey = errors.New("unsupported key")
+
+// key is a verification key read from a JWKS file. Exactly one of its
+// public keys is set.
+type key struct {
+	id  string
+	alg string
+
+	rsa    *rsa.PublicKey
+	ecdsa  *ecdsa.PublicKey
+	secret []byte
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	// symmetric
+	K string `json:"k"`
+}
+
+func loadJWKS(path string) ([]key, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwtauth: %s", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(b, &set)
+	if err != nil {
+		return nil, fmt.Errorf("jwtauth: %s: %s", path, err)
+	}
+
+	keys := make([]key, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		parsed, err := parseJWK(k)
+		if errors.Is(err, errUnsupportedKey) {
+			log.Warnf("jwtauth: %s: skipping key %d: %s", path, i, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwtauth: %s: key %d: %s", path, i, err)
+		}
+		keys = append(keys, parsed)
+	}
+
+	return keys, nil
+}
+
+func parseJWK(k jwk) (key, error) {
+	res := key{id: k.Kid, alg: k.Alg}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return res, fmt.Errorf("modulus: %s", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return res, fmt.Errorf("exponent: %s", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return res, fmt.Errorf("exponent too large")
+		}
+		res.rsa = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return res, fmt.Errorf("%w: curve %q", errUnsupportedKey, k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return res, fmt.Errorf("x: %s", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return res, fmt.Errorf("y: %s", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return res, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		res.ecdsa = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return res, fmt.Errorf("secret: %s", err)
+		}
+		if len(secret) == 0 {
+			return res, fmt.Errorf("empty secret")
+		}
+		res.secret = secret
+
+	default:
+		return res, fmt.Errorf("%w: type %q", errUnsupportedKey, k.Kty)
+	}
+
+	return res, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,219 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingToken     = errors.New("missing token")
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported algorithm")
+	ErrNoKey            = errors.New("no matching key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("token expired")
+	ErrMissingExp       = errors.New("missing exp claim")
+	ErrNotYetValid      = errors.New("token not yet valid")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+)
+
+var algHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// algCurves are the curves of the keys ES algorithms are used with.
+var algCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parsed is a token whose signature has not been verified yet.
+type parsed struct {
+	header       header
+	claims       map[string]interface{}
+	signingInput string
+	signature    []byte
+}
+
+func parse(token string) (*parsed, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	res := &parsed{
+		signingInput: parts[0] + "." + parts[1],
+	}
+
+	err := decodeSegment(parts[0], &res.header)
+	if err != nil {
+		return nil, err
+	}
+
+	err = decodeSegment(parts[1], &res.claims)
+	if err != nil {
+		return nil, err
+	}
+
+	res.signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	return res, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+	err = d.Decode(v)
+	if err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+func (p *parsed) verify(k key) error {
+	hash, ok := algHashes[p.header.Alg]
+	if !ok {
+		return ErrUnsupportedAlg
+	}
+
+	switch p.header.Alg[:2] {
+	case "HS":
+		if k.secret == nil {
+			return ErrNoKey
+		}
+		mac := hmac.New(hash.New, k.secret)
+		mac.Write([]byte(p.signingInput))
+		if !hmac.Equal(mac.Sum(nil), p.signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+
+	case "RS":
+		if k.rsa == nil {
+			return ErrNoKey
+		}
+		err := rsa.VerifyPKCS1v15(k.rsa, hash, digest(hash, p.signingInput), p.signature)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+
+	case "ES":
+		if k.ecdsa == nil || k.ecdsa.Curve.Params().Name != algCurves[p.header.Alg] {
+			return ErrNoKey
+		}
+		size := (k.ecdsa.Curve.Params().BitSize + 7) / 8
+		if len(p.signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(p.signature[:size])
+		s := new(big.Int).SetBytes(p.signature[size:])
+		if !ecdsa.Verify(k.ecdsa, digest(hash, p.signingInput), r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	return ErrUnsupportedAlg
+}
+
+func digest(hash crypto.Hash, s string) []byte {
+	h := hash.New()
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// checkClaims validates the registered claims of a verified token.
+func checkClaims(claims map[string]interface{}, now time.Time, leeway time.Duration, requireExp bool, issuer, audience string) error {
+	if exp, ok, err := numericDate(claims, "exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(leeway)) {
+		return ErrExpired
+	} else if !ok && requireExp {
+		return ErrMissingExp
+	}
+
+	if nbf, ok, err := numericDate(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+
+	if issuer != "" {
+		iss, _ := claims["iss"].(string)
+		if iss != issuer {
+			return ErrInvalidIssuer
+		}
+	}
+
+	if audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == audience {
+				return nil
+			}
+		case []interface{}:
+			for _, a := range aud {
+				if a == audience {
+					return nil
+				}
+			}
+		}
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%w: %s is not a number", ErrMalformed, name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %s is not a number", ErrMalformed, name)
+	}
+
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true, nil
+}
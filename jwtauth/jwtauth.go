@@ -0,0 +1,303 @@
+// Package jwtauth implements an SPOE handler validating JWT bearer tokens
+// against the keys of a local JWKS file.
+package jwtauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// JWKSFile is the path of the JSON Web Key Set holding the
+	// verification keys.
+	JWKSFile string
+
+	// Message names the message to handle. The token is read from
+	// TokenArg when set and present, otherwise from the Authorization
+	// header of HeadersArg.
+	Message    string
+	TokenArg   string
+	HeadersArg string
+
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// Algorithms restricts the accepted algorithms. All supported
+	// algorithms are accepted when empty.
+	Algorithms []string
+	// Leeway is the clock skew tolerated on exp and nbf.
+	Leeway time.Duration
+	// RequireExp rejects tokens without exp, which would never expire.
+	RequireExp bool
+
+	// ValidVar names the boolean variable set for every token. ErrorVar,
+	// when set, receives the reason invalid tokens were rejected.
+	ValidVar string
+	ErrorVar string
+	// Claims maps claim names to the variables they are copied to.
+	// Arrays are joined with commas, objects are not supported.
+	Claims map[string]string
+
+	// ReloadInterval is how often the JWKS file is checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	Message:        "jwt",
+	TokenArg:       "token",
+	HeadersArg:     "req.hdrs_bin",
+	RequireExp:     true,
+	ValidVar:       "jwt_valid",
+	ReloadInterval: 10 * time.Second,
+}
+
+// Validator validates tokens.
+type Validator struct {
+	cfg     Config
+	algs    map[string]bool
+	claims  []string
+	keys    atomic.Value
+	watcher *reload.Watcher
+
+	now func() time.Time
+}
+
+// New loads the keys of cfg and starts watching the JWKS file.
+func New(cfg Config) (*Validator, error) {
+	v := &Validator{
+		cfg: cfg,
+		now: time.Now,
+	}
+
+	if len(cfg.Algorithms) > 0 {
+		v.algs = make(map[string]bool)
+		for _, alg := range cfg.Algorithms {
+			if _, ok := algHashes[alg]; !ok {
+				return nil, fmt.Errorf("jwtauth: unsupported algorithm %q", alg)
+			}
+			v.algs[alg] = true
+		}
+	}
+
+	for claim := range cfg.Claims {
+		v.claims = append(v.claims, claim)
+	}
+	sort.Strings(v.claims)
+
+	err := v.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	v.watcher = reload.Watch([]string{cfg.JWKSFile}, cfg.ReloadInterval, v.Reload)
+	return v, nil
+}
+
+func (v *Validator) Close() error {
+	return v.watcher.Close()
+}
+
+// Reload loads the JWKS file again.
+func (v *Validator) Reload() error {
+	keys, err := loadJWKS(v.cfg.JWKSFile)
+	if err != nil {
+		return err
+	}
+
+	v.keys.Store(keys)
+	return nil
+}
+
+// Validate verifies the signature and the registered claims of token, and
+// returns its claims. Numeric claims are json.Number values.
+func (v *Validator) Validate(token string) (map[string]interface{}, error) {
+	p, err := parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := algHashes[p.header.Alg]; !ok {
+		return nil, ErrUnsupportedAlg
+	}
+	if v.algs != nil && !v.algs[p.header.Alg] {
+		return nil, ErrUnsupportedAlg
+	}
+
+	err = ErrNoKey
+	for _, k := range v.keys.Load().([]key) {
+		if p.header.Kid != "" && k.id != p.header.Kid {
+			continue
+		}
+		if k.alg != "" && k.alg != p.header.Alg {
+			continue
+		}
+
+		err = p.verify(k)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkClaims(p.claims, v.now(), v.cfg.Leeway, v.cfg.RequireExp, v.cfg.Issuer, v.cfg.Audience)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.claims, nil
+}
+
+// ArgError is returned when an arg carrying the token has an unexpected
+// type or cannot be decoded, as opposed to an invalid token.
+type ArgError struct {
+	Arg string
+	Err error
+}
+
+func (e *ArgError) Error() string {
+	return fmt.Sprintf("jwtauth: arg %s: %s", e.Arg, e.Err)
+}
+
+func (e *ArgError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateArgs validates the token carried by args, as returned by
+// ArgIterator.Map, and returns its claims. It returns ErrMissingToken when
+// there is no token, and an *ArgError when the args have unexpected types.
+func (v *Validator) ValidateArgs(args map[string]interface{}) (map[string]interface{}, error) {
+	token, err := v.token(args)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	return v.Validate(token)
+}
+
+func (v *Validator) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != v.cfg.Message {
+			continue
+		}
+
+		token, err := v.token(msgs.Message.Args.Map())
+		if err != nil {
+			return nil, err
+		}
+
+		if token == "" {
+			return v.invalid(ErrMissingToken.Error()), nil
+		}
+
+		claims, err := v.Validate(token)
+		if err != nil {
+			log.Debugf("jwtauth: rejecting token: %s", err)
+			return v.invalid(err.Error()), nil
+		}
+
+		actions := []spoe.Action{
+			spoe.ActionSetVar{Name: v.cfg.ValidVar, Scope: spoe.VarScopeTransaction, Value: true},
+		}
+		for _, claim := range v.claims {
+			value, ok := claimValue(claims[claim])
+			if !ok {
+				continue
+			}
+			actions = append(actions, spoe.ActionSetVar{Name: v.cfg.Claims[claim], Scope: spoe.VarScopeTransaction, Value: value})
+		}
+		return actions, nil
+	}
+
+	return nil, msgs.Error()
+}
+
+func (v *Validator) token(args map[string]interface{}) (string, error) {
+	if v.cfg.TokenArg != "" {
+		if value, ok := args[v.cfg.TokenArg]; ok {
+			s, ok := value.(string)
+			if !ok {
+				return "", &ArgError{Arg: v.cfg.TokenArg, Err: fmt.Errorf("expected string, got %T", value)}
+			}
+			if token := bearer(s); token != "" {
+				return token, nil
+			}
+		}
+	}
+
+	if v.cfg.HeadersArg == "" {
+		return "", nil
+	}
+	value, ok := args[v.cfg.HeadersArg]
+	if !ok {
+		return "", nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return "", &ArgError{Arg: v.cfg.HeadersArg, Err: fmt.Errorf("expected binary, got %T", value)}
+	}
+
+	h, err := spoe.DecodeHeaders(b)
+	if err != nil {
+		return "", &ArgError{Arg: v.cfg.HeadersArg, Err: err}
+	}
+	return bearer(h.Get("Authorization")), nil
+}
+
+func (v *Validator) invalid(reason string) []spoe.Action {
+	actions := []spoe.Action{
+		spoe.ActionSetVar{Name: v.cfg.ValidVar, Scope: spoe.VarScopeTransaction, Value: false},
+	}
+	if v.cfg.ErrorVar != "" {
+		actions = append(actions, spoe.ActionSetVar{Name: v.cfg.ErrorVar, Scope: spoe.VarScopeTransaction, Value: reason})
+	}
+	return actions
+}
+
+// bearer strips the scheme of an Authorization header value. Values without
+// a scheme are returned as is.
+func bearer(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		if !strings.EqualFold(s[:i], "bearer") {
+			return ""
+		}
+		s = strings.TrimSpace(s[i+1:])
+	}
+	return s
+}
+
+// claimValue converts a claim to a type variables can hold.
+func claimValue(v interface{}) (interface{}, bool) {
+	switch val := v.(type) {
+	case string, bool:
+		return val, true
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return int(i), true
+		}
+		return val.String(), true
+	case []interface{}:
+		parts := make([]string, 0, len(val))
+		for _, e := range val {
+			s, ok := claimValue(e)
+			if !ok {
+				return nil, false
+			}
+			parts = append(parts, fmt.Sprint(s))
+		}
+		return strings.Join(parts, ","), true
+	}
+	return nil, false
+}
@@ -0,0 +1,256 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+var b64 = base64.RawURLEncoding
+
+type testKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return testKeys{
+		secret: []byte("0123456789abcdef0123456789abcdef"),
+		rsa:    rsaKey,
+		ec:     ecKey,
+	}
+}
+
+func (k testKeys) jwks() []byte {
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "oct", "kid": "hs", "k": b64.EncodeToString(k.secret)},
+			{
+				"kty": "RSA", "kid": "rs", "alg": "RS256", "use": "sig",
+				"n": b64.EncodeToString(k.rsa.N.Bytes()),
+				"e": b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes()),
+			},
+			{
+				"kty": "EC", "kid": "es", "crv": "P-256",
+				"x": b64.EncodeToString(k.ec.X.Bytes()),
+				"y": b64.EncodeToString(k.ec.Y.Bytes()),
+			},
+			{"kty": "RSA", "use": "enc", "n": "", "e": ""},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"},
+			{"kty": "EC", "kid": "k1", "crv": "secp256k1", "x": "", "y": ""},
+		},
+	}
+	b, _ := json.Marshal(set)
+	return b
+}
+
+func (k testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	hash := crypto.SHA256
+	if alg == "ES384" {
+		hash = crypto.SHA384
+	}
+	digest := func() []byte {
+		h := hash.New()
+		h.Write([]byte(input))
+		return h.Sum(nil)
+	}
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(crypto.SHA256.New, k.secret)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest())
+		require.NoError(t, err)
+	case "ES256", "ES384":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest())
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case "none":
+	default:
+		t.Fatalf("unexpected alg %s", alg)
+	}
+
+	return input + "." + b64.EncodeToString(sig)
+}
+
+func newTestValidator(t *testing.T, keys testKeys, cfg Config) (*Validator, string) {
+	dir, err := ioutil.TempDir("", "jwtauth")
+	require.NoError(t, err)
+
+	cfg.JWKSFile = filepath.Join(dir, "jwks.json")
+	require.NoError(t, ioutil.WriteFile(cfg.JWKSFile, keys.jwks(), 0644))
+
+	v, err := New(cfg)
+	require.NoError(t, err)
+	v.now = func() time.Time { return time.Unix(1000, 0) }
+	return v, dir
+}
+
+func TestValidate(t *testing.T) {
+	keys := newTestKeys(t)
+	cfg := DefaultConfig
+	cfg.Issuer = "https://issuer.example.com"
+	cfg.Audience = "api"
+	cfg.Leeway = 10 * time.Second
+	v, dir := newTestValidator(t, keys, cfg)
+	defer os.RemoveAll(dir)
+	defer v.Close()
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://issuer.example.com",
+			"aud": []string{"other", "api"},
+			"sub": "alice",
+			"exp": 2000,
+			"nbf": 500,
+		}
+		for k, val := range extra {
+			if val == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = val
+		}
+		return c
+	}
+
+	for _, alg := range []string{"HS256", "RS256", "ES256"} {
+		res, err := v.Validate(keys.sign(t, alg, "", claims(nil)))
+		require.NoError(t, err, alg)
+		require.Equal(t, "alice", res["sub"])
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"malformed", "abc.def", ErrMalformed},
+		{"none", keys.sign(t, "none", "", claims(nil)), ErrUnsupportedAlg},
+		{"unknown kid", keys.sign(t, "RS256", "other", claims(nil)), ErrNoKey},
+		{"wrong kid", keys.sign(t, "HS256", "es", claims(nil)), ErrNoKey},
+		{"wrong curve", keys.sign(t, "ES384", "es", claims(nil)), ErrNoKey},
+		{"expired", keys.sign(t, "RS256", "rs", claims(map[string]interface{}{"exp": 990})), ErrExpired},
+		{"no exp", keys.sign(t, "RS256", "rs", claims(map[string]interface{}{"exp": nil})), ErrMissingExp},
+		{"not yet valid", keys.sign(t, "RS256", "rs", claims(map[string]interface{}{"nbf": 1011})), ErrNotYetValid},
+		{"issuer", keys.sign(t, "ES256", "es", claims(map[string]interface{}{"iss": "evil"})), ErrInvalidIssuer},
+		{"audience", keys.sign(t, "ES256", "es", claims(map[string]interface{}{"aud": "other"})), ErrInvalidAudience},
+	}
+	for _, test := range tests {
+		_, err := v.Validate(test.token)
+		require.Equal(t, test.err, err, test.name)
+	}
+
+	// within leeway
+	_, err := v.Validate(keys.sign(t, "RS256", "rs", claims(map[string]interface{}{"exp": 995})))
+	require.NoError(t, err)
+
+	v.cfg.RequireExp = false
+	_, err = v.Validate(keys.sign(t, "RS256", "rs", claims(map[string]interface{}{"exp": nil})))
+	require.NoError(t, err)
+	v.cfg.RequireExp = true
+
+	// tampered payload
+	token := keys.sign(t, "HS256", "hs", claims(nil))
+	other := keys.sign(t, "HS256", "hs", claims(map[string]interface{}{"sub": "mallory"}))
+	_, err = v.Validate(token[:len(token)-43] + other[len(other)-43:])
+	require.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestHandle(t *testing.T) {
+	keys := newTestKeys(t)
+	cfg := DefaultConfig
+	cfg.ErrorVar = "jwt_error"
+	cfg.Algorithms = []string{"RS256"}
+	cfg.Claims = map[string]string{"sub": "jwt_sub", "scope": "jwt_scope", "admin": "jwt_admin", "exp": "jwt_exp"}
+	cfg.ReloadInterval = 5 * time.Millisecond
+	v, dir := newTestValidator(t, keys, cfg)
+	defer os.RemoveAll(dir)
+	defer v.Close()
+
+	token := keys.sign(t, "RS256", "rs", map[string]interface{}{
+		"sub":   "alice",
+		"scope": []string{"read", "write"},
+		"admin": true,
+		"exp":   2000,
+	})
+
+	handle := func(args map[string]interface{}) map[string]interface{} {
+		actions, err := v.Handle(spoetest.Single("jwt", args))
+		require.NoError(t, err)
+		for _, a := range actions {
+			require.Equal(t, spoe.VarScopeTransaction, a.(spoe.ActionSetVar).Scope)
+		}
+		return spoetest.Vars(actions)
+	}
+
+	valid := map[string]interface{}{
+		"jwt_valid": true,
+		"jwt_sub":   "alice",
+		"jwt_scope": "read,write",
+		"jwt_admin": true,
+		"jwt_exp":   2000,
+	}
+	require.Equal(t, valid, handle(map[string]interface{}{"token": token}))
+	require.Equal(t, valid, handle(map[string]interface{}{"token": "Bearer " + token}))
+
+	headers, err := spoe.EncodeHeaders(http.Header{"Authorization": []string{"Bearer " + token}})
+	require.NoError(t, err)
+	require.Equal(t, valid, handle(map[string]interface{}{"req.hdrs_bin": headers}))
+
+	require.Equal(t, map[string]interface{}{"jwt_valid": false, "jwt_error": "missing token"},
+		handle(map[string]interface{}{"token": "Basic YWxpY2U6cGFzcw=="}))
+	require.Equal(t, map[string]interface{}{"jwt_valid": false, "jwt_error": "unsupported algorithm"},
+		handle(map[string]interface{}{"token": keys.sign(t, "HS256", "hs", nil)}))
+
+	claims, err := v.ValidateArgs(map[string]interface{}{"req.hdrs_bin": headers})
+	require.NoError(t, err)
+	require.Equal(t, "alice", claims["sub"])
+	_, err = v.ValidateArgs(map[string]interface{}{})
+	require.Equal(t, ErrMissingToken, err)
+
+	// rotated keys are picked up
+	other := newTestKeys(t)
+	require.NoError(t, ioutil.WriteFile(v.cfg.JWKSFile, other.jwks(), 0644))
+	require.Eventually(t, func() bool {
+		return handle(map[string]interface{}{"token": token})["jwt_valid"] == false
+	}, time.Second, 5*time.Millisecond)
+
+	_, err = v.Handle(spoetest.Single("jwt", map[string]interface{}{"token": 42}))
+	require.EqualError(t, err, "jwtauth: arg token: expected string, got int")
+	_, err = v.ValidateArgs(map[string]interface{}{"req.hdrs_bin": []byte{5}})
+	require.IsType(t, &ArgError{}, err)
+}
@@ -0,0 +1,242 @@
+// Package mirror implements an SPOE handler replaying HTTP requests to
+// shadow backends.
+//
+// Requests are rebuilt from the message args and sent in the background, so
+// the handler returns immediately and never delays the ACK. Requests are
+// dropped rather than queued when too many are in flight.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// Backends are the base URLs requests are mirrored to. The request
+	// path is appended to the backend path.
+	Backends []string
+
+	// Message names the message to handle and Args the args carrying the
+	// request.
+	Message string
+	Args    spoe.RequestArgNames
+
+	// SampleRate is the fraction of the requests mirrored, between 0 and 1.
+	SampleRate float64
+	// MaxInFlight bounds the number of mirrored requests in progress,
+	// over all backends.
+	MaxInFlight int
+	// Timeout bounds each mirrored request, including reading the
+	// response.
+	Timeout time.Duration
+
+	// Client sends the requests. http.DefaultClient is used when nil.
+	Client *http.Client
+}
+
+var DefaultConfig = Config{
+	Message:     "mirror",
+	Args:        spoe.DefaultRequestArgNames,
+	SampleRate:  1,
+	MaxInFlight: 100,
+	Timeout:     5 * time.Second,
+}
+
+type Stats struct {
+	// Sent counts the requests which got a response, whatever its status.
+	Sent uint64
+	// Failed counts the requests which got no response.
+	Failed uint64
+	// Dropped counts the requests not sent because too many were in
+	// flight.
+	Dropped uint64
+}
+
+// Mirror replays requests.
+type Mirror struct {
+	cfg      Config
+	backends []*url.URL
+	client   *http.Client
+	slots    chan struct{}
+
+	lock    sync.RWMutex
+	closed  bool
+	running sync.WaitGroup
+
+	sent, failed, dropped uint64
+
+	sample func() float64
+}
+
+func New(cfg Config) (*Mirror, error) {
+	if len(cfg.Backends) == 0 {
+		return nil, fmt.Errorf("mirror: no backend")
+	}
+	if cfg.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("mirror: MaxInFlight must be positive")
+	}
+
+	m := &Mirror{
+		cfg:    cfg,
+		client: cfg.Client,
+		slots:  make(chan struct{}, cfg.MaxInFlight),
+		sample: rand.Float64,
+	}
+	if m.client == nil {
+		m.client = http.DefaultClient
+	}
+
+	for _, b := range cfg.Backends {
+		u, err := url.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: backend %s: %s", b, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("mirror: backend %s: expected an http or https URL", b)
+		}
+		m.backends = append(m.backends, u)
+	}
+
+	return m, nil
+}
+
+// Close stops mirroring and waits for the requests in flight.
+func (m *Mirror) Close() error {
+	m.lock.Lock()
+	m.closed = true
+	m.lock.Unlock()
+
+	m.running.Wait()
+	return nil
+}
+
+func (m *Mirror) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadUint64(&m.sent),
+		Failed:  atomic.LoadUint64(&m.failed),
+		Dropped: atomic.LoadUint64(&m.dropped),
+	}
+}
+
+func (m *Mirror) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != m.cfg.Message {
+			continue
+		}
+
+		if m.cfg.SampleRate < 1 && m.sample() >= m.cfg.SampleRate {
+			continue
+		}
+
+		req, err := spoe.RequestFromArgs(msgs.Message.Args.Map(), m.cfg.Args)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %s", err)
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %s", err)
+		}
+
+		for _, backend := range m.backends {
+			m.send(backend, req, body)
+		}
+	}
+
+	return nil, msgs.Error()
+}
+
+func (m *Mirror) send(backend *url.URL, orig *http.Request, body []byte) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+		return
+	}
+
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		defer func() { <-m.slots }()
+
+		err := m.do(backend, orig, body)
+		if err != nil {
+			atomic.AddUint64(&m.failed, 1)
+			log.Debugf("mirror: %s", err)
+			return
+		}
+		atomic.AddUint64(&m.sent, 1)
+	}()
+}
+
+func (m *Mirror) do(backend *url.URL, orig *http.Request, body []byte) error {
+	ctx := context.Background()
+	if m.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.Timeout)
+		defer cancel()
+	}
+
+	// join the escaped paths, so that encoded reserved characters such as
+	// %2F are kept
+	u := *backend
+	u.RawPath = strings.TrimSuffix(backend.EscapedPath(), "/") + orig.URL.EscapedPath()
+	u.Path = strings.TrimSuffix(u.Path, "/") + orig.URL.Path
+	u.RawQuery = orig.URL.RawQuery
+
+	req, err := http.NewRequestWithContext(ctx, orig.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	for k, vs := range orig.Header {
+		if hopByHop[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	req.Host = orig.Host
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(ioutil.Discard, res.Body)
+	return err
+}
+
+var hopByHop = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+}
@@ -0,0 +1,134 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+type received struct {
+	method, uri, host, header, body string
+}
+
+func recorder(t *testing.T) (*httptest.Server, chan received) {
+	reqs := make(chan received, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		reqs <- received{r.Method, r.RequestURI, r.Host, r.Header.Get("X-Test"), string(body)}
+	}))
+	return s, reqs
+}
+
+func message(t *testing.T, path string) *spoe.MessageIterator {
+	headers, err := spoe.EncodeHeaders(http.Header{
+		"Host":       []string{"www.example.com"},
+		"X-Test":     []string{"1"},
+		"Connection": []string{"close"},
+	})
+	require.NoError(t, err)
+
+	return spoetest.Single("mirror", map[string]interface{}{
+		"method":       "POST",
+		"path":         path,
+		"query":        "a=b",
+		"req.hdrs_bin": headers,
+		"req.body":     []byte("payload"),
+	})
+}
+
+func TestMirror(t *testing.T) {
+	s1, reqs1 := recorder(t)
+	defer s1.Close()
+	s2, reqs2 := recorder(t)
+	defer s2.Close()
+
+	cfg := DefaultConfig
+	cfg.Backends = []string{s1.URL, s2.URL + "/shadow/"}
+	m, err := New(cfg)
+	require.NoError(t, err)
+
+	actions, err := m.Handle(message(t, "/foo"))
+	require.NoError(t, err)
+	require.Empty(t, actions)
+	require.Equal(t, received{"POST", "/foo?a=b", "www.example.com", "1", "payload"}, <-reqs1)
+	require.Equal(t, received{"POST", "/shadow/foo?a=b", "www.example.com", "1", "payload"}, <-reqs2)
+
+	// encoded paths are mirrored as is
+	_, err = m.Handle(message(t, "/files/a%2Fb%20c"))
+	require.NoError(t, err)
+
+	require.NoError(t, m.Close())
+	require.Equal(t, received{"POST", "/files/a%2Fb%20c?a=b", "www.example.com", "1", "payload"}, <-reqs1)
+	require.Equal(t, received{"POST", "/shadow/files/a%2Fb%20c?a=b", "www.example.com", "1", "payload"}, <-reqs2)
+	require.Equal(t, Stats{Sent: 4}, m.Stats())
+
+	// closed mirrors send nothing
+	_, err = m.Handle(message(t, "/foo"))
+	require.NoError(t, err)
+	require.Equal(t, Stats{Sent: 4}, m.Stats())
+}
+
+func TestMirrorSampling(t *testing.T) {
+	s, reqs := recorder(t)
+	defer s.Close()
+
+	cfg := DefaultConfig
+	cfg.Backends = []string{s.URL}
+	cfg.SampleRate = 0.5
+	m, err := New(cfg)
+	require.NoError(t, err)
+
+	for _, sample := range []float64{0.2, 0.7, 0.49} {
+		sample := sample
+		m.sample = func() float64 { return sample }
+		_, err := m.Handle(message(t, "/foo"))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, m.Close())
+	require.Len(t, reqs, 2)
+}
+
+func TestMirrorLimits(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+
+	cfg := DefaultConfig
+	cfg.Backends = []string{s.URL}
+	cfg.MaxInFlight = 1
+	cfg.Timeout = 50 * time.Millisecond
+	m, err := New(cfg)
+	require.NoError(t, err)
+
+	// the handler never waits for the backend
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := m.Handle(message(t, "/foo"))
+		require.NoError(t, err)
+	}
+	require.True(t, time.Since(start) < cfg.Timeout)
+
+	require.NoError(t, m.Close())
+	require.Equal(t, Stats{Failed: 1, Dropped: 2}, m.Stats())
+}
+
+func TestNew(t *testing.T) {
+	cfg := DefaultConfig
+	_, err := New(cfg)
+	require.Error(t, err)
+
+	cfg.Backends = []string{"shadow:8080"}
+	_, err = New(cfg)
+	require.Error(t, err)
+}
@@ -0,0 +1,214 @@
+package spoe
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/criteo/haproxy-spoe-go/spoeconf"
+)
+
+// MessageHandler handles a single message.
+type MessageHandler func(msg Message) ([]Action, error)
+
+type declaredVar struct {
+	message string
+	scope   VarScope
+	name    string
+}
+
+// Mux dispatches messages to handlers by name. It knows the messages and
+// variables of the agent, so they can be checked against the HAProxy
+// configuration before serving.
+type Mux struct {
+	// VarPrefix, when set, is the prefix HAProxy is expected to give the
+	// variables of the agent, as used in its configuration.
+	VarPrefix string
+
+	handlers map[string]MessageHandler
+	names    []string
+	vars     []declaredVar
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		handlers: make(map[string]MessageHandler),
+	}
+}
+
+// HandleMessage registers the handler of the message name. It panics if
+// the message already has a handler.
+func (m *Mux) HandleMessage(name string, h MessageHandler) {
+	if _, ok := m.handlers[name]; ok {
+		panic(fmt.Sprintf("spoe: message %s already has a handler", name))
+	}
+	m.handlers[name] = h
+	m.names = append(m.names, name)
+}
+
+// Messages returns the names of the handled messages, in registration
+// order.
+func (m *Mux) Messages() []string {
+	return append([]string(nil), m.names...)
+}
+
+// DeclareVar declares a variable set by the handler of message. name does
+// not include the scope nor the prefix HAProxy adds.
+func (m *Mux) DeclareVar(message string, scope VarScope, name string) {
+	m.vars = append(m.vars, declaredVar{message: message, scope: scope, name: name})
+}
+
+// Handle runs the handlers of the messages of a frame and returns all their
+// actions. Messages without handler are ignored.
+func (m *Mux) Handle(msgs *MessageIterator) ([]Action, error) {
+	var actions []Action
+	for msgs.Next() {
+		h, ok := m.handlers[msgs.Message.Name]
+		if !ok {
+			continue
+		}
+
+		res, err := h(msgs.Message)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, res...)
+	}
+
+	return actions, msgs.Error()
+}
+
+// ConfigError lists the differences between an agent and its HAProxy
+// configuration.
+type ConfigError struct {
+	Agent    string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("spoe: agent %s does not match its configuration: %s", e.Agent, strings.Join(e.Problems, "; "))
+}
+
+// CheckConfigFile parses an HAProxy SPOE configuration file and checks it
+// with CheckConfig.
+func (m *Mux) CheckConfigFile(path, agent string) error {
+	cfg, err := spoeconf.ParseFile(path)
+	if err != nil {
+		return err
+	}
+	return m.CheckConfig(cfg, agent)
+}
+
+// CheckConfig checks the mux against the spoe-agent section named agent,
+// which may be empty when the configuration has a single agent. It returns
+// a *ConfigError reporting:
+//
+//   - messages sent by HAProxy without handler, and handlers of messages
+//     HAProxy never sends
+//   - variables declared for messages HAProxy never sends, or with invalid
+//     names
+//   - a prefix different from VarPrefix, or variable names including it
+//   - variables missing from register-var-names, when the agent registers
+//     names without option force-set-var
+//   - variables colliding with the ones HAProxy sets on errors and for
+//     processing times
+//   - variables in a scope which does not exist at the event of their
+//     message: only proc and sess on client sessions, no res on requests
+//     and no req on responses
+func (m *Mux) CheckConfig(cfg *spoeconf.Config, agent string) error {
+	a, err := findAgent(cfg, agent)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := cfg.AgentMessages(a)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	sent := make(map[string]*spoeconf.Message)
+	for _, msg := range msgs {
+		sent[msg.Name] = msg
+		if _, ok := m.handlers[msg.Name]; !ok {
+			report("message %s has no handler", msg.Name)
+		}
+	}
+	for _, name := range m.names {
+		if _, ok := sent[name]; !ok {
+			report("message %s is never sent", name)
+		}
+	}
+
+	prefix := a.Prefix()
+	if m.VarPrefix != "" && m.VarPrefix != prefix {
+		report("variables are prefixed with %s, not %s", prefix, m.VarPrefix)
+	}
+
+	registered := make(map[string]bool)
+	for _, name := range a.RegisterVarNames {
+		registered[name] = true
+	}
+
+	for _, v := range m.vars {
+		full := fullVarName(v.scope, prefix, v.name)
+
+		msg, ok := sent[v.message]
+		if !ok {
+			report("variable %s is declared for message %s, which is never sent", full, v.message)
+			continue
+		}
+
+		if !validVarName(v.name) {
+			report("variable %s has an invalid name", full)
+		}
+		if strings.HasPrefix(v.name, prefix+".") {
+			report("variable %s includes the prefix %s HAProxy adds", full, prefix)
+		}
+		if len(registered) > 0 && !a.ForceSetVar && !registered[v.name] {
+			report("variable %s is not in register-var-names", full)
+		}
+		if v.scope == VarScopeTransaction && (v.name == a.SetOnError || v.name == a.SetProcessTime) {
+			report("variable %s is also set by HAProxy", full)
+		}
+		if !scopeAvailable(v.scope, msg.Event) {
+			report("variable %s cannot be set on %s events of message %s", full, msg.Event, msg.Name)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Agent: a.Name, Problems: problems}
+	}
+	return nil
+}
+
+func findAgent(cfg *spoeconf.Config, name string) (*spoeconf.Agent, error) {
+	if name == "" {
+		if len(cfg.Agents) != 1 {
+			return nil, fmt.Errorf("spoe: configuration has %d agents, one must be chosen", len(cfg.Agents))
+		}
+		return cfg.Agents[0], nil
+	}
+
+	for _, a := range cfg.Agents {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("spoe: configuration has no agent %s", name)
+}
+
+func scopeAvailable(scope VarScope, event string) bool {
+	switch event {
+	case "on-client-session":
+		return scope == VarScopeProcess || scope == VarScopeSession
+	case "on-frontend-tcp-request", "on-backend-tcp-request", "on-frontend-http-request", "on-backend-http-request", "on-server-session":
+		return scope != VarScopeResponse
+	case "on-tcp-response", "on-http-response":
+		return scope != VarScopeRequest
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package spoe
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/criteo/haproxy-spoe-go/spoeconf"
+	"github.com/stretchr/testify/require"
+)
+
+func muxTestIterator(t *testing.T, names ...string) *MessageIterator {
+	b := make([]byte, 256)
+	m := 0
+	for _, name := range names {
+		n, err := encodeString(b[m:], name)
+		require.NoError(t, err)
+		m += n
+		b[m] = 1
+		m++
+		n, err = encodeKV(b[m:], "arg", name)
+		require.NoError(t, err)
+		m += n
+	}
+	return NewMessageIterator(b[:m])
+}
+
+func TestMux(t *testing.T) {
+	mux := NewMux()
+	handler := func(msg Message) ([]Action, error) {
+		args := msg.Args.Map()
+		return []Action{ActionSetVar{Name: msg.Name, Scope: VarScopeTransaction, Value: args["arg"]}}, nil
+	}
+	mux.HandleMessage("a", handler)
+	mux.HandleMessage("b", handler)
+	mux.HandleMessage("fail", func(msg Message) ([]Action, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	require.Equal(t, []string{"a", "b", "fail"}, mux.Messages())
+	require.Panics(t, func() { mux.HandleMessage("a", handler) })
+
+	actions, err := mux.Handle(muxTestIterator(t, "a", "other", "b"))
+	require.NoError(t, err)
+	require.Equal(t, []Action{
+		ActionSetVar{Name: "a", Scope: VarScopeTransaction, Value: "a"},
+		ActionSetVar{Name: "b", Scope: VarScopeTransaction, Value: "b"},
+	}, actions)
+
+	_, err = mux.Handle(muxTestIterator(t, "a", "fail"))
+	require.EqualError(t, err, "failed")
+}
+
+const muxTestConfig = `
+[iprep]
+spoe-agent iprep-agent
+    messages check-client-ip check-request
+    groups on-response
+    option var-prefix iprep
+    option set-on-error error
+    register-var-names score tags error
+
+spoe-message check-client-ip
+    args ip=src
+    event on-client-session
+
+spoe-message check-request
+    args path
+    event on-frontend-http-request
+
+spoe-message check-response
+    args status
+    event on-http-response
+
+spoe-message unused
+    args src
+
+spoe-group on-response
+    messages check-response
+
+spoe-agent other
+    messages unused
+`
+
+func TestMuxCheckConfig(t *testing.T) {
+	cfg, err := spoeconf.Parse(strings.NewReader(muxTestConfig))
+	require.NoError(t, err)
+
+	handler := func(msg Message) ([]Action, error) { return nil, nil }
+
+	mux := NewMux()
+	mux.VarPrefix = "iprep"
+	mux.HandleMessage("check-client-ip", handler)
+	mux.HandleMessage("check-request", handler)
+	mux.HandleMessage("check-response", handler)
+	mux.DeclareVar("check-client-ip", VarScopeSession, "score")
+	mux.DeclareVar("check-request", VarScopeTransaction, "tags")
+	mux.DeclareVar("check-response", VarScopeResponse, "score")
+	require.NoError(t, mux.CheckConfig(cfg, "iprep-agent"))
+
+	mux = NewMux()
+	mux.VarPrefix = "rep"
+	mux.HandleMessage("check-client-ip", handler)
+	mux.HandleMessage("check-response", handler)
+	mux.HandleMessage("check-body", handler)
+	mux.DeclareVar("check-client-ip", VarScopeTransaction, "score")
+	mux.DeclareVar("check-client-ip", VarScopeSession, "bad-name")
+	mux.DeclareVar("check-response", VarScopeRequest, "iprep.score")
+	mux.DeclareVar("check-response", VarScopeTransaction, "error")
+	mux.DeclareVar("check-body", VarScopeTransaction, "size")
+
+	err = mux.CheckConfig(cfg, "iprep-agent")
+	require.Equal(t, &ConfigError{
+		Agent: "iprep-agent",
+		Problems: []string{
+			"message check-request has no handler",
+			"message check-body is never sent",
+			"variables are prefixed with iprep, not rep",
+			"variable txn.iprep.score cannot be set on on-client-session events of message check-client-ip",
+			"variable sess.iprep.bad-name has an invalid name",
+			"variable sess.iprep.bad-name is not in register-var-names",
+			"variable req.iprep.iprep.score includes the prefix iprep HAProxy adds",
+			"variable req.iprep.iprep.score is not in register-var-names",
+			"variable req.iprep.iprep.score cannot be set on on-http-response events of message check-response",
+			"variable txn.iprep.error is also set by HAProxy",
+			"variable txn.iprep.size is declared for message check-body, which is never sent",
+		},
+	}, err)
+	require.Contains(t, err.Error(), "spoe: agent iprep-agent does not match its configuration: message check-request has no handler; ")
+
+	require.EqualError(t, mux.CheckConfig(cfg, ""), "spoe: configuration has 2 agents, one must be chosen")
+	require.EqualError(t, mux.CheckConfig(cfg, "missing"), "spoe: configuration has no agent missing")
+}
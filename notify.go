@@ -52,8 +52,9 @@ type Message struct {
 }
 
 type MessageIterator struct {
-	b   []byte
-	err error
+	b      []byte
+	err    error
+	engine *Engine
 
 	Message Message
 }
@@ -69,6 +70,20 @@ func NewMessageIterator(b []byte) *MessageIterator {
 	}
 }
 
+// clone returns a new iterator over the same messages. It must be called
+// before the first call to Next.
+func (i *MessageIterator) clone() *MessageIterator {
+	res := NewMessageIterator(i.b)
+	res.engine = i.engine
+	return res
+}
+
+// Engine returns the HAProxy engine the messages were received from, or nil
+// when the iterator was not created by an agent.
+func (i *MessageIterator) Engine() *Engine {
+	return i.engine
+}
+
 func (i *MessageIterator) Error() error {
 	return i.err
 }
@@ -97,6 +112,10 @@ func (i *MessageIterator) Next() bool {
 	}
 	i.b = i.b[n:]
 
+	if len(i.b) == 0 {
+		i.err = errors.New("decode message: unterminated sequence")
+		return false
+	}
 	argCount := int(i.b[0])
 	i.b = i.b[1:]
 
@@ -108,13 +127,34 @@ func (i *MessageIterator) Next() bool {
 }
 
 func (c *conn) handleNotify(f Frame, acks chan Frame) error {
+	if c.asyncHandler != nil {
+		return c.handleNotifyAsync(f, acks)
+	}
+
 	messages := NewMessageIterator(f.data)
+	messages.engine = c.engine
 
 	actions, err := c.handler(messages)
 	if err != nil {
+		var disconnect *DisconnectError
+		if errors.As(err, &disconnect) {
+			c.requestDisconnect(disconnect)
+			return nil
+		}
 		return errors.Wrap(err, "handle notify") // TODO return proper response
 	}
 
+	err = encodeAck(&f, actions)
+	if err != nil {
+		return errors.Wrap(err, "handle notify")
+	}
+
+	acks <- f
+
+	return nil
+}
+
+func encodeAck(f *Frame, actions []Action) error {
 	f.ftype = frameTypeAgentACK
 	f.flags = frameFlagFin
 	f.data = f.originalData
@@ -124,14 +164,12 @@ func (c *conn) handleNotify(f Frame, acks chan Frame) error {
 	for _, a := range actions {
 		n, err := a.encode(f.data[off:])
 		if err != nil {
-			return errors.Wrap(err, "handle notify")
+			return err
 		}
 		off += n
 	}
 
 	f.data = f.data[:off]
 
-	acks <- f
-
 	return nil
 }
@@ -0,0 +1,57 @@
+package spoe
+
+import "net"
+
+// Observer receives the lifecycle events of an agent. Its methods are called
+// synchronously from the connection goroutines and must not block.
+type Observer interface {
+	// OnConnect is called when HAProxy opens a connection.
+	OnConnect(c net.Conn)
+	// OnHello is called once the hello of a connection has been accepted.
+	OnHello(c net.Conn, hello Hello)
+	// OnEngineStart is called when the first connection of an engine is
+	// registered.
+	OnEngineStart(key EngKey)
+	// OnEngineStop is called when the last connection of an engine closes.
+	OnEngineStop(key EngKey)
+	// OnNotify is called for every notify frame received.
+	OnNotify(f FrameInfo)
+	// OnAck is called for every ack frame sent.
+	OnAck(f FrameInfo)
+	// OnDisconnect is called when a connection closes, with the error that
+	// ended it, if any.
+	OnDisconnect(c net.Conn, err error)
+}
+
+type Hello struct {
+	EngineID     string
+	FrameSize    int
+	Capabilities map[string]bool
+	Healthcheck  bool
+}
+
+type FrameInfo struct {
+	EngineID string
+	StreamID int
+	FrameID  int
+	Size     int
+}
+
+// NopObserver ignores all events. It can be embedded to implement only part
+// of Observer.
+type NopObserver struct{}
+
+func (NopObserver) OnConnect(net.Conn)           {}
+func (NopObserver) OnHello(net.Conn, Hello)      {}
+func (NopObserver) OnEngineStart(EngKey)         {}
+func (NopObserver) OnEngineStop(EngKey)          {}
+func (NopObserver) OnNotify(FrameInfo)           {}
+func (NopObserver) OnAck(FrameInfo)              {}
+func (NopObserver) OnDisconnect(net.Conn, error) {}
+
+func (cfg Config) observer() Observer {
+	if cfg.Observer == nil {
+		return NopObserver{}
+	}
+	return cfg.Observer
+}
@@ -0,0 +1,169 @@
+package spoe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingObserver struct {
+	NopObserver
+
+	lock   sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(e string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.events = append(o.events, e)
+}
+
+func (o *recordingObserver) Events() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]string(nil), o.events...)
+}
+
+func (o *recordingObserver) OnConnect(net.Conn)          { o.record("connect") }
+func (o *recordingObserver) OnHello(_ net.Conn, h Hello) { o.record("hello " + h.EngineID) }
+func (o *recordingObserver) OnEngineStart(k EngKey)      { o.record("start " + k.Engine) }
+func (o *recordingObserver) OnEngineStop(k EngKey)       { o.record("stop " + k.Engine) }
+func (o *recordingObserver) OnNotify(FrameInfo)          { o.record("notify") }
+func (o *recordingObserver) OnAck(f FrameInfo)           { o.record("ack " + f.EngineID) }
+func (o *recordingObserver) OnDisconnect(net.Conn, error) {
+	o.record("disconnect")
+}
+
+func TestObserver(t *testing.T) {
+	obs := &recordingObserver{}
+	cfg := defaultConfig
+	cfg.Observer = obs
+
+	spoa := NewWithConfig(func(msgs *MessageIterator) ([]Action, error) {
+		return nil, nil
+	}, cfg)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	go spoa.Serve(lis)
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+
+	cod := newCodec(client, defaultConfig)
+
+	require.NoError(t, cod.encodeFrame(helloFrame(t)))
+	res := Frame{}
+	ok, err := cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	require.NoError(t, cod.encodeFrame(notifyFrame(t)))
+	ok, err = cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	// the ack is observed once written, wait for it before closing
+	require.Eventually(t, func() bool {
+		return len(obs.Events()) == 5
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, client.Close())
+
+	engine := "0082BA75-E79D-4766-86D3-1AE84AB4A366"
+	expected := []string{
+		"connect",
+		"hello " + engine,
+		"start " + engine,
+		"notify",
+		"ack " + engine,
+		"stop " + engine,
+		"disconnect",
+	}
+	require.Eventually(t, func() bool {
+		return len(obs.Events()) == len(expected)
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, expected, obs.Events())
+}
+
+func TestObserverRefused(t *testing.T) {
+	obs := &recordingObserver{}
+	cfg := defaultConfig
+	cfg.Observer = obs
+	cfg.RefuseWhenUnhealthy = true
+	cfg.HealthCheck = func(ctx context.Context) error {
+		return errors.New("database is down")
+	}
+
+	spoa := NewWithConfig(func(msgs *MessageIterator) ([]Action, error) {
+		return nil, nil
+	}, cfg)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	go spoa.Serve(lis)
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	cod := newCodec(client, defaultConfig)
+	require.NoError(t, cod.encodeFrame(helloFrame(t)))
+	res := Frame{}
+	ok, err := cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, frameTypeAgentDiscon, res.ftype)
+
+	// refused connections have no hello
+	require.Eventually(t, func() bool {
+		return len(obs.Events()) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"connect", "disconnect"}, obs.Events())
+}
+
+func TestObserverHealthcheck(t *testing.T) {
+	obs := &recordingObserver{}
+	cfg := defaultConfig
+	cfg.Observer = obs
+	cfg.HealthCheck = func(ctx context.Context) error {
+		return nil
+	}
+
+	spoa := NewWithConfig(func(msgs *MessageIterator) ([]Action, error) {
+		return nil, nil
+	}, cfg)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	go spoa.Serve(lis)
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	cod := newCodec(client, defaultConfig)
+	require.NoError(t, cod.encodeFrame(healthcheckHelloFrame(t)))
+	res := Frame{}
+	ok, err := cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, frameTypeAgentHello, res.ftype)
+
+	// healthchecks register no engine
+	require.Eventually(t, func() bool {
+		return len(obs.Events()) == 3
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"connect", "hello ", "disconnect"}, obs.Events())
+}
@@ -0,0 +1,179 @@
+// Package policy implements an SPOE handler evaluating declarative
+// authorization policies.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+	"github.com/criteo/haproxy-spoe-go/jwtauth"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// File holds the policies, as YAML or JSON. The first policy matching
+	// the request decides, the default effect applies when none does:
+	//
+	//	default: deny
+	//	policies:
+	//	  - id: block-scanners
+	//	    effect: deny
+	//	    match:
+	//	      headers: {user-agent: "(?i)sqlmap|nikto"}
+	//	  - id: admins-office-hours
+	//	    effect: allow
+	//	    match:
+	//	      paths: ["^/admin/"]
+	//	      claims: {role: admin}
+	//	      time: {days: [mon, tue, wed, thu, fri], from: "08:00", to: "19:00", location: Europe/Paris}
+	//	  - id: internal
+	//	    effect: allow
+	//	    match:
+	//	      ips: ["10.0.0.0/8"]
+	File string
+
+	// Message names the message to handle and Args the args carrying the
+	// request. Only Method, Path, Headers and ClientIP are used.
+	Message string
+	Args    spoe.RequestArgNames
+
+	// JWT validates the tokens whose claims are matched by policies. It
+	// reads the token from the message args following its own
+	// configuration. Policies with claim conditions never match without
+	// it.
+	JWT *jwtauth.Validator
+
+	// DryRun logs the decisions but always allows.
+	DryRun bool
+
+	// DecisionVar and PolicyVar name the transaction variables set by the
+	// handler.
+	DecisionVar string
+	PolicyVar   string
+
+	// ReloadInterval is how often the file is checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	Message:        "authz",
+	Args:           spoe.DefaultRequestArgNames,
+	DecisionVar:    "policy_decision",
+	PolicyVar:      "policy_id",
+	ReloadInterval: 10 * time.Second,
+}
+
+// Engine evaluates policies.
+type Engine struct {
+	cfg      Config
+	policies atomic.Value
+	watcher  *reload.Watcher
+
+	now func() time.Time
+}
+
+// New loads the policies of cfg and starts watching the file.
+func New(cfg Config) (*Engine, error) {
+	e := &Engine{
+		cfg: cfg,
+		now: time.Now,
+	}
+
+	err := e.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	e.watcher = reload.Watch([]string{cfg.File}, cfg.ReloadInterval, e.Reload)
+	return e, nil
+}
+
+func (e *Engine) Close() error {
+	return e.watcher.Close()
+}
+
+// Reload loads the policies again.
+func (e *Engine) Reload() error {
+	set, err := load(e.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	e.policies.Store(set)
+	return nil
+}
+
+// Evaluate returns the effect for the request carried by args, as returned
+// by ArgIterator.Map, and the ID of the policy which decided it, empty when
+// the default effect applies. Dry-run mode is not applied.
+func (e *Engine) Evaluate(args map[string]interface{}) (string, string, error) {
+	set := e.policies.Load().(*policySet)
+
+	r := &request{
+		method: argString(args[e.cfg.Args.Method]),
+		path:   argString(args[e.cfg.Args.Path]),
+		args:   args,
+		now:    e.now(),
+	}
+	r.ip, _ = args[e.cfg.Args.ClientIP].(net.IP)
+
+	b, _ := args[e.cfg.Args.Headers].([]byte)
+	var err error
+	r.headers, err = spoe.DecodeHeaders(b)
+	if err != nil {
+		return "", "", fmt.Errorf("policy: %s", err)
+	}
+
+	if set.claims && e.cfg.JWT != nil {
+		claims, err := e.cfg.JWT.ValidateArgs(args)
+		var argErr *jwtauth.ArgError
+		switch {
+		case err == nil:
+			r.claims = claims
+		case errors.As(err, &argErr):
+			return "", "", err
+		default:
+			log.Debugf("policy: ignoring token: %s", err)
+		}
+	}
+
+	for _, p := range set.policies {
+		if p.match(r) {
+			return p.Effect, p.ID, nil
+		}
+	}
+	return set.def, "", nil
+}
+
+func (e *Engine) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != e.cfg.Message {
+			continue
+		}
+
+		effect, id, err := e.Evaluate(msgs.Message.Args.Map())
+		if err != nil {
+			return nil, err
+		}
+
+		if e.cfg.DryRun {
+			log.Infof("policy: dry-run: %s (policy %q)", effect, id)
+			effect = EffectAllow
+		}
+
+		actions := []spoe.Action{
+			spoe.ActionSetVar{Name: e.cfg.DecisionVar, Scope: spoe.VarScopeTransaction, Value: effect},
+		}
+		if id != "" {
+			actions = append(actions, spoe.ActionSetVar{Name: e.cfg.PolicyVar, Scope: spoe.VarScopeTransaction, Value: id})
+		}
+		return actions, nil
+	}
+
+	return nil, msgs.Error()
+}
@@ -0,0 +1,129 @@
+package policy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/criteo/haproxy-spoe-go/jwtauth"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicies = `
+default: deny
+policies:
+  - id: scanners
+    effect: deny
+    match:
+      headers: {user-agent: "(?i)sqlmap"}
+  - id: admins
+    effect: allow
+    match:
+      paths: ["^/admin/"]
+      claims: {role: admin}
+  - id: public
+    effect: allow
+    match:
+      methods: [GET]
+      paths: ["^/public/"]
+`
+
+func testToken(secret []byte, claims string) string {
+	b64 := base64.RawURLEncoding
+	input := b64.EncodeToString([]byte(`{"alg":"HS256"}`)) + "." + b64.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return input + "." + b64.EncodeToString(mac.Sum(nil))
+}
+
+func TestEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := []byte("0123456789abcdef")
+	jwks := filepath.Join(dir, "jwks.json")
+	require.NoError(t, ioutil.WriteFile(jwks, []byte(`{"keys": [{"kty": "oct", "k": "`+base64.RawURLEncoding.EncodeToString(secret)+`"}]}`), 0644))
+	jwtCfg := jwtauth.DefaultConfig
+	jwtCfg.JWKSFile = jwks
+	validator, err := jwtauth.New(jwtCfg)
+	require.NoError(t, err)
+	defer validator.Close()
+
+	path := filepath.Join(dir, "policies.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testPolicies), 0644))
+
+	cfg := DefaultConfig
+	cfg.File = path
+	cfg.JWT = validator
+	cfg.ReloadInterval = 5 * time.Millisecond
+	e, err := New(cfg)
+	require.NoError(t, err)
+	defer e.Close()
+
+	handle := func(method, path string, header http.Header) map[string]interface{} {
+		headers, err := spoe.EncodeHeaders(header)
+		require.NoError(t, err)
+
+		actions, err := e.Handle(spoetest.Single("authz", map[string]interface{}{
+			"method":       method,
+			"path":         path,
+			"src":          net.ParseIP("192.0.2.1"),
+			"req.hdrs_bin": headers,
+		}))
+		require.NoError(t, err)
+		return spoetest.Vars(actions)
+	}
+	bearer := func(claims string) http.Header {
+		return http.Header{"Authorization": []string{"Bearer " + testToken(secret, claims)}}
+	}
+
+	require.Equal(t, map[string]interface{}{"policy_decision": "allow", "policy_id": "public"}, handle("GET", "/public/a", nil))
+	require.Equal(t, map[string]interface{}{"policy_decision": "deny"}, handle("POST", "/public/a", nil))
+	require.Equal(t, map[string]interface{}{"policy_decision": "deny", "policy_id": "scanners"},
+		handle("GET", "/public/a", http.Header{"User-Agent": []string{"sqlmap/1.5"}}))
+
+	require.Equal(t, map[string]interface{}{"policy_decision": "allow", "policy_id": "admins"},
+		handle("GET", "/admin/x", bearer(`{"role": "admin", "exp": 4102444800}`)))
+	require.Equal(t, map[string]interface{}{"policy_decision": "deny"}, handle("GET", "/admin/x", bearer(`{"role": "user", "exp": 4102444800}`)))
+	require.Equal(t, map[string]interface{}{"policy_decision": "deny"}, handle("GET", "/admin/x", nil))
+
+	// tokens with invalid signatures are ignored
+	forged := http.Header{"Authorization": []string{"Bearer " + testToken([]byte("other"), `{"role": "admin", "exp": 4102444800}`)}}
+	require.Equal(t, map[string]interface{}{"policy_decision": "deny"}, handle("GET", "/admin/x", forged))
+
+	// unexpected arg types are errors, not invalid tokens
+	_, _, err = e.Evaluate(map[string]interface{}{"method": "GET", "path": "/admin/x", "token": 42})
+	var argErr *jwtauth.ArgError
+	require.True(t, errors.As(err, &argErr))
+
+	// dry-run mode reports the matched policy but allows
+	e.cfg.DryRun = true
+	require.Equal(t, map[string]interface{}{"policy_decision": "allow", "policy_id": "scanners"},
+		handle("GET", "/public/a", http.Header{"User-Agent": []string{"sqlmap/1.5"}}))
+	require.Equal(t, map[string]interface{}{"policy_decision": "allow"}, handle("POST", "/", nil))
+	e.cfg.DryRun = false
+
+	// invalid files are not loaded
+	require.NoError(t, ioutil.WriteFile(path, []byte("default: maybe\n"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, "public", handle("GET", "/public/a", nil)["policy_id"])
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("default: allow\n"), 0644))
+	require.Eventually(t, func() bool {
+		return handle("POST", "/", nil)["policy_decision"] == "allow"
+	}, time.Second, 5*time.Millisecond)
+
+	_, err = e.Handle(spoetest.Single("authz", map[string]interface{}{"req.hdrs_bin": []byte{5}}))
+	require.Error(t, err)
+}
@@ -0,0 +1,378 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Policy applies its effect to the requests matching all its conditions.
+type Policy struct {
+	ID     string `json:"id" yaml:"id"`
+	Effect string `json:"effect" yaml:"effect"`
+	Match  Match  `json:"match" yaml:"match"`
+}
+
+// Match lists the conditions of a policy. Empty conditions always match.
+// Lists match when any of their values does, maps when all their entries do.
+type Match struct {
+	// Methods are HTTP methods.
+	Methods []string `json:"methods" yaml:"methods"`
+	// Paths are regular expressions.
+	Paths []string `json:"paths" yaml:"paths"`
+	// IPs are CIDRs or single addresses.
+	IPs []string `json:"ips" yaml:"ips"`
+	// Headers and Args map names to regular expressions. Missing headers
+	// and args match as empty strings.
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	Args    map[string]string `json:"args" yaml:"args"`
+	// Claims map JWT claims to their expected values. Array claims match
+	// when they contain the value. Requests without a valid token do not
+	// match.
+	Claims map[string]string `json:"claims" yaml:"claims"`
+	// Time restricts the policy to a time window.
+	Time *TimeWindow `json:"time" yaml:"time"`
+}
+
+// TimeWindow matches the days and the time of day, in Location, from From
+// included to To excluded. When To is before From, the window ends the next
+// day.
+type TimeWindow struct {
+	// Days are lower-case English three letter day names.
+	Days []string `json:"days" yaml:"days"`
+	// From and To are 24-hour times such as "08:30".
+	From     string `json:"from" yaml:"from"`
+	To       string `json:"to" yaml:"to"`
+	Location string `json:"location" yaml:"location"`
+}
+
+type document struct {
+	Default  string   `json:"default" yaml:"default"`
+	Policies []Policy `json:"policies" yaml:"policies"`
+}
+
+var days = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// request is what the conditions are checked against.
+type request struct {
+	method  string
+	path    string
+	ip      net.IP
+	headers http.Header
+	args    map[string]interface{}
+	claims  map[string]interface{}
+	now     time.Time
+}
+
+type condition func(r *request) bool
+
+type compiledPolicy struct {
+	Policy
+	conditions []condition
+}
+
+func (p compiledPolicy) match(r *request) bool {
+	for _, c := range p.conditions {
+		if !c(r) {
+			return false
+		}
+	}
+	return true
+}
+
+type policySet struct {
+	def      string
+	policies []compiledPolicy
+	claims   bool
+}
+
+// load reads policies from a YAML or JSON file, depending on its extension,
+// and compiles them.
+func load(path string) (*policySet, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %s", err)
+	}
+
+	var doc document
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(b, &doc)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	default:
+		return nil, fmt.Errorf("policy: unsupported policy file %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("policy: %s: %s", path, err)
+	}
+
+	set, err := compile(doc)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %s: %s", path, err)
+	}
+	return set, nil
+}
+
+func compile(doc document) (*policySet, error) {
+	set := &policySet{def: doc.Default}
+	if set.def == "" {
+		set.def = EffectDeny
+	}
+	if set.def != EffectAllow && set.def != EffectDeny {
+		return nil, fmt.Errorf("unknown default effect %q", set.def)
+	}
+
+	ids := make(map[string]bool)
+	for _, p := range doc.Policies {
+		if p.ID == "" {
+			return nil, fmt.Errorf("policy without id")
+		}
+		if ids[p.ID] {
+			return nil, fmt.Errorf("duplicate policy %s", p.ID)
+		}
+		ids[p.ID] = true
+		if p.Effect != EffectAllow && p.Effect != EffectDeny {
+			return nil, fmt.Errorf("policy %s: unknown effect %q", p.ID, p.Effect)
+		}
+
+		conditions, err := compileMatch(p.Match)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %s", p.ID, err)
+		}
+		set.policies = append(set.policies, compiledPolicy{Policy: p, conditions: conditions})
+		if len(p.Match.Claims) > 0 {
+			set.claims = true
+		}
+	}
+
+	return set, nil
+}
+
+func compileMatch(m Match) ([]condition, error) {
+	var conditions []condition
+
+	if len(m.Methods) > 0 {
+		methods := make(map[string]bool)
+		for _, method := range m.Methods {
+			methods[strings.ToUpper(method)] = true
+		}
+		conditions = append(conditions, func(r *request) bool {
+			return methods[r.method]
+		})
+	}
+
+	if len(m.Paths) > 0 {
+		var res []*regexp.Regexp
+		for _, p := range m.Paths {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("path: %s", err)
+			}
+			res = append(res, re)
+		}
+		conditions = append(conditions, func(r *request) bool {
+			for _, re := range res {
+				if re.MatchString(r.path) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	if len(m.IPs) > 0 {
+		var nets []*net.IPNet
+		for _, s := range m.IPs {
+			n, err := parseNet(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+		}
+		conditions = append(conditions, func(r *request) bool {
+			for _, n := range nets {
+				if r.ip != nil && n.Contains(r.ip) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	for name, expr := range m.Headers {
+		name := name
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %s", name, err)
+		}
+		conditions = append(conditions, func(r *request) bool {
+			return re.MatchString(r.headers.Get(name))
+		})
+	}
+
+	for name, expr := range m.Args {
+		name := name
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("arg %s: %s", name, err)
+		}
+		conditions = append(conditions, func(r *request) bool {
+			return re.MatchString(argString(r.args[name]))
+		})
+	}
+
+	for name, expected := range m.Claims {
+		name, expected := name, expected
+		conditions = append(conditions, func(r *request) bool {
+			return claimMatches(r.claims[name], expected)
+		})
+	}
+
+	if m.Time != nil {
+		c, err := compileTimeWindow(*m.Time)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+
+	return conditions, nil
+}
+
+func compileTimeWindow(w TimeWindow) (condition, error) {
+	loc := time.UTC
+	if w.Location != "" {
+		var err error
+		loc, err = time.LoadLocation(w.Location)
+		if err != nil {
+			return nil, fmt.Errorf("time: %s", err)
+		}
+	}
+
+	var weekdays map[time.Weekday]bool
+	if len(w.Days) > 0 {
+		weekdays = make(map[time.Weekday]bool)
+		for _, d := range w.Days {
+			wd, ok := days[d]
+			if !ok {
+				return nil, fmt.Errorf("time: unknown day %q", d)
+			}
+			weekdays[wd] = true
+		}
+	}
+
+	if (w.From == "") != (w.To == "") {
+		return nil, fmt.Errorf("time: from and to go together")
+	}
+	from, err := parseTimeOfDay(w.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTimeOfDay(w.To)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(r *request) bool {
+		now := r.now.In(loc)
+		if weekdays != nil && !weekdays[now.Weekday()] {
+			return false
+		}
+		if w.From == "" {
+			return true
+		}
+
+		minute := now.Hour()*60 + now.Minute()
+		if from <= to {
+			return minute >= from && minute < to
+		}
+		return minute >= from || minute < to
+	}, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("time: invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("ip: %s", err)
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("ip: invalid IP %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func claimMatches(claim interface{}, expected string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, e := range v {
+			if claimMatches(e, expected) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(claim) == expected
+}
+
+func argString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case net.IP:
+		return val.String()
+	case int:
+		return strconv.Itoa(val)
+	case uint:
+		return strconv.FormatUint(uint64(val), 10)
+	case bool:
+		return strconv.FormatBool(val)
+	}
+	return ""
+}
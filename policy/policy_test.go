@@ -0,0 +1,104 @@
+package policy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompile(t *testing.T) {
+	invalid := map[string]document{
+		`unknown default effect "maybe"`: {Default: "maybe"},
+		"policy without id":              {Policies: []Policy{{Effect: EffectAllow}}},
+		"duplicate policy a":             {Policies: []Policy{{ID: "a", Effect: EffectAllow}, {ID: "a", Effect: EffectDeny}}},
+		`policy a: unknown effect ""`:    {Policies: []Policy{{ID: "a"}}},
+		"policy a: path: error parsing regexp: missing closing ): `(`": {Policies: []Policy{
+			{ID: "a", Effect: EffectAllow, Match: Match{Paths: []string{"("}}},
+		}},
+		`policy a: ip: invalid IP "10.0.0"`: {Policies: []Policy{
+			{ID: "a", Effect: EffectAllow, Match: Match{IPs: []string{"10.0.0"}}},
+		}},
+		`policy a: time: unknown day "monday"`: {Policies: []Policy{
+			{ID: "a", Effect: EffectAllow, Match: Match{Time: &TimeWindow{Days: []string{"monday"}}}},
+		}},
+		`policy a: time: invalid time of day "8h"`: {Policies: []Policy{
+			{ID: "a", Effect: EffectAllow, Match: Match{Time: &TimeWindow{From: "8h", To: "18:00"}}},
+		}},
+		"policy a: time: from and to go together": {Policies: []Policy{
+			{ID: "a", Effect: EffectAllow, Match: Match{Time: &TimeWindow{From: "08:00"}}},
+		}},
+		"policy a: time: unknown time zone Mars/Olympus": {Policies: []Policy{
+			{ID: "a", Effect: EffectAllow, Match: Match{Time: &TimeWindow{Location: "Mars/Olympus"}}},
+		}},
+	}
+	for msg, doc := range invalid {
+		_, err := compile(doc)
+		require.EqualError(t, err, msg)
+	}
+
+	set, err := compile(document{})
+	require.NoError(t, err)
+	require.Equal(t, EffectDeny, set.def)
+}
+
+func TestMatch(t *testing.T) {
+	// a Monday
+	now := time.Date(2021, 3, 15, 9, 30, 0, 0, time.UTC)
+	r := &request{
+		method:  "GET",
+		path:    "/admin/users",
+		ip:      net.ParseIP("10.1.2.3"),
+		headers: http.Header{"X-Env": []string{"prod"}},
+		args:    map[string]interface{}{"tenant": "acme", "port": 443},
+		claims: map[string]interface{}{
+			"role":   "admin",
+			"groups": []interface{}{"ops", "dev"},
+			"level":  json.Number("3"),
+		},
+		now: now,
+	}
+
+	tests := []struct {
+		name     string
+		match    Match
+		expected bool
+	}{
+		{"empty", Match{}, true},
+		{"method", Match{Methods: []string{"post", "get"}}, true},
+		{"other method", Match{Methods: []string{"POST"}}, false},
+		{"path", Match{Paths: []string{"^/api/", "^/admin/"}}, true},
+		{"other path", Match{Paths: []string{"^/api/"}}, false},
+		{"ip", Match{IPs: []string{"192.0.2.1", "10.0.0.0/8"}}, true},
+		{"other ip", Match{IPs: []string{"10.1.2.4"}}, false},
+		{"header", Match{Headers: map[string]string{"x-env": "^prod$"}}, true},
+		{"missing header", Match{Headers: map[string]string{"x-missing": "."}}, false},
+		{"args", Match{Args: map[string]string{"tenant": "^acme$", "port": "^443$"}}, true},
+		{"other arg", Match{Args: map[string]string{"tenant": "^other$"}}, false},
+		{"claims", Match{Claims: map[string]string{"role": "admin", "groups": "dev", "level": "3"}}, true},
+		{"other claim", Match{Claims: map[string]string{"groups": "admin"}}, false},
+		{"missing claim", Match{Claims: map[string]string{"email": ""}}, false},
+		{"days", Match{Time: &TimeWindow{Days: []string{"mon", "tue"}}}, true},
+		{"other days", Match{Time: &TimeWindow{Days: []string{"sat", "sun"}}}, false},
+		{"hours", Match{Time: &TimeWindow{From: "09:30", To: "18:00"}}, true},
+		{"other hours", Match{Time: &TimeWindow{From: "08:00", To: "09:30"}}, false},
+		{"overnight", Match{Time: &TimeWindow{From: "22:00", To: "10:00"}}, true},
+		{"location", Match{Time: &TimeWindow{From: "09:00", To: "10:00", Location: "America/New_York"}}, false},
+		{"all", Match{Methods: []string{"GET"}, IPs: []string{"10.0.0.0/8"}, Claims: map[string]string{"role": "admin"}}, true},
+		{"not all", Match{Methods: []string{"GET"}, IPs: []string{"192.168.0.0/16"}}, false},
+	}
+	for _, test := range tests {
+		set, err := compile(document{Policies: []Policy{{ID: "p", Effect: EffectAllow, Match: test.match}}})
+		require.NoError(t, err, test.name)
+		require.Equal(t, test.expected, set.policies[0].match(r), test.name)
+	}
+
+	// requests without claims never match claim conditions
+	r.claims = nil
+	set, err := compile(document{Policies: []Policy{{ID: "p", Effect: EffectAllow, Match: Match{Claims: map[string]string{"role": "admin"}}}}})
+	require.NoError(t, err)
+	require.False(t, set.policies[0].match(r))
+}
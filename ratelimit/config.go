@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration read from strings such as "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	err := value.Decode(&s)
+	if err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type config struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// LoadRules reads rules from a YAML or JSON file, depending on its
+// extension.
+func LoadRules(path string) ([]Rule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: %s", err)
+	}
+
+	var cfg config
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(b, &cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &cfg)
+	default:
+		return nil, fmt.Errorf("ratelimit: unsupported rules file %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: %s: %s", path, err)
+	}
+
+	for _, r := range cfg.Rules {
+		err := r.validate()
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: %s: %s", path, err)
+		}
+	}
+
+	return cfg.Rules, nil
+}
@@ -0,0 +1,299 @@
+// Package ratelimit implements an SPOE handler limiting the rate of requests
+// per key, read from a message arg.
+//
+// For each request matching at least one rule, the handler sets the
+// following transaction variables:
+//
+//	rl_allowed    true when the request is within all the limits
+//	rl_remaining  requests left under the most restrictive rule
+//	rl_reset      seconds until the most restrictive rule allows requests
+//	              again (when denied) or is fully reset (when allowed)
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+)
+
+const (
+	AlgorithmTokenBucket   = "token-bucket"
+	AlgorithmSlidingWindow = "sliding-window"
+)
+
+const (
+	varAllowed   = "rl_allowed"
+	varRemaining = "rl_remaining"
+	varReset     = "rl_reset"
+
+	// tries of the token bucket compare-and-swap under contention, after
+	// which the request is denied
+	maxSwapTries = 50
+)
+
+// Rule limits the requests sharing the same key to Limit per Window. With
+// the token bucket algorithm, Limit is also the burst size.
+type Rule struct {
+	Name      string   `json:"name" yaml:"name"`
+	Message   string   `json:"message" yaml:"message"`
+	Arg       string   `json:"arg" yaml:"arg"`
+	Header    string   `json:"header" yaml:"header"`
+	Algorithm string   `json:"algorithm" yaml:"algorithm"`
+	Limit     int64    `json:"limit" yaml:"limit"`
+	Window    Duration `json:"window" yaml:"window"`
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule without name")
+	}
+	if r.Message == "" || r.Arg == "" {
+		return fmt.Errorf("rule %s: message and arg are required", r.Name)
+	}
+	if r.Algorithm != AlgorithmTokenBucket && r.Algorithm != AlgorithmSlidingWindow {
+		return fmt.Errorf("rule %s: unknown algorithm %q", r.Name, r.Algorithm)
+	}
+	if r.Limit <= 0 || r.Window <= 0 {
+		return fmt.Errorf("rule %s: limit and window must be positive", r.Name)
+	}
+	if time.Duration(r.Window) < time.Duration(r.Limit) {
+		return fmt.Errorf("rule %s: window must be at least limit nanoseconds", r.Name)
+	}
+	return nil
+}
+
+type result struct {
+	allowed   bool
+	remaining int64
+	reset     time.Duration
+}
+
+// Limiter applies rules to requests.
+type Limiter struct {
+	store Store
+	rules map[string][]Rule
+
+	// FailOpen lets requests through when the store fails.
+	FailOpen bool
+	// Timeout bounds the store operations of a single request.
+	Timeout time.Duration
+
+	now func() time.Time
+}
+
+func New(store Store, rules []Rule) (*Limiter, error) {
+	l := &Limiter{
+		store:   store,
+		rules:   make(map[string][]Rule),
+		Timeout: 100 * time.Millisecond,
+		now:     time.Now,
+	}
+
+	names := make(map[string]bool)
+	for _, r := range rules {
+		err := r.validate()
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: %s", err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("ratelimit: duplicate rule %s", r.Name)
+		}
+		names[r.Name] = true
+		l.rules[r.Message] = append(l.rules[r.Message], r)
+	}
+
+	return l, nil
+}
+
+func (l *Limiter) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	ctx := context.Background()
+	if l.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.Timeout)
+		defer cancel()
+	}
+
+	var binding *result
+
+	for msgs.Next() {
+		rules, ok := l.rules[msgs.Message.Name]
+		if !ok {
+			continue
+		}
+		args := msgs.Message.Args.Map()
+
+		for _, rule := range rules {
+			key, ok := ruleKey(rule, args)
+			if !ok {
+				continue
+			}
+
+			res, err := l.apply(ctx, rule, key)
+			if err != nil {
+				if l.FailOpen {
+					continue
+				}
+				return nil, fmt.Errorf("ratelimit: rule %s: %s", rule.Name, err)
+			}
+
+			if binding == nil || moreRestrictive(res, *binding) {
+				binding = &res
+			}
+		}
+	}
+	if msgs.Error() != nil {
+		return nil, msgs.Error()
+	}
+
+	if binding == nil {
+		return nil, nil
+	}
+
+	return []spoe.Action{
+		spoe.ActionSetVar{Name: varAllowed, Scope: spoe.VarScopeTransaction, Value: binding.allowed},
+		spoe.ActionSetVar{Name: varRemaining, Scope: spoe.VarScopeTransaction, Value: int(binding.remaining)},
+		spoe.ActionSetVar{Name: varReset, Scope: spoe.VarScopeTransaction, Value: int(math.Ceil(binding.reset.Seconds()))},
+	}, nil
+}
+
+func moreRestrictive(a, b result) bool {
+	if a.allowed != b.allowed {
+		return !a.allowed
+	}
+	if a.remaining != b.remaining {
+		return a.remaining < b.remaining
+	}
+	return a.reset > b.reset
+}
+
+func (l *Limiter) apply(ctx context.Context, rule Rule, key string) (result, error) {
+	key = "rl:" + rule.Name + ":" + key
+	if rule.Algorithm == AlgorithmTokenBucket {
+		return l.tokenBucket(ctx, rule, key)
+	}
+	return l.slidingWindow(ctx, rule, key)
+}
+
+// tokenBucket implements the generic cell rate algorithm, storing the
+// theoretical arrival time of the next request.
+func (l *Limiter) tokenBucket(ctx context.Context, rule Rule, key string) (result, error) {
+	interval := time.Duration(rule.Window) / time.Duration(rule.Limit)
+	tolerance := time.Duration(rule.Window)
+
+	for i := 0; i < maxSwapTries; i++ {
+		now := l.now().UnixNano()
+
+		stored, exists, err := l.store.Get(ctx, key)
+		if err != nil {
+			return result{}, err
+		}
+
+		tat := stored
+		if !exists || tat < now {
+			tat = now
+		}
+		newTat := tat + int64(interval)
+		allowAt := newTat - int64(tolerance)
+
+		if now < allowAt {
+			return result{
+				allowed: false,
+				reset:   time.Duration(allowAt - now),
+			}, nil
+		}
+
+		ok, err := l.store.CompareAndSwap(ctx, key, stored, exists, newTat, time.Duration(newTat-now))
+		if err != nil {
+			return result{}, err
+		}
+		if ok {
+			return result{
+				allowed:   true,
+				remaining: (now - allowAt) / int64(interval),
+				reset:     time.Duration(newTat - now),
+			}, nil
+		}
+	}
+
+	// every try lost against a concurrent request of the same key: the
+	// bucket is being drained, deny rather than leave the frame unanswered
+	return result{allowed: false, reset: interval}, nil
+}
+
+// slidingWindow approximates a sliding window by weighting the count of the
+// previous fixed window by its overlap with the sliding one.
+func (l *Limiter) slidingWindow(ctx context.Context, rule Rule, key string) (result, error) {
+	window := int64(rule.Window)
+	now := l.now().UnixNano()
+	index := now / window
+	elapsed := now - index*window
+	ttl := 2 * time.Duration(window)
+
+	previous, _, err := l.store.Get(ctx, key+":"+strconv.FormatInt(index-1, 10))
+	if err != nil {
+		return result{}, err
+	}
+
+	currentKey := key + ":" + strconv.FormatInt(index, 10)
+	current, err := l.store.IncrBy(ctx, currentKey, 1, ttl)
+	if err != nil {
+		return result{}, err
+	}
+
+	weight := float64(window-elapsed) / float64(window)
+	count := float64(previous)*weight + float64(current)
+	reset := time.Duration(window - elapsed)
+
+	if count > float64(rule.Limit) {
+		// denied requests are not counted
+		_, err := l.store.IncrBy(ctx, currentKey, -1, ttl)
+		if err != nil {
+			return result{}, err
+		}
+		return result{allowed: false, reset: reset}, nil
+	}
+
+	return result{
+		allowed:   true,
+		remaining: int64(float64(rule.Limit) - count),
+		reset:     reset,
+	}, nil
+}
+
+func ruleKey(rule Rule, args map[string]interface{}) (string, bool) {
+	v, ok := args[rule.Arg]
+	if !ok {
+		return "", false
+	}
+
+	if rule.Header != "" {
+		hdrs, ok := v.([]byte)
+		if !ok {
+			return "", false
+		}
+		value, ok, err := spoe.LookupHeader(hdrs, rule.Header)
+		if err != nil || !ok || value == "" {
+			return "", false
+		}
+		return value, true
+	}
+
+	switch val := v.(type) {
+	case string:
+		return val, val != ""
+	case []byte:
+		return string(val), len(val) > 0
+	case net.IP:
+		return val.String(), true
+	case int:
+		return strconv.Itoa(val), true
+	case uint:
+		return strconv.FormatUint(uint64(val), 10), true
+	}
+	return "", false
+}
@@ -0,0 +1,256 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter(t *testing.T, store Store, rules ...Rule) (*Limiter, *fakeClock) {
+	l, err := New(store, rules)
+	require.NoError(t, err)
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l.now = clock.Now
+	if m, ok := store.(*MemoryStore); ok {
+		m.now = clock.Now
+	}
+	return l, clock
+}
+
+// testMessages encodes a frame holding a single message, with the same
+// layout as the one sent by HAProxy.
+func testMessages(t *testing.T, name string, args map[string]interface{}) *spoe.MessageIterator {
+	b := make([]byte, 1024)
+	n := copy(b[1:], name)
+	b[0] = byte(n)
+	off := n + 1
+	b[off] = byte(len(args))
+	off++
+
+	for k, v := range args {
+		b[off] = byte(len(k))
+		off++
+		off += copy(b[off:], k)
+		switch val := v.(type) {
+		case string:
+			b[off] = 8
+			b[off+1] = byte(len(val))
+			off += 2
+			off += copy(b[off:], val)
+		case []byte:
+			b[off] = 9
+			b[off+1] = byte(len(val))
+			off += 2
+			off += copy(b[off:], val)
+		case net.IP:
+			b[off] = 6
+			off++
+			off += copy(b[off:], val.To4())
+		default:
+			t.Fatalf("unsupported type %T", v)
+		}
+	}
+
+	return spoe.NewMessageIterator(b[:off])
+}
+
+func vars(t *testing.T, actions []spoe.Action) map[string]interface{} {
+	res := make(map[string]interface{})
+	for _, a := range actions {
+		v := a.(spoe.ActionSetVar)
+		require.Equal(t, spoe.VarScopeTransaction, v.Scope)
+		res[v.Name] = v.Value
+	}
+	return res
+}
+
+func TestTokenBucket(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+
+	l, clock := newTestLimiter(t, store, Rule{
+		Name:      "per-ip",
+		Message:   "rate-limit",
+		Arg:       "ip",
+		Algorithm: AlgorithmTokenBucket,
+		Limit:     3,
+		Window:    Duration(3 * time.Second),
+	})
+
+	ip := net.ParseIP("10.0.0.1")
+	for i := 2; i >= 0; i-- {
+		actions, err := l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"ip": ip}))
+		require.NoError(t, err)
+		v := vars(t, actions)
+		require.Equal(t, true, v[varAllowed])
+		require.Equal(t, i, v[varRemaining])
+	}
+
+	actions, err := l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"ip": ip}))
+	require.NoError(t, err)
+	v := vars(t, actions)
+	require.Equal(t, false, v[varAllowed])
+	require.Equal(t, 0, v[varRemaining])
+	require.Equal(t, 1, v[varReset])
+
+	// other keys have their own bucket
+	actions, err = l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"ip": net.ParseIP("10.0.0.2")}))
+	require.NoError(t, err)
+	require.Equal(t, true, vars(t, actions)[varAllowed])
+
+	// one token is added every second
+	clock.now = clock.now.Add(time.Second)
+	actions, err = l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"ip": ip}))
+	require.NoError(t, err)
+	v = vars(t, actions)
+	require.Equal(t, true, v[varAllowed])
+	require.Equal(t, 0, v[varRemaining])
+}
+
+func TestSlidingWindow(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+
+	l, clock := newTestLimiter(t, store, Rule{
+		Name:      "per-key",
+		Message:   "rate-limit",
+		Arg:       "key",
+		Algorithm: AlgorithmSlidingWindow,
+		Limit:     2,
+		Window:    Duration(10 * time.Second),
+	})
+
+	handle := func() map[string]interface{} {
+		actions, err := l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"key": "abc"}))
+		require.NoError(t, err)
+		return vars(t, actions)
+	}
+
+	require.Equal(t, true, handle()[varAllowed])
+	v := handle()
+	require.Equal(t, true, v[varAllowed])
+	require.Equal(t, 0, v[varRemaining])
+	require.Equal(t, 10, v[varReset])
+	require.Equal(t, false, handle()[varAllowed])
+
+	// half of the previous window still counts
+	clock.now = clock.now.Add(15 * time.Second)
+	v = handle()
+	require.Equal(t, true, v[varAllowed])
+	require.Equal(t, 0, v[varRemaining])
+	require.Equal(t, false, handle()[varAllowed])
+
+	clock.now = clock.now.Add(20 * time.Second)
+	require.Equal(t, true, handle()[varAllowed])
+}
+
+func TestHeaderKeyAndUnmatched(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+
+	l, _ := newTestLimiter(t, store, Rule{
+		Name:      "per-api-key",
+		Message:   "rate-limit",
+		Arg:       "req.hdrs_bin",
+		Header:    "X-Api-Key",
+		Algorithm: AlgorithmTokenBucket,
+		Limit:     1,
+		Window:    Duration(time.Minute),
+	})
+
+	h := http.Header{}
+	h.Set("X-Api-Key", "secret")
+	hdrs, err := spoe.EncodeHeaders(h)
+	require.NoError(t, err)
+
+	actions, err := l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"req.hdrs_bin": hdrs}))
+	require.NoError(t, err)
+	require.Equal(t, true, vars(t, actions)[varAllowed])
+
+	actions, err = l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"req.hdrs_bin": hdrs}))
+	require.NoError(t, err)
+	require.Equal(t, false, vars(t, actions)[varAllowed])
+
+	// requests without the key are not limited
+	hdrs, err = spoe.EncodeHeaders(http.Header{})
+	require.NoError(t, err)
+	actions, err = l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"req.hdrs_bin": hdrs}))
+	require.NoError(t, err)
+	require.Nil(t, actions)
+
+	actions, err = l.Handle(testMessages(t, "other", map[string]interface{}{"key": "x"}))
+	require.NoError(t, err)
+	require.Nil(t, actions)
+}
+
+func TestLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlPath := filepath.Join(dir, "rules.yaml")
+	require.NoError(t, ioutil.WriteFile(yamlPath, []byte(`
+rules:
+  - name: per-ip
+    message: rate-limit
+    arg: ip
+    algorithm: token-bucket
+    limit: 100
+    window: 1m
+`), 0644))
+
+	rules, err := LoadRules(yamlPath)
+	require.NoError(t, err)
+	require.Equal(t, []Rule{{
+		Name:      "per-ip",
+		Message:   "rate-limit",
+		Arg:       "ip",
+		Algorithm: AlgorithmTokenBucket,
+		Limit:     100,
+		Window:    Duration(time.Minute),
+	}}, rules)
+
+	jsonPath := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(jsonPath, []byte(`{"rules": [
+		{"name": "x", "message": "m", "arg": "a", "algorithm": "leaky", "limit": 1, "window": "1s"}
+	]}`), 0644))
+
+	_, err = LoadRules(jsonPath)
+	require.Error(t, err)
+
+	_, err = New(nil, []Rule{rules[0], rules[0]})
+	require.Error(t, err)
+}
+
+func TestRuleValidation(t *testing.T) {
+	rule := Rule{
+		Name:      "per-ip",
+		Message:   "rate-limit",
+		Arg:       "ip",
+		Algorithm: AlgorithmTokenBucket,
+		Limit:     1000,
+		Window:    Duration(999 * time.Nanosecond),
+	}
+	_, err := New(NewMemoryStore(0), []Rule{rule})
+	require.EqualError(t, err, "ratelimit: rule per-ip: window must be at least limit nanoseconds")
+
+	rule.Window = Duration(time.Microsecond)
+	_, err = New(NewMemoryStore(0), []Rule{rule})
+	require.NoError(t, err)
+}
@@ -0,0 +1,309 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var errRedisNil = errors.New("redis: nil reply")
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisStore is a Store backed by a server speaking the Redis protocol, so
+// that several agents share their counters.
+type RedisStore struct {
+	addr        string
+	dialTimeout time.Duration
+
+	conns chan *redisConn
+}
+
+// NewRedisStore returns a store connecting to addr, keeping at most
+// maxIdle idle connections.
+func NewRedisStore(addr string, maxIdle int) *RedisStore {
+	return &RedisStore{
+		addr:        addr,
+		dialTimeout: time.Second,
+		conns:       make(chan *redisConn, maxIdle),
+	}
+}
+
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.conns:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (int64, bool, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	v, ok, err := c.getInt(key)
+	s.put(c, err)
+	return v, ok, err
+}
+
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key string, old int64, exists bool, new int64, ttl time.Duration) (bool, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := c.compareAndSwap(key, old, exists, new, ttl)
+	s.put(c, err)
+	return ok, err
+}
+
+func (s *RedisStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	replies, err := c.pipeline(
+		[]string{"INCRBY", key, strconv.FormatInt(delta, 10)},
+		[]string{"PEXPIRE", key, redisTTL(ttl)},
+	)
+	s.put(c, err)
+	if err != nil {
+		return 0, err
+	}
+
+	v, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCRBY reply %v", replies[0])
+	}
+	return v, nil
+}
+
+func (s *RedisStore) get(ctx context.Context) (*redisConn, error) {
+	var c *redisConn
+	select {
+	case c = <-s.conns:
+	default:
+		d := net.Dialer{Timeout: s.dialTimeout}
+		nc, err := d.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return nil, fmt.Errorf("redis: %s", err)
+		}
+		c = &redisConn{
+			Conn: nc,
+			r:    bufio.NewReader(nc),
+			w:    bufio.NewWriter(nc),
+		}
+	}
+
+	deadline, _ := ctx.Deadline()
+	err := c.SetDeadline(deadline)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+	return c, nil
+}
+
+// put returns the connection to the pool unless it failed at the protocol
+// level: only complete error replies leave it in a known state.
+func (s *RedisStore) put(c *redisConn, err error) {
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) && err != errRedisNil {
+		c.Close()
+		return
+	}
+
+	select {
+	case s.conns <- c:
+	default:
+		c.Close()
+	}
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (c *redisConn) getInt(key string) (int64, bool, error) {
+	res, err := c.do("GET", key)
+	if err == errRedisNil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	b, ok := res.([]byte)
+	if !ok {
+		return 0, false, fmt.Errorf("redis: unexpected GET reply %v", res)
+	}
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("redis: value of %s: %s", key, err)
+	}
+	return v, true, nil
+}
+
+func (c *redisConn) compareAndSwap(key string, old int64, exists bool, new int64, ttl time.Duration) (bool, error) {
+	_, err := c.do("WATCH", key)
+	if err != nil {
+		return false, err
+	}
+
+	v, ok, err := c.getInt(key)
+	if err != nil {
+		return false, err
+	}
+	if ok != exists || (ok && v != old) {
+		_, err = c.do("UNWATCH")
+		return false, err
+	}
+
+	replies, err := c.pipeline(
+		[]string{"MULTI"},
+		[]string{"SET", key, strconv.FormatInt(new, 10), "PX", redisTTL(ttl)},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		return false, err
+	}
+	if replies[2] == nil {
+		// the transaction was aborted by a concurrent write
+		return false, nil
+	}
+	return true, nil
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline(args)
+	if err != nil {
+		return nil, err
+	}
+	if replies[0] == nil {
+		return nil, errRedisNil
+	}
+	return replies[0], nil
+}
+
+// pipeline sends all the commands before reading their replies. Nil replies
+// are returned as nil values.
+func (c *redisConn) pipeline(cmds ...[]string) ([]interface{}, error) {
+	for _, args := range cmds {
+		fmt.Fprintf(c.w, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	err := c.w.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+
+	replies := make([]interface{}, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		replies[i], err = readReply(c.r)
+		var rerr redisError
+		if errors.As(err, &rerr) {
+			// keep reading to leave the connection in a clean state
+			if replyErr == nil {
+				replyErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, replyErr
+}
+
+func redisTTL(ttl time.Duration) string {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		v, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed integer %q", line)
+		}
+		return v, nil
+	case '$':
+		l, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", line)
+		}
+		if l < 0 {
+			return nil, nil
+		}
+		b := make([]byte, l+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, fmt.Errorf("redis: %s", err)
+		}
+		return b[:l], nil
+	case '*':
+		l, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", line)
+		}
+		if l < 0 {
+			return nil, nil
+		}
+		// error elements, as in EXEC replies, do not stop the read so
+		// that the connection stays usable
+		res := make([]interface{}, l)
+		var elemErr error
+		for i := range res {
+			res[i], err = readReply(r)
+			var rerr redisError
+			if errors.As(err, &rerr) {
+				if elemErr == nil {
+					elemErr = err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, elemErr
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
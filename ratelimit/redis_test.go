@@ -0,0 +1,294 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a stand-in for a Redis server implementing the commands used
+// by RedisStore.
+type fakeRedis struct {
+	lock     sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	versions map[string]int
+}
+
+func startFakeRedis(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	s := &fakeRedis{
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		versions: make(map[string]int),
+	}
+
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+
+	return lis.Addr().String()
+}
+
+func (s *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	watched := map[string]int{}
+	var queue [][]string
+	inMulti := false
+
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range reply.([]interface{}) {
+			args = append(args, string(a.([]byte)))
+		}
+		cmd := strings.ToUpper(args[0])
+
+		switch {
+		case cmd == "WATCH":
+			s.lock.Lock()
+			watched[args[1]] = s.versions[args[1]]
+			s.lock.Unlock()
+			fmt.Fprint(c, "+OK\r\n")
+		case cmd == "UNWATCH":
+			watched = map[string]int{}
+			fmt.Fprint(c, "+OK\r\n")
+		case cmd == "MULTI":
+			inMulti = true
+			fmt.Fprint(c, "+OK\r\n")
+		case cmd == "EXEC":
+			s.lock.Lock()
+			aborted := false
+			for k, v := range watched {
+				if s.versions[k] != v {
+					aborted = true
+				}
+			}
+			if aborted {
+				fmt.Fprint(c, "*-1\r\n")
+			} else {
+				fmt.Fprintf(c, "*%d\r\n", len(queue))
+				for _, q := range queue {
+					fmt.Fprint(c, s.exec(q))
+				}
+			}
+			s.lock.Unlock()
+			queue, inMulti, watched = nil, false, map[string]int{}
+		case inMulti:
+			queue = append(queue, args)
+			fmt.Fprint(c, "+QUEUED\r\n")
+		default:
+			s.lock.Lock()
+			fmt.Fprint(c, s.exec(args))
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *fakeRedis) exec(args []string) string {
+	key := args[1]
+	if exp, ok := s.expires[key]; ok && !time.Now().Before(exp) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, ok := s.values[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		s.values[key] = args[2]
+		s.versions[key]++
+		if len(args) == 5 {
+			ms, _ := strconv.Atoi(args[4])
+			s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "INCRBY":
+		v, _ := strconv.ParseInt(s.values[key], 10, 64)
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		v += delta
+		s.values[key] = strconv.FormatInt(v, 10)
+		s.versions[key]++
+		return fmt.Sprintf(":%d\r\n", v)
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisStore(t *testing.T) {
+	store := NewRedisStore(startFakeRedis(t), 2)
+	defer store.Close()
+	ctx := context.Background()
+
+	_, ok, err := store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	swapped, err := store.CompareAndSwap(ctx, "a", 0, false, 10, time.Minute)
+	require.NoError(t, err)
+	require.True(t, swapped)
+
+	swapped, err = store.CompareAndSwap(ctx, "a", 0, false, 20, time.Minute)
+	require.NoError(t, err)
+	require.False(t, swapped)
+
+	swapped, err = store.CompareAndSwap(ctx, "a", 10, true, 20, time.Minute)
+	require.NoError(t, err)
+	require.True(t, swapped)
+
+	v, ok, err := store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(20), v)
+
+	v, err = store.IncrBy(ctx, "b", 5, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), v)
+	v, err = store.IncrBy(ctx, "b", -2, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), v)
+
+	// keys expire with their ttl
+	_, err = store.IncrBy(ctx, "a", 1, time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, ok, err = store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestRedisLimiter(t *testing.T) {
+	store := NewRedisStore(startFakeRedis(t), 4)
+	defer store.Close()
+
+	l, err := New(store, []Rule{{
+		Name:      "per-ip",
+		Message:   "rate-limit",
+		Arg:       "ip",
+		Algorithm: AlgorithmTokenBucket,
+		Limit:     5,
+		Window:    Duration(time.Hour),
+	}})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	allowed := make(chan bool, 10)
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			actions, err := l.Handle(testMessages(t, "rate-limit", map[string]interface{}{"ip": net.ParseIP("10.0.0.1")}))
+			if err != nil {
+				errs <- err
+				return
+			}
+			allowed <- actions[0].(spoe.ActionSetVar).Value.(bool)
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	count := 0
+	for a := range allowed {
+		if a {
+			count++
+		}
+	}
+	require.Equal(t, 5, count)
+}
+
+func TestRedisReadReplyArrayError(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n:1\r\n-ERR wrong type\r\n:3\r\n+OK\r\n"))
+
+	res, err := readReply(r)
+	require.Equal(t, redisError("ERR wrong type"), err)
+	require.Equal(t, []interface{}{int64(1), nil, int64(3)}, res)
+
+	// the whole array was consumed
+	res, err = readReply(r)
+	require.NoError(t, err)
+	require.Equal(t, "OK", res)
+}
+
+func TestRedisStoreDiscardsBrokenConns(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	replies := []string{
+		"$3\r\nabc\r\n",       // not an integer
+		"*2\r\n:1\r\n?\r\n",   // malformed nested reply
+		"-ERR wrong type\r\n", // error reply, the connection is kept
+	}
+	go func() {
+		for _, reply := range replies {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn, reply string) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					_, err := readReply(r)
+					if err != nil {
+						return
+					}
+					fmt.Fprint(c, reply)
+				}
+			}(c, reply)
+		}
+	}()
+
+	store := NewRedisStore(lis.Addr().String(), 2)
+	defer store.Close()
+	ctx := context.Background()
+
+	for range replies[:2] {
+		_, _, err = store.Get(ctx, "a")
+		require.Error(t, err)
+		require.Len(t, store.conns, 0)
+	}
+
+	_, _, err = store.Get(ctx, "a")
+	require.Equal(t, redisError("ERR wrong type"), err)
+	require.Len(t, store.conns, 1)
+}
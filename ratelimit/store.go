@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store holds the counters of the limiter. Implementations must be safe for
+// concurrent use, and their operations atomic.
+type Store interface {
+	// Get returns the value of key. ok is false when the key is missing or
+	// expired.
+	Get(ctx context.Context, key string) (value int64, ok bool, err error)
+	// CompareAndSwap sets key to new, expiring after ttl, if its current
+	// value is old, or if it is missing when exists is false.
+	CompareAndSwap(ctx context.Context, key string, old int64, exists bool, new int64, ttl time.Duration) (bool, error)
+	// IncrBy adds delta to key, creating it if needed, sets it to expire
+	// after ttl and returns its new value.
+	IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+type memoryEntry struct {
+	value   int64
+	expires time.Time
+}
+
+// MemoryStore is a Store local to the process.
+type MemoryStore struct {
+	lock    sync.Mutex
+	entries map[string]memoryEntry
+
+	now  func() time.Time
+	stop chan struct{}
+}
+
+// NewMemoryStore returns a MemoryStore purging expired keys every
+// cleanupInterval.
+func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		entries: make(map[string]memoryEntry),
+		now:     time.Now,
+		stop:    make(chan struct{}),
+	}
+	go s.cleanup(cleanupInterval)
+	return s
+}
+
+func (s *MemoryStore) Close() error {
+	close(s.stop)
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (int64, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.get(key)
+	return e.value, ok, nil
+}
+
+func (s *MemoryStore) CompareAndSwap(ctx context.Context, key string, old int64, exists bool, new int64, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.get(key)
+	if ok != exists || (ok && e.value != old) {
+		return false, nil
+	}
+
+	s.entries[key] = memoryEntry{
+		value:   new,
+		expires: s.now().Add(ttl),
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, _ := s.get(key)
+	e.value += delta
+	e.expires = s.now().Add(ttl)
+	s.entries[key] = e
+	return e.value, nil
+}
+
+func (s *MemoryStore) get(key string) (memoryEntry, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if !s.now().Before(e.expires) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, true
+}
+
+func (s *MemoryStore) cleanup(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			now := s.now()
+			for k, e := range s.entries {
+				if !now.Before(e.expires) {
+					delete(s.entries, k)
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+}
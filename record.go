@@ -0,0 +1,507 @@
+package spoe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recordings start with recordMagic, followed by records made of a type
+// byte, a big endian timestamp in nanoseconds, then the engine id, stream
+// id, frame id and frame payload encoded as in SPOE frames.
+const (
+	recordMagic = "SPOEREC\x01"
+
+	recordHeaderLen = 9
+)
+
+type RecordType byte
+
+const (
+	RecordNotify RecordType = 1
+	RecordAck    RecordType = 2
+)
+
+func (t RecordType) String() string {
+	switch t {
+	case RecordNotify:
+		return "notify"
+	case RecordAck:
+		return "ack"
+	}
+	return fmt.Sprintf("record(%d)", byte(t))
+}
+
+// Record is a notify frame received or an ack frame sent by an agent.
+type Record struct {
+	Type     RecordType
+	Time     time.Time
+	EngineID string
+	StreamID int
+	FrameID  int
+	// Data is the frame payload: the messages of notify frames, the
+	// actions of ack frames.
+	Data []byte
+}
+
+// Messages returns the messages of a notify record.
+func (r Record) Messages() *MessageIterator {
+	return NewMessageIterator(r.Data)
+}
+
+// Actions decodes the actions of an ack record.
+func (r Record) Actions() ([]Action, error) {
+	return DecodeActions(r.Data)
+}
+
+type RecorderConfig struct {
+	// Path is the file the records are written to. Records are appended
+	// when it already exists.
+	Path string
+	// SampleRate is the fraction of the frames recorded, between 0 and 1.
+	// Zero records all the frames, as 1 does. Frames are sampled by engine,
+	// stream and frame ids, so the ack of a recorded notify frame is
+	// recorded as well.
+	SampleRate float64
+	// MaxSize is the size after which the file is rotated, in bytes. Zero
+	// disables rotation.
+	MaxSize int64
+	// MaxFiles is the number of rotated files kept, as Path.1 (the most
+	// recent) to Path.MaxFiles.
+	MaxFiles int
+	// QueueSize bounds the frames waiting to be written. Frames are dropped
+	// when the queue is full, so a slow disk never delays traffic.
+	QueueSize int
+	// FlushInterval is how often the written records are flushed to the
+	// file.
+	FlushInterval time.Duration
+}
+
+var DefaultRecorderConfig = RecorderConfig{
+	SampleRate:    1,
+	MaxSize:       100 << 20,
+	MaxFiles:      5,
+	QueueSize:     1024,
+	FlushInterval: time.Second,
+}
+
+// Recorder writes the frames handled by an agent to a file, for replay. It
+// is set in Config.Recorder and is safe for concurrent use.
+type Recorder struct {
+	cfg RecorderConfig
+
+	lock sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	size int64
+
+	queue     chan []byte
+	dropped   uint64
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRecorder opens the recording and starts writing the frames of the
+// agents using it in the background.
+func NewRecorder(cfg RecorderConfig) (*Recorder, error) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultRecorderConfig.QueueSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultRecorderConfig.FlushInterval
+	}
+
+	r := &Recorder{
+		cfg:     cfg,
+		queue:   make(chan []byte, cfg.QueueSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	go r.run()
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	f, err := os.OpenFile(r.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "recorder")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "recorder")
+	}
+
+	r.file = f
+	r.w = bufio.NewWriter(f)
+	r.size = info.Size()
+
+	if r.size == 0 {
+		_, err = r.w.WriteString(recordMagic)
+		if err != nil {
+			return errors.Wrap(err, "recorder")
+		}
+		r.size = int64(len(recordMagic))
+	}
+	return nil
+}
+
+// Write appends rec to the recording, rotating the file first if it is too
+// large. Unlike the frames recorded for an agent, it is written right away,
+// and buffered until the next flush.
+func (r *Recorder) Write(rec Record) error {
+	buf, err := recordBuffer(rec)
+	if err != nil {
+		return errors.Wrap(err, "recorder")
+	}
+	defer pool.Put(buf)
+
+	return r.write(buf)
+}
+
+func (r *Recorder) write(b []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return errors.New("recorder: closed")
+	}
+
+	if r.cfg.MaxSize > 0 && r.size+int64(len(b)) > r.cfg.MaxSize && r.size > int64(len(recordMagic)) {
+		err := r.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := r.w.Write(b)
+	if err != nil {
+		return errors.Wrap(err, "recorder")
+	}
+	r.size += int64(len(b))
+	return nil
+}
+
+// Dropped returns the number of frames dropped because the queue was full.
+func (r *Recorder) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+func (r *Recorder) rotate() error {
+	err := r.closeFile()
+	if err != nil {
+		return err
+	}
+
+	if r.cfg.MaxFiles > 0 {
+		for i := r.cfg.MaxFiles - 1; i > 0; i-- {
+			err := os.Rename(r.rotatedPath(i), r.rotatedPath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				log.Errorf("spoe: error rotating recording: %s", err)
+			}
+		}
+		err = os.Rename(r.cfg.Path, r.rotatedPath(1))
+	} else {
+		err = os.Remove(r.cfg.Path)
+	}
+
+	// keep recording even if the old file could not be moved
+	oerr := r.open()
+	if err != nil {
+		return errors.Wrap(err, "recorder")
+	}
+	return oerr
+}
+
+func (r *Recorder) rotatedPath(i int) string {
+	return r.cfg.Path + "." + strconv.Itoa(i)
+}
+
+func (r *Recorder) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.w == nil {
+		return nil
+	}
+	return errors.Wrap(r.w.Flush(), "recorder")
+}
+
+// Close writes the queued frames, flushes the records and closes the
+// file. Frames recorded after Close are dropped, records written after
+// Close return an error.
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+	})
+	<-r.stopped
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closeFile()
+}
+
+func (r *Recorder) run() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(r.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case b := <-r.queue:
+			r.writeQueued(b)
+		case <-ticker.C:
+			err := r.Flush()
+			if err != nil {
+				log.Errorf("spoe: error flushing recording: %s", err)
+			}
+		case <-r.stop:
+			for {
+				select {
+				case b := <-r.queue:
+					r.writeQueued(b)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *Recorder) writeQueued(b []byte) {
+	err := r.write(b)
+	pool.Put(b)
+	if err != nil {
+		log.Errorf("spoe: error recording frame: %s", err)
+	}
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.w.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file, r.w = nil, nil
+	return errors.Wrap(err, "recorder")
+}
+
+func (r *Recorder) sampled(engineID string, streamID, frameID int) bool {
+	if r.cfg.SampleRate <= 0 || r.cfg.SampleRate >= 1 {
+		return true
+	}
+
+	h := fnv.New64a()
+	var ids [16]byte
+	binary.BigEndian.PutUint64(ids[:8], uint64(streamID))
+	binary.BigEndian.PutUint64(ids[8:], uint64(frameID))
+	h.Write([]byte(engineID))
+	h.Write(ids[:])
+	return float64(h.Sum64()>>11)/(1<<53) < r.cfg.SampleRate
+}
+
+// record is called by the agent for each notify frame received and ack
+// frame sent. The frame is queued for the background writer, or dropped
+// when the queue is full.
+func (r *Recorder) record(t RecordType, engineID string, f Frame) {
+	if r == nil || !r.sampled(engineID, f.streamID, f.frameID) {
+		return
+	}
+	select {
+	case <-r.stop:
+		return
+	default:
+	}
+
+	buf, err := recordBuffer(Record{
+		Type:     t,
+		Time:     time.Now(),
+		EngineID: engineID,
+		StreamID: f.streamID,
+		FrameID:  f.frameID,
+		Data:     f.data,
+	})
+	if err != nil {
+		log.Errorf("spoe: error recording %s frame: %s", t, err)
+		return
+	}
+
+	select {
+	case r.queue <- buf:
+	default:
+		pool.Put(buf)
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+// recordBuffer returns rec encoded in a buffer of the pool.
+func recordBuffer(rec Record) ([]byte, error) {
+	b := pool.Get(recordHeaderLen + 4*maxVarintLen + len(rec.EngineID) + len(rec.Data))
+	n, err := encodeRecord(b, rec)
+	if err != nil {
+		pool.Put(b)
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+func encodeRecord(b []byte, rec Record) (int, error) {
+	b[0] = byte(rec.Type)
+	binary.BigEndian.PutUint64(b[1:], uint64(rec.Time.UnixNano()))
+	off := recordHeaderLen
+
+	n, err := encodeString(b[off:], rec.EngineID)
+	if err != nil {
+		return 0, err
+	}
+	off += n
+
+	n, err = encodeVarint(b[off:], rec.StreamID)
+	if err != nil {
+		return 0, err
+	}
+	off += n
+
+	n, err = encodeVarint(b[off:], rec.FrameID)
+	if err != nil {
+		return 0, err
+	}
+	off += n
+
+	n, err = encodeBytes(b[off:], rec.Data)
+	if err != nil {
+		return 0, err
+	}
+	off += n
+
+	return off, nil
+}
+
+// RecordReader reads the records written by a Recorder.
+type RecordReader struct {
+	r *bufio.Reader
+}
+
+// NewRecordReader checks that r holds a recording and returns a reader of
+// its records.
+func NewRecordReader(r io.Reader) (*RecordReader, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(recordMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != recordMagic {
+		return nil, errors.New("record: not a recording")
+	}
+
+	return &RecordReader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the recording. A
+// truncated last record, as left by a crash, returns io.ErrUnexpectedEOF.
+//
+// Concatenated recordings, such as rotated files, are read as one.
+func (r *RecordReader) Next() (Record, error) {
+	if magic, _ := r.r.Peek(len(recordMagic)); string(magic) == recordMagic {
+		r.r.Discard(len(recordMagic))
+	}
+
+	var header [recordHeaderLen]byte
+	_, err := io.ReadFull(r.r, header[:])
+	if err != nil {
+		return Record{}, err
+	}
+
+	rec := Record{
+		Type: RecordType(header[0]),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[1:]))),
+	}
+	if rec.Type != RecordNotify && rec.Type != RecordAck {
+		return Record{}, fmt.Errorf("record: unknown record type %d", header[0])
+	}
+
+	engineID, err := r.readBytes()
+	if err != nil {
+		return Record{}, err
+	}
+	rec.EngineID = string(engineID)
+
+	rec.StreamID, err = r.readVarint()
+	if err != nil {
+		return Record{}, err
+	}
+	rec.FrameID, err = r.readVarint()
+	if err != nil {
+		return Record{}, err
+	}
+
+	rec.Data, err = r.readBytes()
+	if err != nil {
+		return Record{}, err
+	}
+
+	return rec, nil
+}
+
+func (r *RecordReader) readVarint() (int, error) {
+	var b [maxVarintLen]byte
+	n := 0
+	for {
+		c, err := r.r.ReadByte()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == len(b) {
+			return 0, errors.New("record: varint too long")
+		}
+		b[n] = c
+		n++
+
+		if (n == 1 && c < 240) || (n > 1 && c < 128) {
+			break
+		}
+	}
+
+	v, _, err := decodeVarint(b[:n])
+	return v, errors.Wrap(err, "record")
+}
+
+func (r *RecordReader) readBytes() ([]byte, error) {
+	l, err := r.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if l < 0 || l > maxFrameSize {
+		return nil, fmt.Errorf("record: invalid field length %d", l)
+	}
+
+	b := make([]byte, l)
+	_, err = io.ReadFull(r.r, b)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, err
+}
@@ -0,0 +1,188 @@
+package spoe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readRecords(t *testing.T, paths ...string) []Record {
+	var readers []io.Reader
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		readers = append(readers, bytes.NewReader(b))
+	}
+
+	r, err := NewRecordReader(io.MultiReader(readers...))
+	require.NoError(t, err)
+
+	var records []Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		require.NoError(t, err)
+		records = append(records, rec)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spoe-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultRecorderConfig
+	cfg.Path = filepath.Join(dir, "spoe.rec")
+	cfg.MaxSize = 110
+	cfg.MaxFiles = 2
+	r, err := NewRecorder(cfg)
+	require.NoError(t, err)
+
+	now := time.Unix(1600000000, 123)
+	var written []Record
+	for i := 0; i < 6; i++ {
+		rec := Record{
+			Type:     RecordNotify,
+			Time:     now.Add(time.Duration(i) * time.Second),
+			EngineID: "engine",
+			StreamID: 300 + i,
+			FrameID:  1,
+			Data:     bytes.Repeat([]byte{byte(i)}, 30),
+		}
+		if i%2 == 1 {
+			rec.Type = RecordAck
+		}
+		require.NoError(t, r.Write(rec))
+		written = append(written, rec)
+	}
+	require.NoError(t, r.Close())
+	require.Error(t, r.Write(written[0]))
+
+	// each file holds two records, the oldest file was removed
+	_, err = os.Stat(cfg.Path + ".3")
+	require.True(t, os.IsNotExist(err))
+
+	records := readRecords(t, cfg.Path+".2", cfg.Path+".1", cfg.Path)
+	require.Len(t, records, 6)
+	for i, rec := range records {
+		require.True(t, written[i].Time.Equal(rec.Time))
+		rec.Time = written[i].Time
+		require.Equal(t, written[i], rec)
+	}
+
+	// records are appended to existing files
+	cfg.MaxSize = 0
+	r, err = NewRecorder(cfg)
+	require.NoError(t, err)
+	require.NoError(t, r.Write(written[0]))
+	require.NoError(t, r.Close())
+	require.Len(t, readRecords(t, cfg.Path), 3)
+}
+
+func TestRecorderQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spoe-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the zero config records every frame
+	path := filepath.Join(dir, "spoe.rec")
+	r, err := NewRecorder(RecorderConfig{Path: path, QueueSize: 1})
+	require.NoError(t, err)
+
+	// a blocked writer makes frames be dropped instead of blocking
+	r.lock.Lock()
+	for i := 0; i < 3; i++ {
+		r.record(RecordNotify, "engine", Frame{streamID: i, frameID: 1, data: []byte("data")})
+	}
+	require.True(t, r.Dropped() >= 1)
+	r.lock.Unlock()
+
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close())
+	r.record(RecordNotify, "engine", Frame{streamID: 9, frameID: 1})
+
+	records := readRecords(t, path)
+	require.Equal(t, 3, len(records)+int(r.Dropped()))
+	require.Equal(t, []byte("data"), records[0].Data)
+}
+
+func TestRecordReaderErrors(t *testing.T) {
+	_, err := NewRecordReader(bytes.NewReader([]byte("not a recording")))
+	require.Error(t, err)
+
+	buf := make([]byte, 100)
+	n, err := encodeRecord(buf, Record{Type: RecordNotify, EngineID: "e", Data: []byte("data")})
+	require.NoError(t, err)
+
+	r, err := NewRecordReader(bytes.NewReader(append([]byte(recordMagic), buf[:n-2]...)))
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	buf[0] = 42
+	r, err = NewRecordReader(bytes.NewReader(append([]byte(recordMagic), buf[:n]...)))
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.EqualError(t, err, "record: unknown record type 42")
+}
+
+func TestRecordReaderCorrupt(t *testing.T) {
+	// a negative length varint
+	b := append([]byte(recordMagic), 1, 0, 0, 0, 0, 0, 0, 0, 0, 0xf0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x08)
+	r, err := NewRecordReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.Error(t, err)
+
+	buf := make([]byte, 200)
+	n, err := encodeRecord(buf, Record{Type: RecordNotify, EngineID: "engine", StreamID: 1000, FrameID: 3, Data: notifyFrame(t).data})
+	require.NoError(t, err)
+	valid := append([]byte(recordMagic), buf[:n]...)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := append([]byte(nil), valid...)
+		for j := 0; j < 1+rnd.Intn(4); j++ {
+			b[len(recordMagic)+rnd.Intn(n)] = byte(rnd.Intn(256))
+		}
+
+		require.NotPanics(t, func() {
+			r, err := NewRecordReader(bytes.NewReader(b))
+			require.NoError(t, err)
+			for {
+				rec, err := r.Next()
+				if err != nil {
+					return
+				}
+				for msgs := rec.Messages(); msgs.Next(); {
+				}
+				_, _ = rec.Actions()
+			}
+		}, "%x", b)
+	}
+}
+
+func TestRecorderSampling(t *testing.T) {
+	r := &Recorder{cfg: RecorderConfig{SampleRate: 0.25}}
+
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		engine := fmt.Sprintf("engine-%d", i%3)
+		s := r.sampled(engine, i, 1)
+		require.Equal(t, s, r.sampled(engine, i, 1))
+		if s {
+			sampled++
+		}
+	}
+	require.InDelta(t, 2500, sampled, 250)
+}
@@ -0,0 +1,342 @@
+package spoe
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/pkg/errors"
+)
+
+// ErrNoAck is returned by replay targets when a notify frame is not
+// acknowledged.
+var ErrNoAck = errors.New("spoe: no ack received")
+
+// ReplayTarget handles a recorded notify frame and returns the actions of
+// its ack.
+type ReplayTarget func(notify Record) ([]Action, error)
+
+// HandlerTarget replays frames into h. The actions are encoded and decoded
+// as an agent would, so they compare with recorded ones.
+func HandlerTarget(h Handler) ReplayTarget {
+	return func(notify Record) ([]Action, error) {
+		actions, err := h(notify.Messages())
+		if err != nil {
+			return nil, err
+		}
+
+		f := Frame{originalData: pool.Get(maxFrameSize)}
+		defer pool.Put(f.originalData)
+
+		err = encodeAck(&f, actions)
+		if err != nil {
+			return nil, errors.Wrap(err, "replay")
+		}
+		return DecodeActions(f.data)
+	}
+}
+
+// ReplayResult is the outcome of replaying a notify frame.
+type ReplayResult struct {
+	Notify Record
+	// Ack is the recorded ack, nil when the frame was not acknowledged.
+	Ack *Record
+
+	Actions []Action
+	Err     error
+	Latency time.Duration
+	// Diff lists the recorded actions missing from the replay, prefixed by
+	// "-", and the replayed actions not recorded, prefixed by "+".
+	Diff []string
+}
+
+type frameKey struct {
+	engineID string
+	streamID int
+	frameID  int
+}
+
+// Replay feeds the notify frames read from r to target and calls fn with
+// the result of each, in the order the acks were recorded. Frames which
+// were never acknowledged are replayed last. Replay stops at the end of the
+// recording, or on the first error returned by fn.
+func Replay(r *RecordReader, target ReplayTarget, fn func(ReplayResult) error) error {
+	pending := make(map[frameKey]Record)
+	var order []frameKey
+
+	replay := func(notify Record, ack *Record) error {
+		res := ReplayResult{Notify: notify, Ack: ack}
+
+		start := time.Now()
+		res.Actions, res.Err = target(notify)
+		res.Latency = time.Since(start)
+
+		if ack == nil {
+			if res.Err == nil {
+				res.Diff = append([]string{"- no ack"}, DiffActions(nil, res.Actions)...)
+			}
+			return fn(res)
+		}
+
+		recorded, err := ack.Actions()
+		if err != nil {
+			return errors.Wrapf(err, "replay: frame %d/%d", notify.StreamID, notify.FrameID)
+		}
+		if res.Err == nil {
+			res.Diff = DiffActions(recorded, res.Actions)
+		} else {
+			res.Diff = append(DiffActions(recorded, nil), "+ no ack")
+		}
+		return fn(res)
+	}
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		key := frameKey{rec.EngineID, rec.StreamID, rec.FrameID}
+		switch rec.Type {
+		case RecordNotify:
+			if old, ok := pending[key]; ok {
+				// the ids were reused before the previous frame was acked
+				err := replay(old, nil)
+				if err != nil {
+					return err
+				}
+			} else {
+				order = append(order, key)
+			}
+			pending[key] = rec
+
+		case RecordAck:
+			notify, ok := pending[key]
+			if !ok {
+				// the notify frame is in a previous file
+				continue
+			}
+			delete(pending, key)
+
+			ack := rec
+			err := replay(notify, &ack)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, key := range order {
+		notify, ok := pending[key]
+		if !ok {
+			continue
+		}
+		delete(pending, key)
+
+		err := replay(notify, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DiffActions compares two lists of actions regardless of their order. It
+// returns the actions only in a, prefixed by "-", then the actions only in
+// b, prefixed by "+".
+func DiffActions(a, b []Action) []string {
+	count := make(map[string]int)
+	for _, action := range a {
+		count[formatAction(action)]++
+	}
+	for _, action := range b {
+		count[formatAction(action)]--
+	}
+
+	var removed, added []string
+	for s, n := range count {
+		for ; n > 0; n-- {
+			removed = append(removed, "- "+s)
+		}
+		for ; n < 0; n++ {
+			added = append(added, "+ "+s)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+
+	return append(removed, added...)
+}
+
+func formatAction(a Action) string {
+	switch a := a.(type) {
+	case ActionSetVar:
+		return fmt.Sprintf("set-var %s.%s=%s", a.Scope, a.Name, formatValue(a.Value))
+	case ActionUnsetVar:
+		return fmt.Sprintf("unset-var %s.%s", a.Scope, a.Name)
+	}
+	return fmt.Sprintf("%T %+v", a, a)
+}
+
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", val)
+	case []byte:
+		return fmt.Sprintf("bin:%x", val)
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T:%v", v, v)
+}
+
+// ReplayClient replays frames to a running agent, as HAProxy would send
+// them. Frames are sent one at a time on a single connection, so all of
+// them are seen by the agent as coming from one engine.
+type ReplayClient struct {
+	conn net.Conn
+	cod  *codec
+}
+
+// DialReplay connects to the agent at addr and sends a hello announcing
+// engineID. timeout bounds the wait for each ack.
+func DialReplay(network, addr, engineID string, timeout time.Duration) (*ReplayClient, error) {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "replay")
+	}
+
+	cfg := defaultConfig
+	cfg.IdleTimeout = timeout
+	cfg.ReadTimeout = timeout
+	cfg.WriteTimeout = timeout
+
+	c := &ReplayClient{
+		conn: conn,
+		cod:  newCodec(conn, cfg),
+	}
+
+	err = c.hello(engineID)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ReplayClient) hello(engineID string) error {
+	f := Frame{
+		ftype: frameTypeHaproxyHello,
+		flags: frameFlagFin,
+		data:  make([]byte, maxFrameSize),
+	}
+
+	off := 0
+	for _, kv := range []struct {
+		name  string
+		value interface{}
+	}{
+		{helloKeySupportedVersions, version},
+		{helloKeyMaxFrameSize, uint(maxFrameSize)},
+		{helloKeyCapabilities, capabilityPipelining},
+		{helloKeyEngineID, engineID},
+	} {
+		n, err := encodeKV(f.data[off:], kv.name, kv.value)
+		if err != nil {
+			return errors.Wrap(err, "replay hello")
+		}
+		off += n
+	}
+	f.data = f.data[:off]
+
+	err := c.cod.encodeFrame(f)
+	if err != nil {
+		return errors.Wrap(err, "replay hello")
+	}
+
+	res, err := c.read()
+	if err != nil {
+		return errors.Wrap(err, "replay hello")
+	}
+	defer pool.Put(res.originalData)
+
+	if res.ftype != frameTypeAgentHello {
+		return fmt.Errorf("replay hello: unexpected frame type %d", res.ftype)
+	}
+	return nil
+}
+
+// Notify sends a recorded notify frame, with its stream and frame ids, and
+// returns the actions of the ack. It returns ErrNoAck when no ack is
+// received before the timeout.
+func (c *ReplayClient) Notify(notify Record) ([]Action, error) {
+	err := c.cod.encodeFrame(Frame{
+		ftype:    frameTypeHaproxyNotify,
+		flags:    frameFlagFin,
+		streamID: notify.StreamID,
+		frameID:  notify.FrameID,
+		data:     notify.Data,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "replay")
+	}
+
+	for {
+		res, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+
+		if res.ftype != frameTypeAgentACK {
+			pool.Put(res.originalData)
+			return nil, fmt.Errorf("replay: unexpected frame type %d", res.ftype)
+		}
+		if res.streamID != notify.StreamID || res.frameID != notify.FrameID {
+			// late ack of a frame which timed out
+			pool.Put(res.originalData)
+			continue
+		}
+
+		actions, err := DecodeActions(res.data)
+		pool.Put(res.originalData)
+		return actions, err
+	}
+}
+
+// read returns the next frame, turning disconnect frames into errors.
+func (c *ReplayClient) read() (Frame, error) {
+	var f Frame
+	ok, err := c.cod.decodeFrame(&f)
+	if err != nil {
+		return f, err
+	}
+	if !ok {
+		pool.Put(f.originalData)
+		return f, ErrNoAck
+	}
+
+	if f.ftype == frameTypeAgentDiscon {
+		defer pool.Put(f.originalData)
+
+		data, _, err := decodeKVs(f.data, -1)
+		if err != nil {
+			return f, errors.Wrap(err, "replay")
+		}
+		message, _ := data["message"].(string)
+		code, _ := data["status-code"].(int)
+		return f, &DisconnectError{Code: ErrorCode(code), Message: message}
+	}
+
+	return f, nil
+}
+
+func (c *ReplayClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,168 @@
+package spoe
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeActions(t *testing.T) {
+	actions := []Action{
+		ActionSetVar{Name: "int", Scope: VarScopeTransaction, Value: 42},
+		ActionSetVar{Name: "str", Scope: VarScopeSession, Value: "value"},
+		ActionSetVar{Name: "ip", Scope: VarScopeRequest, Value: net.ParseIP("192.0.2.1").To4()},
+		ActionUnsetVar{Name: "old", Scope: VarScopeProcess},
+	}
+
+	f := Frame{originalData: make([]byte, 1024)}
+	require.NoError(t, encodeAck(&f, actions))
+
+	decoded, err := DecodeActions(f.data)
+	require.NoError(t, err)
+	require.Equal(t, actions, decoded)
+
+	_, err = DecodeActions(f.data[:len(f.data)-1])
+	require.Error(t, err)
+	_, err = DecodeActions([]byte{9, 0, 0})
+	require.Error(t, err)
+}
+
+func TestDiffActions(t *testing.T) {
+	a := []Action{
+		ActionSetVar{Name: "score", Scope: VarScopeTransaction, Value: 1},
+		ActionSetVar{Name: "tag", Scope: VarScopeTransaction, Value: "a"},
+		ActionUnsetVar{Name: "x", Scope: VarScopeRequest},
+	}
+	b := []Action{
+		ActionUnsetVar{Name: "x", Scope: VarScopeRequest},
+		ActionSetVar{Name: "score", Scope: VarScopeTransaction, Value: uint(1)},
+		ActionSetVar{Name: "tag", Scope: VarScopeTransaction, Value: "a"},
+	}
+
+	require.Empty(t, DiffActions(a, a))
+	require.Equal(t, []string{
+		`- set-var txn.score=int:1`,
+		`+ set-var txn.score=uint:1`,
+	}, DiffActions(a, b))
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spoe-replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recCfg := DefaultRecorderConfig
+	recCfg.Path = filepath.Join(dir, "spoe.rec")
+	recorder, err := NewRecorder(recCfg)
+	require.NoError(t, err)
+
+	handler := func(msgs *MessageIterator) ([]Action, error) {
+		var actions []Action
+		for msgs.Next() {
+			args := msgs.Message.Args.Map()
+			if args["fail"] == true {
+				return nil, errors.New("failing")
+			}
+			actions = append(actions, ActionSetVar{Name: msgs.Message.Name, Scope: VarScopeTransaction, Value: args["v"]})
+		}
+		return actions, nil
+	}
+
+	cfg := defaultConfig
+	cfg.Recorder = recorder
+	agent := NewWithConfig(handler, cfg)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	go agent.Serve(lis)
+
+	client, err := DialReplay("tcp", lis.Addr().String(), "engine-1", 100*time.Millisecond)
+	require.NoError(t, err)
+
+	notify := func(streamID int, name string, args ...interface{}) Record {
+		b := make([]byte, 1024)
+		n, err := encodeString(b, name)
+		require.NoError(t, err)
+		b[n] = byte(len(args) / 2)
+		n++
+		for i := 0; i < len(args); i += 2 {
+			m, err := encodeKV(b[n:], args[i].(string), args[i+1])
+			require.NoError(t, err)
+			n += m
+		}
+		return Record{Type: RecordNotify, StreamID: streamID, FrameID: 1, Data: b[:n]}
+	}
+
+	actions, err := client.Notify(notify(1, "first", "v", 1))
+	require.NoError(t, err)
+	require.Equal(t, []Action{ActionSetVar{Name: "first", Scope: VarScopeTransaction, Value: 1}}, actions)
+
+	_, err = client.Notify(notify(2, "second", "fail", true))
+	require.Equal(t, ErrNoAck, err)
+
+	_, err = client.Notify(notify(3, "third", "v", "x"))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	require.Eventually(t, func() bool {
+		require.NoError(t, recorder.Flush())
+		return len(readRecords(t, recCfg.Path)) == 5
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, recorder.Close())
+
+	records := readRecords(t, recCfg.Path)
+	require.Equal(t, RecordNotify, records[0].Type)
+	require.Equal(t, "engine-1", records[0].EngineID)
+	require.Equal(t, RecordAck, records[1].Type)
+	require.Equal(t, 1, records[1].StreamID)
+
+	replay := func(target ReplayTarget) []ReplayResult {
+		f, err := os.Open(recCfg.Path)
+		require.NoError(t, err)
+		defer f.Close()
+		r, err := NewRecordReader(f)
+		require.NoError(t, err)
+
+		var results []ReplayResult
+		require.NoError(t, Replay(r, target, func(res ReplayResult) error {
+			results = append(results, res)
+			return nil
+		}))
+		return results
+	}
+
+	// replaying into the same handler gives the same actions, unacked frames
+	// come last
+	results := replay(HandlerTarget(handler))
+	require.Len(t, results, 3)
+	for _, res := range results {
+		require.Empty(t, res.Diff)
+	}
+	require.Equal(t, 1, results[0].Notify.StreamID)
+	require.Equal(t, 3, results[1].Notify.StreamID)
+	require.Equal(t, 2, results[2].Notify.StreamID)
+	require.Nil(t, results[2].Ack)
+	require.Error(t, results[2].Err)
+
+	// and so does replaying to a running agent
+	client, err = DialReplay("tcp", lis.Addr().String(), "replay", 100*time.Millisecond)
+	require.NoError(t, err)
+	defer client.Close()
+	for _, res := range replay(client.Notify) {
+		require.Empty(t, res.Diff)
+	}
+
+	results = replay(HandlerTarget(func(msgs *MessageIterator) ([]Action, error) {
+		return []Action{ActionSetVar{Name: "first", Scope: VarScopeTransaction, Value: 2}}, nil
+	}))
+	require.Equal(t, []string{"- set-var txn.first=int:1", "+ set-var txn.first=int:2"}, results[0].Diff)
+	require.Equal(t, []string{"- set-var txn.third=\"x\"", "+ set-var txn.first=int:2"}, results[1].Diff)
+	require.Equal(t, []string{"- no ack", "+ set-var txn.first=int:2"}, results[2].Diff)
+}
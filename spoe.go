@@ -1,6 +1,7 @@
 package spoe
 
 import (
+	"context"
 	"net"
 	"sync"
 	"time"
@@ -23,13 +24,36 @@ type Config struct {
 	WriteTimeout   time.Duration
 	IdleTimeout    time.Duration
 	MaxConnections int
+
+	// HealthCheck is called when HAProxy sends a healthcheck hello. When it
+	// fails, the agent answers with a disconnect frame carrying the error
+	// instead of a hello, marking the agent as down. HealthCheckTimeout
+	// bounds each call, one second when zero.
+	HealthCheck        func(ctx context.Context) error
+	HealthCheckTimeout time.Duration
+	// RefuseWhenUnhealthy also runs HealthCheck on regular connections and
+	// refuses them while it fails.
+	RefuseWhenUnhealthy bool
+
+	// Observer, when set, is notified of connection, engine and frame events.
+	Observer Observer
+
+	// AsyncTimeout is the delay after which frames handled by an
+	// AsyncHandler are acknowledged with no actions. Zero disables it.
+	AsyncTimeout time.Duration
+
+	// Recorder, when set, records the notify frames received and the ack
+	// frames sent, for replay. It is not closed by the agent.
+	Recorder *Recorder
 }
 
 var defaultConfig = Config{
-	ReadTimeout:    time.Second,
-	WriteTimeout:   time.Second,
-	IdleTimeout:    30 * time.Second,
-	MaxConnections: 0,
+	ReadTimeout:        time.Second,
+	WriteTimeout:       time.Second,
+	IdleTimeout:        30 * time.Second,
+	MaxConnections:     0,
+	HealthCheckTimeout: time.Second,
+	AsyncTimeout:       time.Second,
 }
 
 type EngKey struct {
@@ -40,7 +64,9 @@ type EngKey struct {
 
 type Agent struct {
 	Handler Handler
-	cfg     Config
+	// AsyncHandler, when set, is used instead of Handler.
+	AsyncHandler AsyncHandler
+	cfg          Config
 
 	maxFrameSize int
 
@@ -52,11 +78,6 @@ func New(h Handler) *Agent {
 	return NewWithConfig(h, defaultConfig)
 }
 
-type Engine struct {
-	frames chan Frame
-	count  int32
-}
-
 func NewWithConfig(h Handler, cfg Config) *Agent {
 	return &Agent{
 		Handler: h,
@@ -103,12 +124,16 @@ func (a *Agent) Serve(lis net.Listener) error {
 
 		go func() {
 			c := &conn{
-				Conn:        c,
-				handler:     a.Handler,
-				cfg:         a.cfg,
-				notifyTasks: make(chan Frame),
+				Conn:         c,
+				handler:      a.Handler,
+				asyncHandler: a.AsyncHandler,
+				cfg:          a.cfg,
+				notifyTasks:  make(chan Frame),
 			}
+			observer := a.cfg.observer()
+			observer.OnConnect(c.Conn)
 			err := c.run(a)
+			observer.OnDisconnect(c.Conn, err)
 			if err != nil {
 				log.Warnf("spoe: error handling connection: %s", err)
 			}
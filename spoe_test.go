@@ -1,11 +1,17 @@
 package spoe
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	pool "github.com/libp2p/go-buffer-pool"
 	log "github.com/sirupsen/logrus"
@@ -147,3 +153,116 @@ func BenchmarkSPOE(b *testing.B) {
 		pool.Put(res.originalData)
 	}
 }
+
+func TestSPOEHealthCheck(t *testing.T) {
+	healthy := int32(1)
+	cfg := defaultConfig
+	cfg.RefuseWhenUnhealthy = true
+	cfg.HealthCheck = func(ctx context.Context) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return errors.New("database is down")
+		}
+		return nil
+	}
+
+	spoa := NewWithConfig(func(msgs *MessageIterator) ([]Action, error) {
+		return nil, nil
+	}, cfg)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	go spoa.Serve(lis)
+
+	hello := func(req Frame) Frame {
+		client, err := net.Dial("tcp", lis.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+
+		cod := newCodec(client, defaultConfig)
+		require.NoError(t, cod.encodeFrame(req))
+
+		res := Frame{}
+		ok, err := cod.decodeFrame(&res)
+		require.True(t, ok)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := hello(healthcheckHelloFrame(t))
+	require.Equal(t, frameTypeAgentHello, res.ftype)
+
+	atomic.StoreInt32(&healthy, 0)
+
+	res = hello(healthcheckHelloFrame(t))
+	require.Equal(t, frameTypeAgentDiscon, res.ftype)
+	data, _, err := decodeKVs(res.data, -1)
+	require.NoError(t, err)
+	require.Equal(t, int(ErrorUnknown), data["status-code"])
+	require.Equal(t, "healthcheck: database is down", data["message"])
+
+	res = hello(helloFrame(t))
+	require.Equal(t, frameTypeAgentDiscon, res.ftype)
+}
+
+func TestHealthCheckTimeoutDefault(t *testing.T) {
+	c := &conn{cfg: Config{
+		HealthCheck: func(ctx context.Context) error {
+			deadline, ok := ctx.Deadline()
+			if !ok || time.Until(deadline) > defaultConfig.HealthCheckTimeout {
+				return errors.New("no deadline")
+			}
+			return nil
+		},
+	}}
+	require.NoError(t, c.checkHealth())
+}
+
+func TestDisconnectFrameTruncation(t *testing.T) {
+	c := &conn{frameSize: maxFrameSize}
+
+	f, err := c.disconnectFrame(ErrorUnknown, strings.Repeat("é", 200))
+	require.NoError(t, err)
+	data, _, err := decodeKVs(f.data, -1)
+	require.NoError(t, err)
+
+	message := data["message"].(string)
+	require.Equal(t, strings.Repeat("é", 127), message)
+	require.True(t, utf8.ValidString(message))
+}
+
+func TestSPOEHandlerDisconnect(t *testing.T) {
+	spoa := New(func(msgs *MessageIterator) ([]Action, error) {
+		return nil, &DisconnectError{Code: ErrorRes, Message: "out of memory"}
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	go spoa.Serve(lis)
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	cod := newCodec(client, defaultConfig)
+
+	require.NoError(t, cod.encodeFrame(helloFrame(t)))
+	res := Frame{}
+	ok, err := cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	require.NoError(t, cod.encodeFrame(notifyFrame(t)))
+	ok, err = cod.decodeFrame(&res)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	require.Equal(t, frameTypeAgentDiscon, res.ftype)
+	data, _, err := decodeKVs(res.data, -1)
+	require.NoError(t, err)
+	require.Equal(t, int(ErrorRes), data["status-code"])
+	require.Equal(t, "out of memory", data["message"])
+}
@@ -0,0 +1,338 @@
+// Package spoeconf parses HAProxy SPOE configuration files, the files given
+// to the config parameter of "filter spoe".
+//
+// Only the directives describing the exchanged data are kept: the messages
+// and groups of agents, their variable options, and the args and events of
+// messages. Other directives are ignored.
+package spoeconf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type Config struct {
+	Agents   []*Agent
+	Messages []*Message
+	Groups   []*Group
+}
+
+type Agent struct {
+	// Scope is the section of the file the agent is declared in, the
+	// engine name of the spoe filter, without brackets.
+	Scope string
+	Name  string
+	Line  int
+
+	Messages []string
+	Groups   []string
+
+	// VarPrefix is the value of "option var-prefix", empty when unset.
+	VarPrefix        string
+	ForceSetVar      bool
+	RegisterVarNames []string
+	// SetOnError and SetProcessTime name the variables HAProxy sets
+	// itself, empty when unset.
+	SetOnError     string
+	SetProcessTime string
+}
+
+// Prefix returns the prefix of the variables set by the agent. It defaults to
+// the agent name.
+func (a *Agent) Prefix() string {
+	if a.VarPrefix != "" {
+		return a.VarPrefix
+	}
+	return a.Name
+}
+
+type Message struct {
+	Scope string
+	Name  string
+	Line  int
+
+	Args []Arg
+	// Event is the event triggering the message, empty for messages only
+	// sent through groups, and Condition its optional if or unless
+	// condition.
+	Event     string
+	Condition string
+}
+
+// Arg is an arg of a message. Unnamed args have an empty name.
+type Arg struct {
+	Name   string
+	Sample string
+}
+
+type Group struct {
+	Scope    string
+	Name     string
+	Line     int
+	Messages []string
+}
+
+// Message returns the message named name in scope.
+func (c *Config) Message(scope, name string) (*Message, bool) {
+	for _, m := range c.Messages {
+		if m.Scope == scope && m.Name == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Group returns the group named name in scope.
+func (c *Config) Group(scope, name string) (*Group, bool) {
+	for _, g := range c.Groups {
+		if g.Scope == scope && g.Name == name {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// AgentMessages returns the messages an agent receives, directly or through
+// its groups, in declaration order and without duplicates.
+func (c *Config) AgentMessages(a *Agent) ([]*Message, error) {
+	var res []*Message
+	seen := make(map[string]bool)
+
+	add := func(name string) error {
+		if seen[name] {
+			return nil
+		}
+		m, ok := c.Message(a.Scope, name)
+		if !ok {
+			return fmt.Errorf("spoeconf: agent %s: unknown message %s", a.Name, name)
+		}
+		seen[name] = true
+		res = append(res, m)
+		return nil
+	}
+
+	for _, name := range a.Messages {
+		err := add(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range a.Groups {
+		g, ok := c.Group(a.Scope, name)
+		if !ok {
+			return nil, fmt.Errorf("spoeconf: agent %s: unknown group %s", a.Name, name)
+		}
+		for _, m := range g.Messages {
+			err := add(m)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func ParseFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("spoeconf: %s", err)
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+func Parse(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+	scope := ""
+
+	var agent *Agent
+	var message *Message
+	var group *Group
+
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		words, err := split(s.Text())
+		if err != nil {
+			return nil, fmt.Errorf("spoeconf: line %d: %s", line, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		errorf := func(format string, args ...interface{}) error {
+			return fmt.Errorf("spoeconf: line %d: "+format, append([]interface{}{line}, args...)...)
+		}
+
+		if strings.HasPrefix(words[0], "[") {
+			if len(words) != 1 || !strings.HasSuffix(words[0], "]") || len(words[0]) < 3 {
+				return nil, errorf("invalid scope %s", strings.Join(words, " "))
+			}
+			scope = words[0][1 : len(words[0])-1]
+			agent, message, group = nil, nil, nil
+			continue
+		}
+
+		switch words[0] {
+		case "spoe-agent", "spoe-message", "spoe-group":
+			if len(words) != 2 {
+				return nil, errorf("%s expects a name", words[0])
+			}
+			agent, message, group = nil, nil, nil
+			switch words[0] {
+			case "spoe-agent":
+				agent = &Agent{Scope: scope, Name: words[1], Line: line}
+				cfg.Agents = append(cfg.Agents, agent)
+			case "spoe-message":
+				if _, ok := cfg.Message(scope, words[1]); ok {
+					return nil, errorf("duplicate message %s", words[1])
+				}
+				message = &Message{Scope: scope, Name: words[1], Line: line}
+				cfg.Messages = append(cfg.Messages, message)
+			case "spoe-group":
+				if _, ok := cfg.Group(scope, words[1]); ok {
+					return nil, errorf("duplicate group %s", words[1])
+				}
+				group = &Group{Scope: scope, Name: words[1], Line: line}
+				cfg.Groups = append(cfg.Groups, group)
+			}
+			continue
+		}
+
+		switch {
+		case agent != nil:
+			err = parseAgent(agent, words)
+		case message != nil:
+			err = parseMessage(message, words)
+		case group != nil:
+			if words[0] == "messages" {
+				group.Messages = append(group.Messages, words[1:]...)
+			}
+		default:
+			err = fmt.Errorf("%s outside of a section", words[0])
+		}
+		if err != nil {
+			return nil, errorf("%s", err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("spoeconf: %s", err)
+	}
+
+	return cfg, nil
+}
+
+func parseAgent(a *Agent, words []string) error {
+	switch words[0] {
+	case "messages":
+		a.Messages = append(a.Messages, words[1:]...)
+	case "groups":
+		a.Groups = append(a.Groups, words[1:]...)
+	case "register-var-names":
+		a.RegisterVarNames = append(a.RegisterVarNames, words[1:]...)
+	case "option":
+		if len(words) < 2 {
+			return fmt.Errorf("option expects a name")
+		}
+		value := func() (string, error) {
+			if len(words) != 3 {
+				return "", fmt.Errorf("option %s expects a value", words[1])
+			}
+			return words[2], nil
+		}
+
+		var err error
+		switch words[1] {
+		case "var-prefix":
+			a.VarPrefix, err = value()
+		case "set-on-error":
+			a.SetOnError, err = value()
+		case "set-process-time":
+			a.SetProcessTime, err = value()
+		case "force-set-var":
+			a.ForceSetVar = true
+		}
+		return err
+	}
+	return nil
+}
+
+func parseMessage(m *Message, words []string) error {
+	switch words[0] {
+	case "args":
+		for _, w := range words[1:] {
+			arg := Arg{Sample: w}
+			// the sample may contain = in its parameters
+			if i := strings.IndexByte(w, '='); i >= 0 && !strings.ContainsAny(w[:i], "(,") {
+				arg.Name, arg.Sample = w[:i], w[i+1:]
+			}
+			if arg.Sample == "" {
+				return fmt.Errorf("arg %s has no sample", arg.Name)
+			}
+			m.Args = append(m.Args, arg)
+		}
+	case "event":
+		if len(words) < 2 {
+			return fmt.Errorf("event expects a name")
+		}
+		m.Event = words[1]
+		m.Condition = strings.Join(words[2:], " ")
+	}
+	return nil
+}
+
+// split cuts a line in words, handling quotes, backslash escapes and
+// comments like HAProxy.
+func split(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' && i+1 < len(line) {
+				i++
+				word.WriteByte(line[i])
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case c == '#':
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
@@ -0,0 +1,111 @@
+package spoeconf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+# global comment
+[ip-reputation]
+spoe-agent iprep-agent
+    messages check-client-ip   # trailing comment
+    groups   on-demand
+    option   var-prefix iprep
+    option   force-set-var
+    option   set-on-error error
+    register-var-names score tags
+    timeout  processing 10ms
+
+spoe-message check-client-ip
+    args ip=src "ua=req.hdr(user-agent)" req.hdrs_bin
+    event on-client-session if ! { src -f /etc/haproxy/whitelist.lst }
+
+spoe-message check-body
+    args body=req.body
+
+spoe-group on-demand
+    messages check-body
+
+[other]
+spoe-agent other-agent
+    messages check-client-ip
+
+spoe-message check-client-ip
+    args src
+    event on-frontend-http-request
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(testConfig))
+	require.NoError(t, err)
+
+	require.Len(t, cfg.Agents, 2)
+	require.Equal(t, &Agent{
+		Scope:            "ip-reputation",
+		Name:             "iprep-agent",
+		Line:             4,
+		Messages:         []string{"check-client-ip"},
+		Groups:           []string{"on-demand"},
+		VarPrefix:        "iprep",
+		ForceSetVar:      true,
+		RegisterVarNames: []string{"score", "tags"},
+		SetOnError:       "error",
+	}, cfg.Agents[0])
+	require.Equal(t, "iprep", cfg.Agents[0].Prefix())
+	require.Equal(t, "other-agent", cfg.Agents[1].Prefix())
+
+	m, ok := cfg.Message("ip-reputation", "check-client-ip")
+	require.True(t, ok)
+	require.Equal(t, &Message{
+		Scope: "ip-reputation",
+		Name:  "check-client-ip",
+		Line:  13,
+		Args: []Arg{
+			{Name: "ip", Sample: "src"},
+			{Name: "ua", Sample: "req.hdr(user-agent)"},
+			{Sample: "req.hdrs_bin"},
+		},
+		Event:     "on-client-session",
+		Condition: "if ! { src -f /etc/haproxy/whitelist.lst }",
+	}, m)
+
+	m, ok = cfg.Message("other", "check-client-ip")
+	require.True(t, ok)
+	require.Equal(t, []Arg{{Sample: "src"}}, m.Args)
+
+	msgs, err := cfg.AgentMessages(cfg.Agents[0])
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "check-client-ip", msgs[0].Name)
+	require.Equal(t, "check-body", msgs[1].Name)
+
+	cfg.Agents[1].Groups = []string{"on-demand"}
+	_, err = cfg.AgentMessages(cfg.Agents[1])
+	require.EqualError(t, err, "spoeconf: agent other-agent: unknown group on-demand")
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"messages a":                             "spoeconf: line 1: messages outside of a section",
+		"spoe-agent":                             "spoeconf: line 1: spoe-agent expects a name",
+		"spoe-message m\nspoe-message m":         "spoeconf: line 2: duplicate message m",
+		"spoe-agent a\noption var-prefix":        "spoeconf: line 2: option var-prefix expects a value",
+		"spoe-message m\nargs a=":                "spoeconf: line 2: arg a has no sample",
+		"spoe-message m\nargs \"a=src":           "spoeconf: line 2: unterminated quote",
+		"[scope":                                 "spoeconf: line 1: invalid scope [scope",
+		"spoe-group g\nmessages a\nspoe-group g": "spoeconf: line 3: duplicate group g",
+	}
+	for config, msg := range tests {
+		_, err := Parse(strings.NewReader(config))
+		require.EqualError(t, err, msg, config)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	words, err := split(`args a="x y" b='c#d' e\ f # comment`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"args", "a=x y", "b=c#d", "e f"}, words)
+}
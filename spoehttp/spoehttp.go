@@ -0,0 +1,236 @@
+// Package spoehttp exposes the HTTP parts of SPOE messages (headers,
+// cookies, query string, form and JSON bodies), decoding each of them only
+// when first requested.
+//
+// A Request references the message args it was built from, so it must not
+// be used after the handler returns.
+package spoehttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+)
+
+var (
+	ErrNotJSON         = errors.New("spoehttp: content type is not JSON")
+	ErrBodyTooLarge    = errors.New("spoehttp: body too large")
+	ErrMissingHeaders  = errors.New("spoehttp: headers arg not found")
+	errMultipleJSONDoc = errors.New("spoehttp: body contains more than one JSON value")
+)
+
+type Request struct {
+	args  map[string]interface{}
+	names spoe.RequestArgNames
+
+	header    http.Header
+	headerErr error
+	headerOK  bool
+
+	query    url.Values
+	queryErr error
+	queryOK  bool
+
+	form    url.Values
+	formErr error
+	formOK  bool
+}
+
+// NewRequest wraps message args using spoe.DefaultRequestArgNames.
+func NewRequest(args map[string]interface{}) *Request {
+	return NewRequestWithNames(args, spoe.DefaultRequestArgNames)
+}
+
+func NewRequestWithNames(args map[string]interface{}, names spoe.RequestArgNames) *Request {
+	return &Request{
+		args:  args,
+		names: names,
+	}
+}
+
+func (r *Request) Method() string {
+	method, _ := r.argString(r.names.Method)
+	return method
+}
+
+func (r *Request) Path() string {
+	path, _ := r.argString(r.names.Path)
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+func (r *Request) Header() (http.Header, error) {
+	if r.headerOK {
+		return r.header, r.headerErr
+	}
+	r.headerOK = true
+
+	hdrs, ok := r.argBytes(r.names.Headers)
+	if !ok {
+		r.headerErr = ErrMissingHeaders
+		return nil, r.headerErr
+	}
+
+	r.header, r.headerErr = spoe.DecodeHeaders(hdrs)
+	return r.header, r.headerErr
+}
+
+// ContentType returns the media type of the request, without parameters.
+func (r *Request) ContentType() (string, error) {
+	h, err := r.Header()
+	if err != nil {
+		return "", err
+	}
+
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		return "", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", fmt.Errorf("spoehttp: content type: %s", err)
+	}
+	return mediaType, nil
+}
+
+func (r *Request) Cookies() ([]*http.Cookie, error) {
+	h, err := r.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	return (&http.Request{Header: h}).Cookies(), nil
+}
+
+// Cookie returns the named cookie, or http.ErrNoCookie.
+func (r *Request) Cookie(name string) (*http.Cookie, error) {
+	h, err := r.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	return (&http.Request{Header: h}).Cookie(name)
+}
+
+// Query returns the query string parameters, read from the query arg or
+// from the path arg when it contains one.
+func (r *Request) Query() (url.Values, error) {
+	if r.queryOK {
+		return r.query, r.queryErr
+	}
+	r.queryOK = true
+
+	query, ok := r.argString(r.names.Query)
+	if !ok {
+		path, _ := r.argString(r.names.Path)
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			query = path[i+1:]
+		}
+	}
+
+	r.query, r.queryErr = url.ParseQuery(query)
+	if r.queryErr != nil {
+		r.queryErr = fmt.Errorf("spoehttp: query: %s", r.queryErr)
+	}
+	return r.query, r.queryErr
+}
+
+// Form returns the values of an application/x-www-form-urlencoded body.
+// Bodies of other content types yield no values.
+func (r *Request) Form() (url.Values, error) {
+	if r.formOK {
+		return r.form, r.formErr
+	}
+	r.formOK = true
+	r.form = make(url.Values)
+
+	ct, err := r.ContentType()
+	if err != nil {
+		r.formErr = err
+		return nil, err
+	}
+	if ct != "application/x-www-form-urlencoded" {
+		return r.form, nil
+	}
+
+	r.form, r.formErr = url.ParseQuery(string(r.Body()))
+	if r.formErr != nil {
+		r.formErr = fmt.Errorf("spoehttp: form: %s", r.formErr)
+	}
+	return r.form, r.formErr
+}
+
+// Body returns the raw request body, which aliases the message data when
+// the arg is binary.
+func (r *Request) Body() []byte {
+	body, _ := r.argBytes(r.names.Body)
+	return body
+}
+
+// DecodeJSON decodes a JSON body into v. It fails with ErrNotJSON when the
+// content type is not JSON and with ErrBodyTooLarge when the body exceeds
+// maxSize bytes.
+func (r *Request) DecodeJSON(v interface{}, maxSize int) error {
+	ct, err := r.ContentType()
+	if err != nil {
+		return err
+	}
+	if ct != "application/json" && !strings.HasSuffix(ct, "+json") {
+		return ErrNotJSON
+	}
+
+	body := r.Body()
+	if len(body) > maxSize {
+		return ErrBodyTooLarge
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	err = dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("spoehttp: json: %s", err)
+	}
+	if dec.More() {
+		return errMultipleJSONDoc
+	}
+	return nil
+}
+
+// argString and argBytes accept both strings and binaries, as
+// spoe.RequestFromArgs does.
+func (r *Request) argString(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+
+	switch v := r.args[name].(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+func (r *Request) argBytes(name string) ([]byte, bool) {
+	if name == "" {
+		return nil, false
+	}
+
+	switch v := r.args[name].(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
@@ -0,0 +1,132 @@
+package spoehttp
+
+import (
+	"net/http"
+	"testing"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/stretchr/testify/require"
+)
+
+func args(t *testing.T, h http.Header, path string, body string) map[string]interface{} {
+	hdrs, err := spoe.EncodeHeaders(h)
+	require.NoError(t, err)
+
+	return map[string]interface{}{
+		"method":       "POST",
+		"path":         path,
+		"req.hdrs_bin": hdrs,
+		"req.body":     []byte(body),
+	}
+}
+
+func TestCookiesAndQuery(t *testing.T) {
+	h := http.Header{}
+	h.Set("Cookie", "session=abc; theme=dark")
+
+	r := NewRequest(args(t, h, "/search?q=go&page=2", ""))
+
+	require.Equal(t, "/search", r.Path())
+	require.Equal(t, "POST", r.Method())
+
+	cookies, err := r.Cookies()
+	require.NoError(t, err)
+	require.Len(t, cookies, 2)
+
+	c, err := r.Cookie("theme")
+	require.NoError(t, err)
+	require.Equal(t, "dark", c.Value)
+
+	_, err = r.Cookie("missing")
+	require.Equal(t, http.ErrNoCookie, err)
+
+	q, err := r.Query()
+	require.NoError(t, err)
+	require.Equal(t, "go", q.Get("q"))
+	require.Equal(t, "2", q.Get("page"))
+
+	// the query arg takes precedence over the path
+	a := args(t, h, "/search?q=go", "")
+	a["query"] = "q=rust"
+	q, err = NewRequest(a).Query()
+	require.NoError(t, err)
+	require.Equal(t, "rust", q.Get("q"))
+}
+
+func TestForm(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	r := NewRequest(args(t, h, "/login", "user=bob&pass=secret"))
+	form, err := r.Form()
+	require.NoError(t, err)
+	require.Equal(t, "bob", form.Get("user"))
+
+	h.Set("Content-Type", "text/plain")
+	form, err = NewRequest(args(t, h, "/login", "user=bob")).Form()
+	require.NoError(t, err)
+	require.Empty(t, form)
+}
+
+func TestDecodeJSON(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+
+	var v struct {
+		Name string `json:"name"`
+	}
+
+	r := NewRequest(args(t, h, "/", `{"name":"bob"}`))
+	require.NoError(t, r.DecodeJSON(&v, 1024))
+	require.Equal(t, "bob", v.Name)
+
+	require.Equal(t, ErrBodyTooLarge, r.DecodeJSON(&v, 4))
+
+	r = NewRequest(args(t, h, "/", `{"name":"bob"} {}`))
+	require.Error(t, r.DecodeJSON(&v, 1024))
+
+	h.Set("Content-Type", "application/problem+json")
+	r = NewRequest(args(t, h, "/", `{"name":"alice"}`))
+	require.NoError(t, r.DecodeJSON(&v, 1024))
+	require.Equal(t, "alice", v.Name)
+
+	h.Set("Content-Type", "text/html")
+	r = NewRequest(args(t, h, "/", `{}`))
+	require.Equal(t, ErrNotJSON, r.DecodeJSON(&v, 1024))
+}
+
+func TestMissingHeaders(t *testing.T) {
+	r := NewRequest(map[string]interface{}{})
+
+	_, err := r.Header()
+	require.Equal(t, ErrMissingHeaders, err)
+	_, err = r.Cookies()
+	require.Equal(t, ErrMissingHeaders, err)
+}
+
+func TestArgTypes(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "application/x-www-form-urlencoded")
+	hdrs, err := spoe.EncodeHeaders(h)
+	require.NoError(t, err)
+
+	// binaries and strings are accepted for every arg, as by spoe.RequestFromArgs
+	r := NewRequest(map[string]interface{}{
+		"method":       []byte("PUT"),
+		"path":         []byte("/items?id=1"),
+		"req.hdrs_bin": string(hdrs),
+		"req.body":     "name=foo",
+	})
+
+	require.Equal(t, "PUT", r.Method())
+	require.Equal(t, "/items", r.Path())
+	require.Equal(t, []byte("name=foo"), r.Body())
+
+	q, err := r.Query()
+	require.NoError(t, err)
+	require.Equal(t, "1", q.Get("id"))
+
+	form, err := r.Form()
+	require.NoError(t, err)
+	require.Equal(t, "foo", form.Get("name"))
+}
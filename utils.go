@@ -3,35 +3,129 @@ package spoe
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
 func DecodeHeaders(headers []byte) (http.Header, error) {
 	res := make(http.Header)
-	pos := 0
-	for pos < len(headers) {
-		key, n, err := decodeString(headers[pos:])
-		if err != nil {
-			return nil, errors.Wrap(err, "error decoding headers")
+	i := NewHeaderIterator(headers)
+	for i.Next() {
+		res.Add(i.Name, i.Value)
+	}
+	if i.Error() != nil {
+		return nil, i.Error()
+	}
+
+	return res, nil
+}
+
+// EncodeHeaders encodes headers in the binary format HAProxy uses for the
+// req.hdrs_bin and res.hdrs_bin samples, including the terminating empty
+// header. Header names are lower-cased, as HAProxy sends them.
+func EncodeHeaders(headers http.Header) ([]byte, error) {
+	keys := make([]string, 0, len(headers))
+	size := 2
+	for k, vs := range headers {
+		keys = append(keys, k)
+		for _, v := range vs {
+			size += len(k) + len(v) + 2*maxVarintLen
 		}
-		pos += n
+	}
+	sort.Strings(keys)
 
-		value, n, err := decodeString(headers[pos:])
-		if err != nil {
-			return nil, errors.Wrap(err, "error decoding headers")
+	b := make([]byte, size)
+	pos := 0
+	for _, k := range keys {
+		name := strings.ToLower(k)
+		if name == "" {
+			return nil, fmt.Errorf("error encoding headers: empty header name")
 		}
-		pos += n
+		for _, v := range headers[k] {
+			n, err := encodeString(b[pos:], name)
+			if err != nil {
+				return nil, errors.Wrap(err, "error encoding headers")
+			}
+			pos += n
 
-		if key == "" && value == "" {
-			if pos != len(headers) {
-				return nil, fmt.Errorf("error decoding headers: received empty values before end of buffer")
+			n, err = encodeString(b[pos:], v)
+			if err != nil {
+				return nil, errors.Wrap(err, "error encoding headers")
 			}
-			break
+			pos += n
 		}
+	}
+
+	// termination sequence
+	b[pos] = 0
+	b[pos+1] = 0
+	pos += 2
+
+	return b[:pos], nil
+}
+
+// HeaderIterator walks headers encoded in HAProxy's binary format without
+// building an http.Header.
+type HeaderIterator struct {
+	b   []byte
+	err error
+
+	Name  string
+	Value string
+}
 
-		res.Add(key, value)
+func NewHeaderIterator(headers []byte) *HeaderIterator {
+	return &HeaderIterator{
+		b: headers,
 	}
+}
 
-	return res, nil
+func (i *HeaderIterator) Error() error {
+	return i.err
+}
+
+func (i *HeaderIterator) Next() bool {
+	if len(i.b) == 0 {
+		return false
+	}
+
+	key, n, err := decodeString(i.b)
+	if err != nil {
+		i.err = errors.Wrap(err, "error decoding headers")
+		return false
+	}
+	i.b = i.b[n:]
+
+	value, n, err := decodeString(i.b)
+	if err != nil {
+		i.err = errors.Wrap(err, "error decoding headers")
+		return false
+	}
+	i.b = i.b[n:]
+
+	if key == "" && value == "" {
+		if len(i.b) != 0 {
+			i.err = fmt.Errorf("error decoding headers: received empty values before end of buffer")
+		}
+		i.b = nil
+		return false
+	}
+
+	i.Name = key
+	i.Value = value
+	return true
+}
+
+// LookupHeader returns the first value of the header name, compared
+// case-insensitively, without decoding the other headers.
+func LookupHeader(headers []byte, name string) (string, bool, error) {
+	i := NewHeaderIterator(headers)
+	for i.Next() {
+		if strings.EqualFold(i.Name, name) {
+			return i.Value, true, nil
+		}
+	}
+	return "", false, i.Error()
 }
@@ -1,6 +1,8 @@
 package spoe
 
 import (
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -43,3 +45,56 @@ func TestDecodeHeaders(t *testing.T) {
 	require.Equal(t, "bar", res.Get("X-Foo"))
 	require.Equal(t, "bar2", res.Get("X-Foo2"))
 }
+
+func TestEncodeHeaders(t *testing.T) {
+	h := make(http.Header)
+	h.Add("X-Foo", "bar")
+	h.Add("X-Foo", "baz")
+	h.Set("Host", "example.com")
+	h.Set("X-Long", strings.Repeat("a", 300))
+
+	b, err := EncodeHeaders(h)
+	require.NoError(t, err)
+
+	// terminated by an empty name and value
+	require.Equal(t, []byte{0, 0}, b[len(b)-2:])
+
+	res, err := DecodeHeaders(b)
+	require.NoError(t, err)
+	require.Equal(t, h, res)
+
+	b, err = EncodeHeaders(http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0}, b)
+}
+
+func TestHeaderIterator(t *testing.T) {
+	h := make(http.Header)
+	h.Set("Authorization", "Bearer foo")
+	h.Set("User-Agent", "test")
+
+	b, err := EncodeHeaders(h)
+	require.NoError(t, err)
+
+	i := NewHeaderIterator(b)
+	require.True(t, i.Next())
+	require.Equal(t, "authorization", i.Name)
+	require.Equal(t, "Bearer foo", i.Value)
+	require.True(t, i.Next())
+	require.Equal(t, "user-agent", i.Name)
+	require.False(t, i.Next())
+	require.NoError(t, i.Error())
+
+	v, ok, err := LookupHeader(b, "User-Agent")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "test", v)
+
+	_, ok, err = LookupHeader(b, "Cookie")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// data after the termination sequence
+	_, _, err = LookupHeader(append([]byte{0, 0}, b...), "Cookie")
+	require.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package spoe
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Vars builds the actions setting and unsetting variables:
+//
+//	actions, err := spoe.NewVars().
+//		Txn("score", 5).
+//		Sess("user", "bob").
+//		Unset(spoe.Req, "x").
+//		Actions()
+//
+// Names are checked against the characters HAProxy allows in variable
+// names. The first invalid name is reported by Err and Actions, the
+// following calls are then ignored.
+type Vars struct {
+	prefix  string
+	actions []Action
+	err     error
+}
+
+func NewVars() *Vars {
+	return &Vars{}
+}
+
+// NewVarsWithPrefix returns a builder knowing the prefix HAProxy inserts
+// between the scope and the name: the var-prefix of the agent, or its id when
+// var-prefix is unset, as given by spoeconf.Agent.Prefix. It is only used to
+// give full names for logging, the names sent to HAProxy never include it.
+func NewVarsWithPrefix(prefix string) *Vars {
+	return &Vars{prefix: prefix}
+}
+
+func (v *Vars) Set(scope VarScope, name string, value interface{}) *Vars {
+	if v.check(name) {
+		v.actions = append(v.actions, ActionSetVar{Name: name, Scope: scope, Value: value})
+	}
+	return v
+}
+
+func (v *Vars) Unset(scope VarScope, name string) *Vars {
+	if v.check(name) {
+		v.actions = append(v.actions, ActionUnsetVar{Name: name, Scope: scope})
+	}
+	return v
+}
+
+func (v *Vars) Proc(name string, value interface{}) *Vars {
+	return v.Set(VarScopeProcess, name, value)
+}
+
+func (v *Vars) Sess(name string, value interface{}) *Vars {
+	return v.Set(VarScopeSession, name, value)
+}
+
+func (v *Vars) Txn(name string, value interface{}) *Vars {
+	return v.Set(VarScopeTransaction, name, value)
+}
+
+func (v *Vars) Req(name string, value interface{}) *Vars {
+	return v.Set(VarScopeRequest, name, value)
+}
+
+func (v *Vars) Res(name string, value interface{}) *Vars {
+	return v.Set(VarScopeResponse, name, value)
+}
+
+func (v *Vars) Err() error {
+	return v.err
+}
+
+func (v *Vars) Actions() ([]Action, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+	return v.actions, nil
+}
+
+// FullName returns the name HAProxy gives a variable, such as
+// txn.prefix.name. HAProxy always inserts a prefix: builders created by
+// NewVars do not know it and return scope.name, which is not a name HAProxy
+// uses.
+func (v *Vars) FullName(scope VarScope, name string) string {
+	return fullVarName(scope, v.prefix, name)
+}
+
+// String lists the variables by full name, for logging.
+func (v *Vars) String() string {
+	parts := make([]string, 0, len(v.actions))
+	for _, a := range v.actions {
+		switch a := a.(type) {
+		case ActionSetVar:
+			parts = append(parts, fmt.Sprintf("%s=%v", v.FullName(a.Scope, a.Name), a.Value))
+		case ActionUnsetVar:
+			parts = append(parts, fmt.Sprintf("unset %s", v.FullName(a.Scope, a.Name)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (v *Vars) check(name string) bool {
+	if v.err != nil {
+		return false
+	}
+	if !validVarName(name) {
+		v.err = fmt.Errorf("spoe: invalid variable name %q", name)
+		return false
+	}
+	return true
+}
+
+// validVarName reports whether HAProxy accepts name in variable names.
+func validVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func fullVarName(scope VarScope, prefix, name string) string {
+	if prefix == "" {
+		return scope.String() + "." + name
+	}
+	return scope.String() + "." + prefix + "." + name
+}
@@ -0,0 +1,52 @@
+package spoe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVars(t *testing.T) {
+	vars := NewVarsWithPrefix("iprep").
+		Txn("score", 5).
+		Sess("user", "bob").
+		Proc("hits", 1).
+		Req("path.len", 3).
+		Res("cached", true).
+		Unset(Req, "x")
+
+	actions, err := vars.Actions()
+	require.NoError(t, err)
+	require.Equal(t, []Action{
+		ActionSetVar{Name: "score", Scope: VarScopeTransaction, Value: 5},
+		ActionSetVar{Name: "user", Scope: VarScopeSession, Value: "bob"},
+		ActionSetVar{Name: "hits", Scope: VarScopeProcess, Value: 1},
+		ActionSetVar{Name: "path.len", Scope: VarScopeRequest, Value: 3},
+		ActionSetVar{Name: "cached", Scope: VarScopeResponse, Value: true},
+		ActionUnsetVar{Name: "x", Scope: VarScopeRequest},
+	}, actions)
+
+	require.Equal(t, "txn.iprep.score", vars.FullName(Txn, "score"))
+	require.Equal(t, "txn.iprep.score=5 sess.iprep.user=bob proc.iprep.hits=1 req.iprep.path.len=3 res.iprep.cached=true unset req.iprep.x", vars.String())
+	require.Equal(t, "sess.user", NewVars().FullName(Sess, "user"))
+}
+
+func TestVarsInvalidName(t *testing.T) {
+	vars := NewVars().Txn("ok_1", 1).Txn("not-ok", 2).Txn("", 3)
+	require.EqualError(t, vars.Err(), `spoe: invalid variable name "not-ok"`)
+
+	_, err := vars.Actions()
+	require.Equal(t, vars.Err(), err)
+
+	for _, name := range []string{"", "a b", "é", "a-b", "a:b"} {
+		require.False(t, validVarName(name), name)
+	}
+	for _, name := range []string{"a", "A.b_9"} {
+		require.True(t, validVarName(name), name)
+	}
+}
+
+func TestVarScopeString(t *testing.T) {
+	require.Equal(t, "res", VarScopeResponse.String())
+	require.Equal(t, "scope(9)", VarScope(9).String())
+}
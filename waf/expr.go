@@ -0,0 +1,410 @@
+package waf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expressions combine conditions on the request with &&, || and !, and
+// parentheses. Conditions compare values:
+//
+//	a == b, a != b     equality
+//	a ~ "re", a !~ "re" regular expression match
+//	a contains b       substring
+//	a in "cidr,..."    IP ranges, a must be an IP
+//	a                  a is not empty
+//
+// Values are string literals, in double quotes or backquotes, the request
+// fields method, path, query, ip and body, or the functions header("name")
+// and arg("name"). A header sent several times gives its values joined with
+// ", ", so a rule sees all of them. Regular expressions and IP ranges must be literals, so
+// they are checked when the rules are loaded.
+type expr interface {
+	eval(r *request) bool
+}
+
+type value interface {
+	get(r *request) string
+}
+
+type literal string
+
+func (l literal) get(*request) string { return string(l) }
+
+type field string
+
+func (f field) get(r *request) string { return r.field(string(f)) }
+
+type headerValue string
+
+func (h headerValue) get(r *request) string {
+	return strings.Join(r.headers.Values(string(h)), ", ")
+}
+
+type argValue string
+
+func (a argValue) get(r *request) string { return r.arg(string(a)) }
+
+type andExpr struct{ left, right expr }
+
+func (e andExpr) eval(r *request) bool { return e.left.eval(r) && e.right.eval(r) }
+
+type orExpr struct{ left, right expr }
+
+func (e orExpr) eval(r *request) bool { return e.left.eval(r) || e.right.eval(r) }
+
+type notExpr struct{ e expr }
+
+func (e notExpr) eval(r *request) bool { return !e.e.eval(r) }
+
+type equalExpr struct{ left, right value }
+
+func (e equalExpr) eval(r *request) bool { return e.left.get(r) == e.right.get(r) }
+
+type containsExpr struct{ left, right value }
+
+func (e containsExpr) eval(r *request) bool { return strings.Contains(e.left.get(r), e.right.get(r)) }
+
+type matchExpr struct {
+	left value
+	re   *regexp.Regexp
+}
+
+func (e matchExpr) eval(r *request) bool { return e.re.MatchString(e.left.get(r)) }
+
+type inExpr struct {
+	left value
+	nets []*net.IPNet
+}
+
+func (e inExpr) eval(r *request) bool {
+	ip := net.ParseIP(e.left.get(r))
+	if ip == nil {
+		return false
+	}
+	for _, n := range e.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type notEmptyExpr struct{ v value }
+
+func (e notEmptyExpr) eval(r *request) bool { return e.v.get(r) != "" }
+
+var fields = map[string]bool{
+	"method": true,
+	"path":   true,
+	"query":  true,
+	"ip":     true,
+	"body":   true,
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenString
+	tokenIdent
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(s) && s[end] != c {
+				if c == '"' && s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("at offset %d: unterminated string", i)
+			}
+			text, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("at offset %d: invalid string: %s", i, err)
+			}
+			tokens = append(tokens, token{tokenString, text, i})
+			i = end + 1
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := i + 1
+			for end < len(s) && (s[end] == '_' || s[end] >= 'a' && s[end] <= 'z' || s[end] >= 'A' && s[end] <= 'Z' || s[end] >= '0' && s[end] <= '9') {
+				end++
+			}
+			tokens = append(tokens, token{tokenIdent, s[i:end], i})
+			i = end
+
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "!~", "!", "~", "(", ")"} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("at offset %d: unexpected character %q", i, c)
+			}
+			tokens = append(tokens, token{tokenOp, op, i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(s)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parseExpr compiles an expression.
+func parseExpr(s string) (expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	t := p.peek()
+	if t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) unexpected(t token) error {
+	return fmt.Errorf("at offset %d: unexpected %s", t.pos, t)
+}
+
+func (p *parser) or() (expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenOp, "||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (expr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenOp, "&&") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (expr, error) {
+	if p.accept(tokenOp, "!") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	if p.accept(tokenOp, "(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(tokenOp, ")") {
+			return nil, p.unexpected(p.peek())
+		}
+		return e, nil
+	}
+	return p.condition()
+}
+
+func (p *parser) condition() (expr, error) {
+	left, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokenOp && (t.text == "==" || t.text == "!="):
+		p.next()
+		right, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		var e expr = equalExpr{left, right}
+		if t.text == "!=" {
+			e = notExpr{e}
+		}
+		return e, nil
+
+	case t.kind == tokenOp && (t.text == "~" || t.text == "!~"):
+		p.next()
+		s, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(s.text)
+		if err != nil {
+			return nil, fmt.Errorf("at offset %d: %s", s.pos, err)
+		}
+		var e expr = matchExpr{left, re}
+		if t.text == "!~" {
+			e = notExpr{e}
+		}
+		return e, nil
+
+	case t.kind == tokenIdent && t.text == "contains":
+		p.next()
+		right, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return containsExpr{left, right}, nil
+
+	case t.kind == tokenIdent && t.text == "in":
+		p.next()
+		s, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		nets, err := parseNets(s.text)
+		if err != nil {
+			return nil, fmt.Errorf("at offset %d: %s", s.pos, err)
+		}
+		return inExpr{left, nets}, nil
+	}
+
+	return notEmptyExpr{left}, nil
+}
+
+func (p *parser) literal() (token, error) {
+	t := p.next()
+	if t.kind != tokenString {
+		return t, fmt.Errorf("at offset %d: expected a string, got %s", t.pos, t)
+	}
+	return t, nil
+}
+
+func (p *parser) value() (value, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return literal(t.text), nil
+
+	case tokenIdent:
+		if fields[t.text] {
+			return field(t.text), nil
+		}
+		if t.text != "header" && t.text != "arg" {
+			return nil, fmt.Errorf("at offset %d: unknown field %s", t.pos, t.text)
+		}
+
+		if !p.accept(tokenOp, "(") {
+			return nil, p.unexpected(p.peek())
+		}
+		name, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(tokenOp, ")") {
+			return nil, p.unexpected(p.peek())
+		}
+
+		if t.text == "header" {
+			return headerValue(name.text), nil
+		}
+		return argValue(name.text), nil
+	}
+
+	return nil, p.unexpected(t)
+}
+
+func parseNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,82 @@
+package waf
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpr(t *testing.T) {
+	r := &request{
+		args: map[string]interface{}{
+			"method":   "POST",
+			"path":     "/admin/users",
+			"query":    "id=1 UNION SELECT password",
+			"src":      net.ParseIP("192.168.1.10").To4(),
+			"req.body": []byte(`{"name": "<script>"}`),
+			"count":    3,
+		},
+		names: spoe.DefaultRequestArgNames,
+		headers: http.Header{
+			"User-Agent":      []string{"sqlmap/1.5"},
+			"X-Forwarded-For": []string{"192.0.2.1", "' OR 1=1"},
+		},
+	}
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`method == "POST"`, true},
+		{`method != "POST"`, false},
+		{`path ~ "^/admin"`, true},
+		{`path !~ "^/admin"`, false},
+		{"query ~ `(?i)union\\s+select`", true},
+		{`body contains "<script>"`, true},
+		{`ip in "10.0.0.0/8, 192.168.0.0/16"`, true},
+		{`ip in "192.168.1.11"`, false},
+		{`path in "10.0.0.0/8"`, false},
+		{`header("user-agent") ~ "sqlmap"`, true},
+		{`header("x-missing")`, false},
+		{`header("x-missing") == ""`, true},
+		{`header("x-forwarded-for") contains "' OR 1=1"`, true},
+		{`header("x-forwarded-for") == "192.0.2.1"`, false},
+		{`arg("count") == "3"`, true},
+		{`arg("missing")`, false},
+		{`method == "GET" || path contains "users"`, true},
+		{`method == "GET" || path contains "users" && ip in "10.0.0.0/8"`, false},
+		{`(method == "GET" || path contains "users") && !(ip in "10.0.0.0/8")`, true},
+		{`!!method`, true},
+		{`"a\"b" == "a\"b"`, true},
+	}
+	for _, test := range tests {
+		e, err := parseExpr(test.expr)
+		require.NoError(t, err, test.expr)
+		require.Equal(t, test.expected, e.eval(r), test.expr)
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, `at offset 0: unexpected end of expression`},
+		{`path ==`, `at offset 7: unexpected end of expression`},
+		{`path == "a" method`, `at offset 12: unexpected "method"`},
+		{`uri == "/"`, `at offset 0: unknown field uri`},
+		{`header(path)`, `at offset 7: expected a string, got "path"`},
+		{`path ~ "("`, "at offset 7: error parsing regexp: missing closing ): `(`"},
+		{`ip in "10.0.0.0/33"`, `at offset 6: invalid CIDR address: 10.0.0.0/33`},
+		{`path == "/`, `at offset 8: unterminated string`},
+		{`(path`, `at offset 5: unexpected end of expression`},
+		{`path = "/"`, `at offset 5: unexpected character '='`},
+	}
+	for _, test := range tests {
+		_, err := parseExpr(test.expr)
+		require.EqualError(t, err, test.err, test.expr)
+	}
+}
@@ -0,0 +1,288 @@
+// Package waf implements an SPOE handler filtering requests with rules
+// written in a small expression language.
+package waf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/reload"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ActionDeny  = "deny"
+	ActionAllow = "allow"
+	ActionLog   = "log"
+
+	VerdictPass = "pass"
+)
+
+type Rule struct {
+	ID     string `json:"id" yaml:"id"`
+	Expr   string `json:"expr" yaml:"expr"`
+	Action string `json:"action" yaml:"action"`
+}
+
+type compiledRule struct {
+	Rule
+	expr expr
+}
+
+type config struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// LoadRules reads and checks rules from a YAML or JSON file, depending on
+// its extension.
+func LoadRules(path string) ([]Rule, error) {
+	rules, err := loadRules(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Rule, len(rules))
+	for i, r := range rules {
+		res[i] = r.Rule
+	}
+	return res, nil
+}
+
+func loadRules(path string) ([]compiledRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("waf: %s", err)
+	}
+
+	var cfg config
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(b, &cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &cfg)
+	default:
+		return nil, fmt.Errorf("waf: unsupported rules file %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("waf: %s: %s", path, err)
+	}
+
+	rules, err := compile(cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("waf: %s: %s", path, err)
+	}
+	return rules, nil
+}
+
+func compile(rules []Rule) ([]compiledRule, error) {
+	res := make([]compiledRule, 0, len(rules))
+	ids := make(map[string]bool)
+	for _, r := range rules {
+		if r.ID == "" {
+			return nil, fmt.Errorf("rule without id")
+		}
+		if strings.Contains(r.ID, ",") {
+			return nil, fmt.Errorf("rule %s: id must not contain commas", r.ID)
+		}
+		if ids[r.ID] {
+			return nil, fmt.Errorf("duplicate rule %s", r.ID)
+		}
+		ids[r.ID] = true
+
+		if r.Action != ActionDeny && r.Action != ActionAllow && r.Action != ActionLog {
+			return nil, fmt.Errorf("rule %s: unknown action %q", r.ID, r.Action)
+		}
+
+		e, err := parseExpr(r.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.ID, err)
+		}
+		res = append(res, compiledRule{Rule: r, expr: e})
+	}
+	return res, nil
+}
+
+type Config struct {
+	// File holds the rules, as YAML or JSON:
+	//
+	//	rules:
+	//	  - id: admin-from-outside
+	//	    expr: path ~ "^/admin" && !(ip in "10.0.0.0/8,192.168.0.0/16")
+	//	    action: deny
+	//	  - id: sqli
+	//	    expr: query ~ `(?i)union\s+select` || body contains "' OR 1=1"
+	//	    action: deny
+	//	  - id: debug-header
+	//	    expr: header("x-debug")
+	//	    action: log
+	File string
+
+	// Message names the message to handle and Args the args carrying the
+	// request fields. Only Method, Path, Query, Headers, Body and
+	// ClientIP are used.
+	Message string
+	Args    spoe.RequestArgNames
+
+	// VerdictVar and MatchedVar name the transaction variables set by the
+	// handler.
+	VerdictVar string
+	MatchedVar string
+
+	// ReloadInterval is how often the file is checked for changes.
+	ReloadInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	Message:        "waf",
+	Args:           spoe.DefaultRequestArgNames,
+	VerdictVar:     "waf_verdict",
+	MatchedVar:     "waf_matched",
+	ReloadInterval: 10 * time.Second,
+}
+
+// Firewall evaluates rules.
+type Firewall struct {
+	cfg     Config
+	rules   atomic.Value
+	watcher *reload.Watcher
+}
+
+// New loads the rules of cfg and starts watching the file.
+func New(cfg Config) (*Firewall, error) {
+	f := &Firewall{cfg: cfg}
+
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	f.watcher = reload.Watch([]string{cfg.File}, cfg.ReloadInterval, f.Reload)
+	return f, nil
+}
+
+func (f *Firewall) Close() error {
+	return f.watcher.Close()
+}
+
+// Reload loads the rules again.
+func (f *Firewall) Reload() error {
+	rules, err := loadRules(f.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	f.rules.Store(rules)
+	return nil
+}
+
+// Evaluate returns the verdict for the request carried by args, as returned
+// by ArgIterator.Map, and the IDs of the matched rules. The first matching
+// deny or allow rule sets the verdict, matching log rules are only reported.
+// The verdict is pass when no such rule matches.
+func (f *Firewall) Evaluate(args map[string]interface{}) (string, []string, error) {
+	r := &request{args: args, names: f.cfg.Args}
+	if b, ok := args[f.cfg.Args.Headers].([]byte); ok && f.cfg.Args.Headers != "" {
+		var err error
+		r.headers, err = spoe.DecodeHeaders(b)
+		if err != nil {
+			return "", nil, fmt.Errorf("waf: %s", err)
+		}
+	}
+
+	verdict := VerdictPass
+	var matched []string
+	for _, rule := range f.rules.Load().([]compiledRule) {
+		if !rule.expr.eval(r) {
+			continue
+		}
+
+		matched = append(matched, rule.ID)
+		if rule.Action != ActionLog {
+			verdict = rule.Action
+			break
+		}
+	}
+
+	return verdict, matched, nil
+}
+
+func (f *Firewall) Handle(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	for msgs.Next() {
+		if msgs.Message.Name != f.cfg.Message {
+			continue
+		}
+
+		verdict, matched, err := f.Evaluate(msgs.Message.Args.Map())
+		if err != nil {
+			return nil, err
+		}
+
+		actions := []spoe.Action{
+			spoe.ActionSetVar{Name: f.cfg.VerdictVar, Scope: spoe.VarScopeTransaction, Value: verdict},
+		}
+		if len(matched) > 0 {
+			actions = append(actions, spoe.ActionSetVar{
+				Name:  f.cfg.MatchedVar,
+				Scope: spoe.VarScopeTransaction,
+				Value: strings.Join(matched, ","),
+			})
+		}
+		return actions, nil
+	}
+
+	return nil, msgs.Error()
+}
+
+// request gives expressions access to the message args.
+type request struct {
+	args    map[string]interface{}
+	names   spoe.RequestArgNames
+	headers http.Header
+}
+
+func (r *request) field(name string) string {
+	switch name {
+	case "method":
+		return r.arg(r.names.Method)
+	case "path":
+		return r.arg(r.names.Path)
+	case "query":
+		return r.arg(r.names.Query)
+	case "ip":
+		return r.arg(r.names.ClientIP)
+	case "body":
+		return r.arg(r.names.Body)
+	}
+	return ""
+}
+
+func (r *request) arg(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	switch v := r.args[name].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case net.IP:
+		return v.String()
+	case int:
+		return strconv.Itoa(v)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package waf
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/criteo/haproxy-spoe-go/internal/spoetest"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+rules:
+  - id: debug
+    expr: header("x-debug")
+    action: log
+  - id: internal
+    expr: ip in "10.0.0.0/8"
+    action: allow
+  - id: admin
+    expr: path ~ "^/admin"
+    action: deny
+`
+
+func TestLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waf")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"rules": [{"id": "a", "expr": "method == \"TRACE\"", "action": "deny"}]}`), 0644))
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+	require.Equal(t, []Rule{{ID: "a", Expr: `method == "TRACE"`, Action: ActionDeny}}, rules)
+
+	invalid := map[string]string{
+		`{"rules": [{"expr": "path", "action": "deny"}]}`:                                                         "rule without id",
+		`{"rules": [{"id": "a,b", "expr": "path", "action": "deny"}]}`:                                            "rule a,b: id must not contain commas",
+		`{"rules": [{"id": "a", "expr": "path", "action": "block"}]}`:                                             `rule a: unknown action "block"`,
+		`{"rules": [{"id": "a", "expr": "path ~ \"[\"", "action": "deny"}]}`:                                      "rule a: at offset 7: error parsing regexp: missing closing ]: `[`",
+		`{"rules": [{"id": "a", "expr": "path", "action": "log"}, {"id": "a", "expr": "path", "action": "log"}]}`: "duplicate rule a",
+	}
+	for content, msg := range invalid {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, err := LoadRules(path)
+		require.EqualError(t, err, "waf: "+path+": "+msg)
+	}
+
+	_, err = LoadRules(filepath.Join(dir, "rules.txt"))
+	require.Error(t, err)
+}
+
+func TestFirewall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waf")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testRules), 0644))
+
+	cfg := DefaultConfig
+	cfg.File = path
+	cfg.ReloadInterval = 5 * time.Millisecond
+	f, err := New(cfg)
+	require.NoError(t, err)
+	defer f.Close()
+
+	handle := func(ip, path string, debug bool) map[string]interface{} {
+		h := http.Header{}
+		if debug {
+			h.Set("X-Debug", "1")
+		}
+		headers, err := spoe.EncodeHeaders(h)
+		require.NoError(t, err)
+
+		actions, err := f.Handle(spoetest.Single("waf", map[string]interface{}{
+			"src":          net.ParseIP(ip),
+			"path":         path,
+			"req.hdrs_bin": headers,
+		}))
+		require.NoError(t, err)
+		return spoetest.Vars(actions)
+	}
+
+	require.Equal(t, map[string]interface{}{"waf_verdict": "pass"}, handle("192.0.2.1", "/", false))
+	require.Equal(t, map[string]interface{}{"waf_verdict": "deny", "waf_matched": "admin"}, handle("192.0.2.1", "/admin", false))
+	require.Equal(t, map[string]interface{}{"waf_verdict": "allow", "waf_matched": "debug,internal"}, handle("10.1.2.3", "/admin", true))
+	require.Equal(t, map[string]interface{}{"waf_verdict": "pass", "waf_matched": "debug"}, handle("192.0.2.1", "/", true))
+
+	// invalid rules are not loaded
+	require.NoError(t, ioutil.WriteFile(path, []byte("rules:\n  - id: a\n    expr: path ==\n    action: deny\n"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, "deny", handle("192.0.2.1", "/admin", false)["waf_verdict"])
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("rules:\n  - id: root\n    expr: path == \"/\"\n    action: deny\n"), 0644))
+	require.Eventually(t, func() bool {
+		return handle("192.0.2.1", "/", false)["waf_verdict"] == "deny"
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, "pass", handle("192.0.2.1", "/admin", false)["waf_verdict"])
+
+	_, err = f.Handle(spoetest.Single("waf", map[string]interface{}{"req.hdrs_bin": []byte{5, 'a'}}))
+	require.Error(t, err)
+}